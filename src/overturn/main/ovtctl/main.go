@@ -0,0 +1,9 @@
+package main
+
+import (
+	"overturn/ovtctl"
+)
+
+func main() {
+	ovtctl.Main()
+}
@@ -0,0 +1,329 @@
+package ovtctl
+
+import (
+	"errors"
+	"fmt"
+	ctlrpc "overturn/ovtd/rpc"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func cmd_version(ctl *CtlContext, args []string) error {
+	major, minor, err := ctl.Port.Version()
+	if err != nil {
+		return err
+	}
+
+	version := struct {
+		Client string
+		Daemon string
+	}{
+		Client: fmt.Sprintf("%v.%v", ctlrpc.RPC_VERSION_MAJOR, ctlrpc.RPC_VERSION_MINOR),
+		Daemon: fmt.Sprintf("%v.%v", major, minor),
+	}
+	return ctl.output(version, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Client RPC:\t%v\n", version.Client)
+		fmt.Fprintf(w, "Daemon RPC:\t%v\n", version.Daemon)
+	})
+}
+
+func cmd_status(ctl *CtlContext, args []string) error {
+	status, err := ctl.Port.GetStatus()
+	if err != nil {
+		return err
+	}
+	links, err := ctl.Port.GetInterfaceInfo("")
+	if err != nil {
+		return err
+	}
+
+	result := struct {
+		*ctlrpc.GetStatusResult
+		Interfaces []ctlrpc.InterfaceInfo
+	}{status, links}
+	return ctl.output(result, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Machine:\t%v\n", status.Machine)
+		fmt.Fprintf(w, "Active:\t%v\n\n", or_dash(status.Active))
+
+		by_network := make(map[string]ctlrpc.InterfaceInfo, len(links))
+		for _, link := range links {
+			by_network[link.Network] = link
+		}
+		fmt.Fprintln(w, "NETWORK\tLINK\tMTU\tQUEUES\tROLE\tTERM\tINDEX\tCOMMIT\tMASTER\tNODES")
+		for _, network := range status.Networks {
+			link := by_network[network.Name]
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+				network.Name, network.Link, link.MTU, link.Queues, network.Role,
+				network.Term, network.Index, network.Commit, or_dash(network.MasterName), network.Nodes)
+		}
+	})
+}
+
+func cmd_nodes(ctl *CtlContext, args []string) error {
+	flags := new_flags("nodes")
+	network := flags.String("network", "", "Network. All attached networks if empty.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	nodes, err := ctl.Port.ListNodes(*network)
+	if err != nil {
+		return err
+	}
+
+	return ctl.output(nodes, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "NETWORK\tNAME\tID\tSTATE\tRTT\tVIA\tPUBLISH")
+		for _, node := range nodes {
+			name := node.Name
+			if node.Self {
+				name += " (self)"
+			}
+			if node.Master {
+				name += " *"
+			}
+			rtt := "-"
+			if node.RTT > 0 {
+				rtt = node.RTT.Round(time.Microsecond).String()
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+				node.Network, name, node.ID, node.State, rtt, or_dash(node.Relay), strings.Join(node.Publish, ","))
+		}
+	})
+}
+
+func cmd_stats(ctl *CtlContext, args []string) error {
+	flags := new_flags("stats")
+	network := flags.String("network", "", "Network. All attached networks if empty.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	stats, err := ctl.Port.GetStats(*network)
+	if err != nil {
+		return err
+	}
+	peers, err := ctl.Port.GetProbes(*network)
+	if err != nil {
+		return err
+	}
+
+	result := struct {
+		Networks []ctlrpc.NetworkStats
+		Peers    []ctlrpc.PeerProbeInfo
+	}{stats, peers}
+	return ctl.output(result, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "NETWORK\tRX\tTX\tFRAGMENT\tRELAY\tUNKNOWN\tDROP(RELAY/DECRYPT/PLAIN/REPLAY/EPOCH/FRAGMENT)")
+		for _, s := range stats {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v/%v/%v/%v/%v/%v\n",
+				s.Network, s.RxBytes, s.WxBytes, s.Fragment, s.Relay, s.Unknown,
+				s.RelayDrop, s.DecryptDrop, s.PlaintextDrop, s.ReplayDrop, s.EpochDrop,
+				s.FragmentTimeoutDrop+s.FragmentLimitDrop+s.FragmentInvalidDrop)
+		}
+
+		fmt.Fprintln(w, "\nNETWORK\tPEER\tENDPOINT\tSENT\tLOST\tRTT\tMIN\tJITTER\tLOSS")
+		for _, peer := range peers {
+			for _, path := range peer.Paths {
+				endpoint := path.Endpoint
+				if path.Best {
+					endpoint += " *"
+				}
+				fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%.1f%%\n",
+					peer.Network, peer.Name, endpoint, path.Sent, path.Lost,
+					path.RTT.Round(time.Microsecond), path.MinRTT.Round(time.Microsecond),
+					path.Jitter.Round(time.Microsecond), path.Loss*100)
+			}
+		}
+	})
+}
+
+func cmd_join(ctl *CtlContext, args []string) error {
+	var publish, prefixes listFlag
+
+	flags := new_flags("join")
+	network := flags.String("network", "", "Network to join.")
+	token := flags.String("token", "", "Join token of network.")
+	flags.Var(&publish, "publish", "Endpoint published to other nodes. Repeatable.")
+	flags.Var(&prefixes, "prefix", "Prefix routed to this node. Repeatable.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *network == "" || *token == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New(ERR_MISSING_ARGUMENT)
+	}
+
+	link, err := ctl.Port.JoinNetwork(&ctlrpc.JoinNetworkArgs{
+		Network:  *network,
+		Address:  flags.Arg(0),
+		Token:    *token,
+		Publish:  publish,
+		Prefixes: prefixes,
+	})
+	if err != nil {
+		return err
+	}
+
+	result := struct {
+		Network string
+		Link    string
+	}{*network, link}
+	return ctl.output(result, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Joining %v via %v. (link: %v)\n", *network, flags.Arg(0), link)
+	})
+}
+
+func cmd_leave(ctl *CtlContext, args []string) error {
+	flags := new_flags("leave")
+	force := flags.Bool("force", false, "Stop network even if removal is not committed.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New(ERR_MISSING_ARGUMENT)
+	}
+
+	network := flags.Arg(0)
+	if err := ctl.Port.LeaveNetwork(network, *force); err != nil {
+		return err
+	}
+
+	result := struct{ Network string }{network}
+	return ctl.output(result, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Left network %v and stopped it.\n", network)
+	})
+}
+
+func cmd_add_node(ctl *CtlContext, args []string) error {
+	var publish, prefixes listFlag
+
+	flags := new_flags("add-node")
+	network := flags.String("network", "", "Network.")
+	id := flags.String("id", "", "Machine ID of node.")
+	name := flags.String("name", "", "Name of node.")
+	key := flags.String("key", "", "Static key of node.")
+	identity := flags.String("identity", "", "Identity key of node.")
+	flags.Var(&publish, "publish", "Endpoint published by node. Repeatable.")
+	flags.Var(&prefixes, "prefix", "Prefix routed to node. Repeatable.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *network == "" || *id == "" || *name == "" {
+		flags.Usage()
+		return errors.New(ERR_MISSING_ARGUMENT)
+	}
+
+	index, err := ctl.Port.AddNode(&ctlrpc.AddNodeArgs{
+		Network:  *network,
+		ID:       *id,
+		Name:     *name,
+		Publish:  publish,
+		Prefixes: prefixes,
+		Key:      *key,
+		Identity: *identity,
+	})
+	if err != nil {
+		return err
+	}
+
+	result := struct {
+		Network string
+		Node    string
+		Index   uint64
+	}{*network, *id, index}
+	return ctl.output(result, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Node %v added to %v. (log index: %v)\n", *name, *network, index)
+	})
+}
+
+func cmd_remove_node(ctl *CtlContext, args []string) error {
+	flags := new_flags("remove-node")
+	network := flags.String("network", "", "Network.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *network == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New(ERR_MISSING_ARGUMENT)
+	}
+
+	node := flags.Arg(0)
+	index, err := ctl.Port.RemoveNode(*network, node)
+	if err != nil {
+		return err
+	}
+
+	result := struct {
+		Network string
+		Node    string
+		Index   uint64
+	}{*network, node, index}
+	return ctl.output(result, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Node %v removed from %v. (log index: %v)\n", node, *network, index)
+	})
+}
+
+func cmd_rotate_token(ctl *CtlContext, args []string) error {
+	flags := new_flags("rotate-token")
+	network := flags.String("network", "", "Network.")
+	token := flags.String("token", "", "New join token. Generated if empty.")
+	expire_before := flags.Uint64("expire-before", 0, "Token is invalid before this unix time. 0 for none.")
+	expire_after := flags.Uint64("expire-after", 0, "Token is invalid after this unix time. 0 for none.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *network == "" {
+		flags.Usage()
+		return errors.New(ERR_MISSING_ARGUMENT)
+	}
+
+	new_token, index, err := ctl.Port.RotateToken(&ctlrpc.RotateTokenArgs{
+		Network:      *network,
+		Token:        *token,
+		ExpireBefore: *expire_before,
+		ExpireAfter:  *expire_after,
+	})
+	if err != nil {
+		return err
+	}
+
+	result := struct {
+		Network string
+		Token   string
+		Index   uint64
+	}{*network, new_token, index}
+	return ctl.output(result, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Token of %v rotated to %v. (log index: %v)\n", *network, new_token, index)
+	})
+}
+
+func cmd_reload(ctl *CtlContext, args []string) error {
+	networks, err := ctl.Port.Reload()
+	if err != nil {
+		return err
+	}
+
+	result := struct{ Networks []string }{networks}
+	return ctl.output(result, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Configure reloaded. (running: %v)\n", or_dash(strings.Join(networks, ",")))
+	})
+}
+
+func cmd_stop(ctl *CtlContext, args []string) error {
+	code, err := ctl.Port.StopDaemon()
+	if err != nil {
+		return err
+	}
+
+	result := struct{ ExitCode int }{code}
+	if err = ctl.output(result, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Daemon stopped. (exit code: %v)\n", code)
+	}); err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("Daemon stopped with errors. (exit code: %v)", code)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package ovtctl
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	ctlrpc "overturn/ovtd/rpc"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	ERR_MISSING_COMMAND  = "Missing command."
+	ERR_UNKNOWN_COMMAND  = "Unknown command."
+	ERR_MISSING_ARGUMENT = "Missing argument."
+)
+
+type Options struct {
+	Control string
+	JSON    bool
+}
+
+// Command : Subcommand run against daemon over control socket.
+type Command struct {
+	Usage string
+	Brief string
+	Run   func(ctl *CtlContext, args []string) error
+}
+
+// CtlContext : Connection to daemon and output settings shared by commands.
+type CtlContext struct {
+	*Options
+	Port *ctlrpc.UserRPCPort
+}
+
+// COMMANDS : Commands by name. Filled in init, since commands refer to it for usage.
+var COMMANDS map[string]*Command
+
+func init() {
+	COMMANDS = map[string]*Command{
+		"version":      {"version", "Print RPC version of client and daemon.", cmd_version},
+		"status":       {"status", "Print machine ID, networks and their election state.", cmd_status},
+		"nodes":        {"nodes [-network name]", "List nodes of networks.", cmd_nodes},
+		"stats":        {"stats [-network name]", "Print traffic counters and path probes.", cmd_stats},
+		"join":         {"join -network name -token token [-publish ep] [-prefix cidr] address", "Join network via publish address of a member.", cmd_join},
+		"leave":        {"leave [-force] name", "Remove this node from network and stop it.", cmd_leave},
+		"add-node":     {"add-node -network name -id id -name name [-publish ep] [-prefix cidr] [-key key] [-identity key]", "Admit node to network. Daemon should be master.", cmd_add_node},
+		"remove-node":  {"remove-node -network name node", "Remove node of ID or name from network. Daemon should be master.", cmd_remove_node},
+		"rotate-token": {"rotate-token -network name [-token token] [-expire-before unix] [-expire-after unix]", "Replace join token of network. Daemon should be master.", cmd_rotate_token},
+		"reload":       {"reload", "Read configure again and restart networks.", cmd_reload},
+		"stop":         {"stop", "Stop daemon gracefully.", cmd_stop},
+	}
+}
+
+// listFlag : Flag given repeatedly or as comma separated values.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %v [options] command [arguments]\n\nOptions:\n", os.Args[0])
+	flag.PrintDefaults()
+
+	names := make([]string, 0, len(COMMANDS))
+	for name := range COMMANDS {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %v\t%v\n", name, COMMANDS[name].Brief)
+	}
+	w.Flush()
+}
+
+func parse_args() (*Options, []string) {
+	ctl := flag.String(
+		"control",
+		"unix:/var/run/ovtd.sock",
+		"Control socket of daemon.",
+	)
+
+	as_json := flag.Bool(
+		"json",
+		false,
+		"Print result in JSON.",
+	)
+
+	help := flag.Bool(
+		"help",
+		false,
+		"Print the usage.",
+	)
+
+	flag.Usage = usage
+	flag.Parse()
+
+	if *help {
+		flag.Usage()
+		return nil, nil
+	}
+
+	return &Options{
+		Control: *ctl,
+		JSON:    *as_json,
+	}, flag.Args()
+}
+
+func Main() {
+	opts, args := parse_args()
+	if opts == nil {
+		return
+	}
+	if len(args) < 1 {
+		fail(errors.New(ERR_MISSING_COMMAND))
+	}
+	cmd, ok := COMMANDS[args[0]]
+	if !ok {
+		fail(fmt.Errorf("%v (%v)", ERR_UNKNOWN_COMMAND, args[0]))
+	}
+
+	port, err := ctlrpc.NewUserRPCPort(opts.Control)
+	if err != nil {
+		fail(err)
+	}
+	defer port.Close()
+
+	if err = cmd.Run(&CtlContext{Options: opts, Port: port}, args[1:]); err != nil {
+		port.Close()
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "%v: %v\n", os.Args[0], err.Error())
+	os.Exit(1)
+}
+
+// new_flags : Flag set of command. Usage of command is printed on error.
+func new_flags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %v %v\n", os.Args[0], COMMANDS[name].Usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// output : Print value in JSON, or as table otherwise.
+func (ctl *CtlContext) output(value interface{}, table func(w *tabwriter.Writer)) error {
+	if ctl.JSON {
+		buf, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(buf))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
+
+func or_dash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,90 @@
+package ovtd
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net"
+	"sort"
+)
+
+const (
+	CAPTURE_AUTO     = "auto"
+	CAPTURE_IPTABLES = "iptables"
+	CAPTURE_NFTABLES = "nftables"
+)
+
+// CaptureBackend : Mark traffics to destinations of network, so that policy routing steers them into link tunnel.
+type CaptureBackend interface {
+	Name() string
+
+	// RefreshRules : (Re)apply mark rules. Captured set is kept.
+	RefreshRules() error
+
+	// ClearRules : Remove mark rules and captured set.
+	ClearRules()
+
+	// SyncSet : Replace destinations in captured set.
+	SyncSet(prefixes []*net.IPNet) error
+
+	// Verify : Check rules and captured set are still in place.
+	Verify() error
+
+	// IPv6 : Whether IPv6 traffics are captured.
+	IPv6() bool
+}
+
+// CapturePort : Local port of tunnel. Traffics of tunnel itself is never captured.
+type CapturePort struct {
+	Proto uint8
+	Port  uint16
+	Dst   bool
+}
+
+// NewCaptureBackend : Create capture backend by name. Auto prefers nftables if kernel supports it.
+// Chains, sets and tables are named by tag of network.
+func NewCaptureBackend(name string, tag string, mark uint32, ignore []CapturePort) (CaptureBackend, error) {
+	switch name {
+	case CAPTURE_IPTABLES:
+		return NewIptablesCapture(tag, mark, ignore)
+
+	case CAPTURE_NFTABLES:
+		return NewNftablesCapture(tag, mark, ignore)
+
+	case CAPTURE_AUTO, "":
+		backend, err := NewNftablesCapture(tag, mark, ignore)
+		if err == nil {
+			return backend, nil
+		}
+		log.WithFields(log.Fields{
+			"module":     "Capture",
+			"err_detail": err.Error(),
+		}).Info("nftables not available. Fallback to iptables.")
+		return NewIptablesCapture(tag, mark, ignore)
+	}
+	return nil, fmt.Errorf("Unknown capture backend %v.", name)
+}
+
+// merge_prefixes : Drop prefixes covered by others, so that rest are disjoint.
+func merge_prefixes(prefixes []*net.IPNet) []*net.IPNet {
+	sorted := make([]*net.IPNet, len(prefixes))
+	copy(sorted, prefixes)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if c := bytes.Compare(a.IP.To16(), b.IP.To16()); c != 0 {
+			return c < 0
+		}
+		a_ones, _ := a.Mask.Size()
+		b_ones, _ := b.Mask.Size()
+		return a_ones < b_ones
+	})
+
+	merged := make([]*net.IPNet, 0, len(sorted))
+	for _, prefix := range sorted {
+		if n := len(merged); n > 0 && merged[n-1].Contains(prefix.IP) {
+			continue
+		}
+		merged = append(merged, prefix)
+	}
+	return merged
+}
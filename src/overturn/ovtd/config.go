@@ -2,31 +2,80 @@ package ovtd
 
 import (
 	"flag"
+	"fmt"
 	yaml "gopkg.in/yaml.v2"
 	"os"
 )
 
 type NodeConfigYAML struct {
-	Name    string   `yaml:"name"`
-	Publish []string `yaml:"publish"`
-	Active  bool     `yaml:"active"`
+	Name     string   `yaml:"name"`
+	Publish  []string `yaml:"publish"`
+	Prefixes []string `yaml:"prefixes,omitempty"`
+	Active   bool     `yaml:"active"`
+	Key      string   `yaml:"key,omitempty"`
+	Identity string   `yaml:"identity,omitempty"`
+}
+
+type LogEntryYAML struct {
+	Index             uint64   `yaml:"index"`
+	Term              uint64   `yaml:"term"`
+	Op                string   `yaml:"op"`
+	Node              string   `yaml:"node,omitempty"`
+	Name              string   `yaml:"name,omitempty"`
+	Publish           []string `yaml:"publish,omitempty"`
+	Prefixes          []string `yaml:"prefixes,omitempty"`
+	Token             string   `yaml:"token,omitempty"`
+	TokenExpireBefore uint64   `yaml:"token_expire_before,omitempty"`
+	TokenExpireAfter  uint64   `yaml:"token_expire_after,omitempty"`
+	Key               string   `yaml:"key,omitempty"`
+	Identity          string   `yaml:"identity,omitempty"`
+	Issuer            string   `yaml:"issuer,omitempty"`
+	Signature         string   `yaml:"signature,omitempty"`
+}
+
+// JoinConfigYAML : Join in progress. Cleared once join is accepted or rejected.
+type JoinConfigYAML struct {
+	Address  string   `yaml:"address"`
+	Token    string   `yaml:"token"`
+	Publish  []string `yaml:"publish,omitempty"`
+	Prefixes []string `yaml:"prefixes,omitempty"`
 }
 
 type NetworkClusterYAML struct {
 	Token             string                     `yaml:"token"`
 	TokenExpireBefore uint64                     `yaml:"token_expire_before"`
 	TokenExpireAfter  uint64                     `yaml:"token_expire_after"`
+	Transport         string                     `yaml:"transport,omitempty"`
+	Port              uint16                     `yaml:"port,omitempty"`
+	Fallback          string                     `yaml:"fallback,omitempty"`
+	StreamPort        uint16                     `yaml:"stream_port,omitempty"`
+	TLSCert           string                     `yaml:"tls_cert,omitempty"`
+	TLSKey            string                     `yaml:"tls_key,omitempty"`
+	TLSCA             string                     `yaml:"tls_ca,omitempty"`
+	Insecure          bool                       `yaml:"insecure,omitempty"`
+	MTU               uint32                     `yaml:"mtu,omitempty"`
+	Multipath         string                     `yaml:"multipath,omitempty"`
 	Term              uint64                     `yaml:"term"`
+	Vote              string                     `yaml:"vote,omitempty"`
+	Masters           map[uint64]string          `yaml:"masters,omitempty"`
 	HeartbeatPeriod   uint32                     `yaml:"heartbeat_period"`
 	HeartbeatTimeout  uint32                     `yaml:"heartbeat_timeout"`
 	Index             uint64                     `yaml:"index"`
+	Commit            uint64                     `yaml:"commit"`
+	Compacted         uint64                     `yaml:"compacted,omitempty"`
+	CompactedTerm     uint64                     `yaml:"compacted_term,omitempty"`
 	Nodes             map[string]*NodeConfigYAML `yaml:"nodes"`
+	Log               []*LogEntryYAML            `yaml:"log,omitempty"`
+	Join              *JoinConfigYAML            `yaml:"join,omitempty"`
 }
 
 type DynamicConfigYAML struct {
-	Active  string                         `yaml:"active"`
-	Machine string                         `yaml:"machine_id"`
-	Network map[string]*NetworkClusterYAML `yaml:"network,omitempty"`
+	Active    string                         `yaml:"active"`
+	Machine   string                         `yaml:"machine_id"`
+	StaticKey string                         `yaml:"static_key,omitempty"`
+	Identity  string                         `yaml:"identity_key,omitempty"`
+	Network   map[string]*NetworkClusterYAML `yaml:"network,omitempty"`
+	Attached  []string                       `yaml:"attached,omitempty"`
 }
 
 type DynamicConfig struct {
@@ -38,6 +87,7 @@ type Options struct {
 	ClusterConfig    string
 	PIDFile          string
 	Control          string
+	Capture          string
 	HeartbeatTimeout uint32
 	HeartbeatPeriod  uint32
 }
@@ -93,6 +143,18 @@ func (cfg *DynamicConfig) Save() error {
 }
 
 func (cfg *DynamicConfig) Load() error {
+	config, err := cfg.Read()
+	if err != nil {
+		return err
+	}
+	if config != nil {
+		cfg.Config = *config
+	}
+	return nil
+}
+
+// Read : Parse configure file without touching loaded configure. nil if file is empty.
+func (cfg *DynamicConfig) Read() (*DynamicConfigYAML, error) {
 	var info os.FileInfo
 	var err error
 
@@ -102,21 +164,42 @@ func (cfg *DynamicConfig) Load() error {
 
 	cfg.file.Seek(0, os.SEEK_SET)
 	if _, err := cfg.file.Read(buf); err != nil {
-		return nil
+		return nil, nil
 	}
 
-	err = yaml.Unmarshal(buf, &cfg.Config)
+	config := new(DynamicConfigYAML)
+	err = yaml.Unmarshal(buf, config)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if cfg.Config.Network == nil {
-		cfg.Config.Network = make(map[string]*NetworkClusterYAML)
+	if config.Network == nil {
+		config.Network = make(map[string]*NetworkClusterYAML)
 	}
-	return nil
+	return config, nil
 }
 
-func (cfg *DynamicConfig) GetPart(begin uint64, end uint64) {
+// GetPart : Get membership log entries of network in [begin, end).
+func (cfg *DynamicConfig) GetPart(network string, begin uint64, end uint64) ([]*LogEntryYAML, error) {
+	net_cfg, ok := cfg.Config.Network[network]
+	if !ok || net_cfg == nil {
+		return nil, fmt.Errorf("Network %v not found.", network)
+	}
+	if begin >= end {
+		return nil, nil
+	}
+
+	part := make([]*LogEntryYAML, 0, end-begin)
+	for _, entry := range net_cfg.Log {
+		if entry.Index >= begin && entry.Index < end {
+			part = append(part, entry)
+		}
+	}
+	if uint64(len(part)) != end-begin {
+		return part, fmt.Errorf("Log entries [%v, %v) not complete. (found: %v)", begin, end, len(part))
+	}
+
+	return part, nil
 }
 
 func parse_args() *Options {
@@ -138,6 +221,12 @@ func parse_args() *Options {
 		"Control socket.",
 	)
 
+	capture := flag.String(
+		"capture",
+		CAPTURE_AUTO,
+		"Traffic capture backend. (auto, iptables or nftables)",
+	)
+
 	hb_timeout := flag.Uint(
 		"default-heartbeat-timeout",
 		1000,
@@ -167,6 +256,7 @@ func parse_args() *Options {
 		ClusterConfig:    *dyn_cfg,
 		PIDFile:          *pid,
 		Control:          *ctl,
+		Capture:          *capture,
 		HeartbeatTimeout: uint32(*hb_timeout),
 		HeartbeatPeriod:  uint32(*hb_period),
 	}
@@ -1,26 +1,52 @@
 package ovtd
 
 import (
+	"crypto/ed25519"
 	"errors"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/google/uuid"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 )
 
 const (
 	ERR_CANNOT_GEN_MACHINE_ID = "Cannot generate machine ID."
 	ERR_NO_ACTIVE_NETWORK     = "No active network."
 	ERR_CONF_PERSIST          = "Cannot persist configure."
+	ERR_CANNOT_GEN_STATIC_KEY = "Cannot generate static key."
+	ERR_CANNOT_GEN_IDENTITY   = "Cannot generate identity key."
+	ERR_NETWORK_ATTACHED      = "Network already attached."
+	ERR_NETWORK_NOT_ATTACHED  = "Network not attached."
+	ERR_NETWORK_NAME_EMPTY    = "Network name is empty."
+	ERR_DAEMON_STOPPING       = "Daemon is stopping."
+	ERR_RELOAD_IDENTITY       = "Machine ID and keys cannot change on reload."
 )
 
 type Controller struct {
 	*Options
 	*DynamicConfig
 	Machine   uuid.UUID
+	Key       *StaticKey
+	Identity  ed25519.PrivateKey
 	RPCServer *UserRPCServer
+
+	// Running networks by name.
+	Networks map[string]*ClusterManager
+
+	// Exit code of daemon, decided when stopped.
+	ExitCode int
+
+	lock        sync.Mutex
+	config_lock sync.Mutex // guards DynamicConfig. Managers also hold it when changing their configure.
+	stopping    bool
+	stop_once   sync.Once
 }
 
 func NewController(opts *Options) *Controller {
-	return &Controller{Options: opts, DynamicConfig: nil}
+	return &Controller{Options: opts, DynamicConfig: nil, Networks: make(map[string]*ClusterManager)}
 }
 
 func NewID() (string, error) {
@@ -32,6 +58,8 @@ func NewID() (string, error) {
 }
 
 func (ctl *Controller) PersistDynamicClusterConfig() error {
+	ctl.config_lock.Lock()
+	defer ctl.config_lock.Unlock()
 
 	if err := ctl.DynamicConfig.Save(); err != nil {
 		log.WithFields(log.Fields{
@@ -51,6 +79,10 @@ func (ctl *Controller) GetMachineID() uuid.UUID {
 	return ctl.Machine
 }
 
+func (ctl *Controller) GetIdentity() ed25519.PublicKey {
+	return ctl.Identity.Public().(ed25519.PublicKey)
+}
+
 func (ctl *Controller) Run() error {
 	var err error
 	var cfg *DynamicConfig
@@ -77,13 +109,6 @@ func (ctl *Controller) Run() error {
 		return err
 	}
 
-	if cfg.Config.Active == "" {
-		log.WithFields(log.Fields{
-			"module": "Controller",
-		}).Error(ERR_NO_ACTIVE_NETWORK)
-		return errors.New(ERR_NO_ACTIVE_NETWORK)
-	}
-
 	// Parse ID
 	if cfg.Config.Machine == "" {
 		cfg.Config.Machine, err = NewID()
@@ -110,28 +135,52 @@ func (ctl *Controller) Run() error {
 		return errors.New("Invalid machine ID.")
 	}
 
-	// start network cluster
-	var exists bool
-	var active_config *NetworkClusterYAML
-	active_config, exists = cfg.Config.Network[cfg.Config.Active]
-	if active_config == nil || !exists { // create with default configure.
+	// Identity key signs messages issued by this node.
+	if cfg.Config.Identity == "" {
+		if ctl.Identity, err = NewIdentity(); err != nil {
+			log.WithFields(log.Fields{
+				"module":     "Controller",
+				"err_detail": err.Error(),
+			}).Error(ERR_CANNOT_GEN_IDENTITY)
+			return errors.New(ERR_CANNOT_GEN_IDENTITY)
+		}
+		cfg.Config.Identity = EncodeIdentity(ctl.Identity)
 
 		log.WithFields(log.Fields{
 			"module": "Controller",
-		}).Warningf("Create non-existing active network %v.", cfg.Config.Active)
-
-		active_config = &NetworkClusterYAML{
-			Token:             "",
-			TokenExpireBefore: 0,
-			TokenExpireAfter:  0,
-			Term:              0,
-			HeartbeatPeriod:   opts.HeartbeatPeriod,
-			HeartbeatTimeout:  opts.HeartbeatTimeout,
-			Index:             0,
-			Nodes:             make(map[string]*NodeConfigYAML),
+		}).Warningf("New identity: %v", EncodeKey(IdentityKey(ctl.GetIdentity())))
+		updated = true
+	} else if ctl.Identity, err = ParseIdentity(cfg.Config.Identity); err != nil {
+		log.WithFields(log.Fields{
+			"module":     "Controller",
+			"event":      "initialize",
+			"err_detail": err.Error(),
+		}).Error("Invalid identity key.")
+		return errors.New("Invalid identity key.")
+	}
+
+	// Static key for peer sessions.
+	if cfg.Config.StaticKey == "" {
+		if ctl.Key, err = NewStaticKey(); err != nil {
+			log.WithFields(log.Fields{
+				"module":     "Controller",
+				"err_detail": err.Error(),
+			}).Error(ERR_CANNOT_GEN_STATIC_KEY)
+			return errors.New(ERR_CANNOT_GEN_STATIC_KEY)
 		}
+		cfg.Config.StaticKey = ctl.Key.String()
 
-		cfg.Config.Network[cfg.Config.Active] = active_config
+		log.WithFields(log.Fields{
+			"module": "Controller",
+		}).Warningf("New static key: %v", EncodeKey(ctl.Key.Public))
+		updated = true
+	} else if ctl.Key, err = ParseStaticKey(cfg.Config.StaticKey); err != nil {
+		log.WithFields(log.Fields{
+			"module":     "Controller",
+			"event":      "initialize",
+			"err_detail": err.Error(),
+		}).Error("Invalid static key.")
+		return errors.New("Invalid static key.")
 	}
 
 	ctl.DynamicConfig = cfg
@@ -142,15 +191,366 @@ func (ctl *Controller) Run() error {
 		}
 	}
 
-	if ctl.RPCServer, err = NewUserRPCServer(ctl.Options.Control); err != nil {
+	if ctl.RPCServer, err = NewUserRPCServer(ctl.Options.Control, ctl); err != nil {
 		return err
 	}
+	go ctl.watch_signals()
 
-	var cluster_manager *ClusterManager
-	cluster_manager, err = NewClusterManager(ctl, active_config)
-	cluster_manager.Start()
+	// start network clusters
+	boot := ctl.boot_networks()
+	if len(boot) < 1 {
+		log.WithFields(log.Fields{
+			"module": "Controller",
+		}).Warning(ERR_NO_ACTIVE_NETWORK)
+	}
+	ReconcileCapture(boot)
+	for _, name := range boot {
+		ctl.AttachNetwork(name)
+	}
 
-	// RPC here
+	// RPC here. Serve until daemon stops.
 	return ctl.RPCServer.Serve()
+}
+
+// watch_signals : SIGTERM and SIGINT stop daemon as StopDaemon RPC does.
+func (ctl *Controller) watch_signals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	sig := <-signals
+	signal.Stop(signals)
+	log.WithFields(log.Fields{
+		"module": "Controller",
+		"event":  "stop",
+	}).Warningf("Received %v. Stop daemon.", sig)
+	ctl.Stop()
+}
+
+// Stop : Tear down all networks, persist configure and stop serving RPC. Return exit code of daemon.
+// Networks stay attached in configure, so they are started again with daemon.
+func (ctl *Controller) Stop() int {
+	ctl.stop_once.Do(func() {
+		ctl.ExitCode = ctl.shutdown()
+	})
+	return ctl.ExitCode
+}
+
+func (ctl *Controller) shutdown() int {
+	code := 0
+
+	ctl.lock.Lock()
+	ctl.stopping = true
+	for name, nm := range ctl.Networks {
+		if err := ctl.release_network(name, nm); err != nil {
+			code = 1
+		}
+		delete(ctl.Networks, name)
+	}
+	ctl.lock.Unlock()
+
+	if ctl.DynamicConfig != nil {
+		if err := ctl.PersistDynamicClusterConfig(); err != nil {
+			code = 1
+		}
+	}
+	if ctl.RPCServer != nil {
+		ctl.RPCServer.Close()
+	}
+
+	log.WithFields(log.Fields{
+		"module": "Controller",
+		"event":  "stop",
+	}).Warningf("Daemon stopped. (exit code: %v)", code)
+
+	return code
+}
+
+// boot_networks : Networks started with daemon. Active network goes first.
+func (ctl *Controller) boot_networks() []string {
+	names := make([]string, 0, len(ctl.DynamicConfig.Config.Attached)+1)
+	if ctl.DynamicConfig.Config.Active != "" {
+		names = append(names, ctl.DynamicConfig.Config.Active)
+	}
+	for _, name := range ctl.DynamicConfig.Config.Attached {
+		if name != ctl.DynamicConfig.Config.Active {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// network_config : Configure of network. Created with default configure if not exists.
+func (ctl *Controller) network_config(name string) *NetworkClusterYAML {
+	ctl.config_lock.Lock()
+	defer ctl.config_lock.Unlock()
+
+	config, exists := ctl.DynamicConfig.Config.Network[name]
+	if config != nil && exists {
+		return config
+	}
+
+	log.WithFields(log.Fields{
+		"module": "Controller",
+	}).Warningf("Create non-existing network %v.", name)
+
+	config = &NetworkClusterYAML{
+		Token:             "",
+		TokenExpireBefore: 0,
+		TokenExpireAfter:  0,
+		Term:              0,
+		HeartbeatPeriod:   ctl.Options.HeartbeatPeriod,
+		HeartbeatTimeout:  ctl.Options.HeartbeatTimeout,
+		Index:             0,
+		Nodes:             make(map[string]*NodeConfigYAML),
+	}
+	ctl.DynamicConfig.Config.Network[name] = config
+	return config
+}
+
+// free_slot : Lowest slot not occupied by running networks.
+func (ctl *Controller) free_slot() int {
+	used := make(map[int]bool, len(ctl.Networks))
+	for _, nm := range ctl.Networks {
+		used[nm.Slot] = true
+	}
+	slot := 0
+	for used[slot] {
+		slot++
+	}
+	return slot
+}
+
+// check_ports : Refuse network listening on port of a running network. Raw ICMP sockets are shared instead.
+func (ctl *Controller) check_ports(config *NetworkClusterYAML) error {
+	for _, port := range listen_ports(config) {
+		for name, nm := range ctl.Networks {
+			for _, used := range listen_ports(nm.Config) {
+				if used.Proto == port.Proto && used.Port == port.Port {
+					return fmt.Errorf("Port %v is already used by network %v. Set a distinct port in network configure.", port.Port, name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// set_attached : Record whether network is started with daemon.
+func (ctl *Controller) set_attached(name string, attached bool) {
+	ctl.config_lock.Lock()
+	defer ctl.config_lock.Unlock()
+
+	cfg := &ctl.DynamicConfig.Config
+	kept := make([]string, 0, len(cfg.Attached)+1)
+	for _, existing := range cfg.Attached {
+		if existing != name {
+			kept = append(kept, existing)
+		}
+	}
+	if attached {
+		kept = append(kept, name)
+	} else if cfg.Active == name {
+		cfg.Active = ""
+	}
+	cfg.Attached = kept
+}
+
+// AttachNetwork : Start network in daemon. Attached networks are started again when daemon restarts.
+func (ctl *Controller) AttachNetwork(name string) (*ClusterManager, error) {
+	ctl.lock.Lock()
+	defer ctl.lock.Unlock()
+
+	if name == "" {
+		return nil, errors.New(ERR_NETWORK_NAME_EMPTY)
+	}
+	if ctl.stopping {
+		return nil, errors.New(ERR_DAEMON_STOPPING)
+	}
+	return ctl.attach_network(name)
+}
+
+// attach_network : Create and start network. Called with lock held.
+func (ctl *Controller) attach_network(name string) (*ClusterManager, error) {
+	var err error
+	var nm *ClusterManager
+
+	fallback := func(err error, desp string) (*ClusterManager, error) {
+		log.WithFields(log.Fields{
+			"module":     "Controller",
+			"event":      "attach",
+			"err_detail": err.Error(),
+		}).Error(desp)
+		return nil, err
+	}
+
+	if _, exists := ctl.Networks[name]; exists {
+		return nil, errors.New(ERR_NETWORK_ATTACHED)
+	}
+
+	config := ctl.network_config(name)
+	if err = ctl.check_ports(config); err != nil {
+		return fallback(err, fmt.Sprintf("Cannot create network %v.", name))
+	}
+	if nm, err = NewClusterManager(ctl, name, ctl.free_slot(), config); err != nil {
+		return fallback(err, fmt.Sprintf("Cannot create network %v.", name))
+	}
+	if err = nm.Start(); err != nil {
+		nm.Destroy()
+		return fallback(err, fmt.Sprintf("Cannot start network %v.", name))
+	}
+	ctl.Networks[name] = nm
+
+	ctl.set_attached(name, true)
+	if err = ctl.PersistDynamicClusterConfig(); err != nil {
+		return nm, err
+	}
+
+	log.WithFields(log.Fields{
+		"module": "Controller",
+		"event":  "attach",
+	}).Infof("Network %v attached. (link: %v, mark: 0x%x, table: %v)", name, nm.LinkTun.Link.Name, nm.IptMark, nm.RtTable)
+
+	return nm, nil
+}
+
+// ActiveNetwork : Name of active network. Empty if none.
+func (ctl *Controller) ActiveNetwork() string {
+	ctl.config_lock.Lock()
+	defer ctl.config_lock.Unlock()
+	return ctl.DynamicConfig.Config.Active
+}
+
+// LookupNetworks : Running networks by name. All running networks if name is empty.
+func (ctl *Controller) LookupNetworks(name string) (map[string]*ClusterManager, error) {
+	ctl.lock.Lock()
+	defer ctl.lock.Unlock()
+
+	if name == "" {
+		networks := make(map[string]*ClusterManager, len(ctl.Networks))
+		for running, nm := range ctl.Networks {
+			networks[running] = nm
+		}
+		return networks, nil
+	}
+
+	nm, exists := ctl.Networks[name]
+	if !exists {
+		return nil, errors.New(ERR_NETWORK_NOT_ATTACHED)
+	}
+	return map[string]*ClusterManager{name: nm}, nil
+}
+
+// LookupNetwork : Running network of name. Empty name never refers to all networks.
+func (ctl *Controller) LookupNetwork(name string) (*ClusterManager, error) {
+	if name == "" {
+		return nil, errors.New(ERR_NETWORK_NAME_EMPTY)
+	}
+
+	ctl.lock.Lock()
+	defer ctl.lock.Unlock()
+
+	nm, exists := ctl.Networks[name]
+	if !exists {
+		return nil, errors.New(ERR_NETWORK_NOT_ATTACHED)
+	}
+	return nm, nil
+}
+
+// release_network : Stop tunnels of network, and remove its link, capture rules and kernel routes.
+func (ctl *Controller) release_network(name string, nm *ClusterManager) error {
+	err := nm.Stop()
+	if destroy_err := nm.Destroy(); destroy_err != nil {
+		log.WithFields(log.Fields{
+			"module":     "Controller",
+			"event":      "release",
+			"err_detail": destroy_err.Error(),
+		}).Warningf("Cannot release resources of network %v.", name)
+		err = destroy_err
+	}
+	return err
+}
+
+// DetachNetwork : Stop network and release its link, rules and routes. Configure of network is kept.
+func (ctl *Controller) DetachNetwork(name string) error {
+	ctl.lock.Lock()
+	defer ctl.lock.Unlock()
+
+	nm, exists := ctl.Networks[name]
+	if !exists {
+		return errors.New(ERR_NETWORK_NOT_ATTACHED)
+	}
+	delete(ctl.Networks, name)
+
+	ctl.release_network(name, nm)
+	ctl.set_attached(name, false)
+	if err := ctl.PersistDynamicClusterConfig(); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"module": "Controller",
+		"event":  "detach",
+	}).Infof("Network %v detached.", name)
+
+	return nil
+}
+
+// Reload : Read configure file again and restart networks from it. Networks attached in file are
+// started, others are stopped. Returns networks running after reload.
+func (ctl *Controller) Reload() ([]string, error) {
+	fallback := func(err error) ([]string, error) {
+		log.WithFields(log.Fields{
+			"module":     "Controller",
+			"event":      "reload",
+			"err_detail": err.Error(),
+		}).Error("Cannot reload configure.")
+		return nil, err
+	}
+
+	ctl.lock.Lock()
+	defer ctl.lock.Unlock()
+
+	if ctl.stopping {
+		return nil, errors.New(ERR_DAEMON_STOPPING)
+	}
+
+	ctl.config_lock.Lock()
+	config, err := ctl.DynamicConfig.Read()
+	if err == nil && config == nil {
+		err = errors.New("Configure file is empty.")
+	}
+	if err == nil {
+		current := &ctl.DynamicConfig.Config
+		if config.Machine != current.Machine || config.StaticKey != current.StaticKey || config.Identity != current.Identity {
+			err = errors.New(ERR_RELOAD_IDENTITY)
+		}
+	}
+	ctl.config_lock.Unlock()
+	if err != nil {
+		return fallback(err)
+	}
+
+	// Running networks refer to configure being replaced.
+	for name, nm := range ctl.Networks {
+		ctl.release_network(name, nm)
+		delete(ctl.Networks, name)
+	}
+
+	ctl.config_lock.Lock()
+	ctl.DynamicConfig.Config = *config
+	ctl.config_lock.Unlock()
+
+	running := make([]string, 0)
+	ReconcileCapture(ctl.boot_networks())
+	for _, name := range ctl.boot_networks() {
+		if _, err := ctl.attach_network(name); err == nil {
+			running = append(running, name)
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"module": "Controller",
+		"event":  "reload",
+	}).Infof("Configure reloaded. (running: %v)", running)
 
+	return running, nil
 }
@@ -0,0 +1,128 @@
+package ovtd
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"net"
+	"overturn/protocol"
+	"sync/atomic"
+)
+
+// Inbound : Where a message comes from.
+// Relayed messages come in frames from original sender, wrapped by relay from next hop.
+type Inbound struct {
+	Via     NetTunnel
+	From    net.Addr
+	Frame   protocol.OVTPacket
+	Relayed bool
+}
+
+// MessageHandler : Handle message decoded from inbound packet.
+type MessageHandler func(msg protocol.Message, in *Inbound)
+
+// Handle : Register handler of message type. Message type should be registered in protocol.
+func (nm *ClusterManager) Handle(msg_type uint16, handler MessageHandler) {
+	nm.handler_lock.Lock()
+	defer nm.handler_lock.Unlock()
+	nm.handlers[msg_type] = handler
+}
+
+func (nm *ClusterManager) handler_of(msg_type uint16) MessageHandler {
+	nm.handler_lock.RLock()
+	defer nm.handler_lock.RUnlock()
+	return nm.handlers[msg_type]
+}
+
+func (nm *ClusterManager) register_handlers() {
+	nm.Handle(protocol.NODE_ACTIVATE, func(msg protocol.Message, in *Inbound) {
+		nm.OnNodeActivate(msg.(*protocol.NodeActivate), in.Frame)
+	})
+	heartbeat := func(msg protocol.Message, in *Inbound) {
+		nm.OnHeartbeat(msg.Type(), msg.(*protocol.Heartbeat), in)
+	}
+	nm.Handle(protocol.HEARTBEAT_MASTER, heartbeat)
+	nm.Handle(protocol.HEARTBEAT_NODE, heartbeat)
+	nm.Handle(protocol.VOTE_REQUEST, func(msg protocol.Message, in *Inbound) {
+		nm.OnVoteRequest(msg.(*protocol.VoteRequest), in.Frame)
+	})
+	nm.Handle(protocol.VOTE_RESPONSE, func(msg protocol.Message, in *Inbound) {
+		nm.OnVoteResponse(msg.(*protocol.VoteResponse), in.Frame)
+	})
+	nm.Handle(protocol.LOG_ENTRY, func(msg protocol.Message, in *Inbound) {
+		nm.OnLogEntry(msg.(*protocol.LogEntry), in.Frame)
+	})
+	nm.Handle(protocol.LOG_ACK, func(msg protocol.Message, in *Inbound) {
+		nm.OnLogAck(msg.(*protocol.LogAck), in.Frame)
+	})
+	nm.Handle(protocol.LOG_PROPOSE, func(msg protocol.Message, in *Inbound) {
+		nm.OnLogPropose(msg.(*protocol.LogPropose), in)
+	})
+	nm.Handle(protocol.LOG_FETCH, func(msg protocol.Message, in *Inbound) {
+		nm.OnLogFetch(msg.(*protocol.LogFetch))
+	})
+	nm.Handle(protocol.JOIN_REQUEST, func(msg protocol.Message, in *Inbound) {
+		nm.OnJoinRequest(msg.(*protocol.JoinRequest), in.Via, in.From, in.Frame)
+	})
+	nm.Handle(protocol.JOIN_RESPONSE, func(msg protocol.Message, in *Inbound) {
+		nm.OnJoinResponse(msg.(*protocol.JoinResponse), in.From)
+	})
+	nm.Handle(protocol.HANDSHAKE, func(msg protocol.Message, in *Inbound) {
+		nm.OnHandshake(msg.(*protocol.Handshake), in.Frame)
+	})
+	nm.Handle(protocol.FRAGMENT, func(msg protocol.Message, in *Inbound) {
+		nm.OnFragment(msg.(*protocol.Fragment), in.Frame)
+	})
+	nm.Handle(protocol.PATH_PROBE, func(msg protocol.Message, in *Inbound) {
+		nm.OnPathProbe(msg.(*protocol.PathProbe), in.Frame)
+	})
+	nm.Handle(protocol.RELAY, func(msg protocol.Message, in *Inbound) {
+		nm.OnRelay(msg.(*protocol.Relay), in)
+	})
+	nm.Handle(protocol.PATH_ECHO, func(msg protocol.Message, in *Inbound) {
+		nm.OnPathEcho(msg.(*protocol.PathEcho), in)
+	})
+}
+
+func (nm *ClusterManager) DispatchOVTPacket(via NetTunnel, pkt protocol.OVTPacket, from net.Addr) {
+	nm.dispatch(pkt, &Inbound{Via: via, From: from, Frame: pkt})
+}
+
+func (nm *ClusterManager) dispatch(pkt protocol.OVTPacket, in *Inbound) {
+	msg_type := pkt.PayloadType()
+	if msg_type == protocol.RAW_PAYLOAD {
+		nm.DeliverPayload(pkt.PayloadRef())
+		return
+	}
+
+	handler := nm.handler_of(msg_type)
+	msg, known := protocol.NewMessage(msg_type)
+	if !known || handler == nil {
+		// Counted in UnknownStat. Warned once per type, since peers of newer version may send it steadily.
+		atomic.AddUint64(&nm.UnknownStat, 1)
+		entry := log.WithFields(log.Fields{
+			"module": "ClusterManager",
+			"event":  "packet",
+		})
+		if _, warned := nm.unknown_types.LoadOrStore(msg_type, true); warned {
+			entry.Debugf("Drop message of unknown type %v from %v.", msg_type, in.From)
+		} else {
+			entry.Warningf("Drop message of unknown type %v from %v. Further ones are counted only.", msg_type, in.From)
+		}
+		return
+	}
+
+	if nm.unmarshal_message(pkt, msg) {
+		handler(msg, in)
+	}
+}
+
+func (nm *ClusterManager) unmarshal_message(pkt protocol.OVTPacket, msg protocol.Message) bool {
+	if err := msg.Unmarshal(pkt.PayloadRef()); err != nil {
+		log.WithFields(log.Fields{
+			"module":     "ClusterManager",
+			"event":      "packet",
+			"err_detail": err.Error(),
+		}).Warningf("Drop invalid message of type %v.", pkt.PayloadType())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,344 @@
+package ovtd
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/google/uuid"
+	"math/rand"
+	"overturn/protocol"
+	"sync/atomic"
+	"time"
+)
+
+// Node roles in network cluster.
+const (
+	ROLE_FOLLOWER = iota
+	ROLE_CANDIDATE
+	ROLE_MASTER
+)
+
+func RoleName(role uint8) string {
+	switch role {
+	case ROLE_FOLLOWER:
+		return "follower"
+	case ROLE_CANDIDATE:
+		return "candidate"
+	case ROLE_MASTER:
+		return "master"
+	}
+	return "unknown"
+}
+
+// cluster_bootstrap : Drive heartbeats and elections until cluster manager stops.
+func (nm *ClusterManager) cluster_bootstrap() {
+	ticker := time.NewTicker(time.Duration(nm.Info.HeartbeatPeriod) * time.Millisecond)
+	defer ticker.Stop()
+
+	nm.lock.Lock()
+	nm.reset_election_timer()
+	nm.lock.Unlock()
+
+	for atomic.LoadUint32(&nm.running) > 0 {
+		<-ticker.C
+		nm.election_tick()
+	}
+
+	nm.stopSig <- 0
+}
+
+func (nm *ClusterManager) election_tick() {
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+
+	nm.check_liveness()
+	nm.maintain_sessions()
+	nm.Fragments.Expire(time.Now())
+	nm.maintain_probes(time.Now())
+	nm.update_relays(time.Now())
+	nm.maintain_path_mtu(time.Now())
+	nm.maintain_capture(time.Now())
+
+	if nm.Info.Role == ROLE_MASTER {
+		nm.broadcast_heartbeat(protocol.HEARTBEAT_MASTER)
+		nm.publish_keys(time.Now())
+		return
+	}
+
+	if nm.is_member() {
+		nm.broadcast_heartbeat(protocol.HEARTBEAT_NODE)
+		nm.publish_keys(time.Now())
+	}
+
+	if nm.joining != nil {
+		nm.retry_join()
+	}
+
+	if time.Now().After(nm.Info.ElectionDeadline) {
+		nm.start_election()
+	}
+}
+
+// reset_election_timer : Randomize next election in [timeout, 2 * timeout).
+func (nm *ClusterManager) reset_election_timer() {
+	timeout := time.Duration(nm.Info.HeartbeatTimeout) * time.Millisecond
+	jitter := time.Duration(rand.Int63n(int64(timeout) + 1))
+	nm.Info.ElectionDeadline = time.Now().Add(timeout + jitter)
+}
+
+func (nm *ClusterManager) is_member() bool {
+	_, ok := nm.Info.ByID[nm.Info.Self.ID]
+	return ok
+}
+
+func (nm *ClusterManager) quorum() int {
+	return len(nm.Info.ByID)/2 + 1
+}
+
+func (nm *ClusterManager) persist_election() error {
+	nm.ctl.config_lock.Lock()
+	nm.Config.Term = nm.Info.Term
+	if nm.Info.VotedFor == uuid.Nil {
+		nm.Config.Vote = ""
+	} else {
+		nm.Config.Vote = nm.Info.VotedFor.String()
+	}
+	nm.ctl.config_lock.Unlock()
+	return nm.ctl.PersistDynamicClusterConfig()
+}
+
+func (nm *ClusterManager) start_election() {
+	nm.reset_election_timer()
+
+	// Nodes not in membership are not allowed to vote.
+	if !nm.is_member() {
+		return
+	}
+
+	nm.Info.Term++
+	nm.Info.Role = ROLE_CANDIDATE
+	nm.Info.Master = nil
+	nm.Info.VotedFor = nm.Info.Self.ID
+	nm.Info.Votes = map[uuid.UUID]bool{nm.Info.Self.ID: true}
+	if err := nm.persist_election(); err != nil {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"module": "ClusterManager",
+		"event":  "election",
+	}).Infof("Start election for term %v.", nm.Info.Term)
+
+	if len(nm.Info.Votes) >= nm.quorum() {
+		nm.become_master()
+		return
+	}
+
+	req := protocol.NewVoteRequest(nm.Info.Name, nm.Info.Self.ID, nm.Info.Term, nm.Info.Index, nm.last_log_term())
+	for id, node := range nm.Info.ByID {
+		if id == nm.Info.Self.ID {
+			continue
+		}
+		nm.SendMessage(node, protocol.VOTE_REQUEST, req)
+	}
+}
+
+func (nm *ClusterManager) become_master() {
+	nm.Info.Role = ROLE_MASTER
+	nm.Info.Master = nm.Info.Self
+	nm.Info.Votes = nil
+	nm.Info.Match = make(map[uuid.UUID]uint64)
+	nm.record_master(nm.Info.Term, nm.Info.Self.ID)
+
+	log.WithFields(log.Fields{
+		"module": "ClusterManager",
+		"event":  "election",
+	}).Warningf("Become master of term %v.", nm.Info.Term)
+
+	nm.broadcast_heartbeat(protocol.HEARTBEAT_MASTER)
+}
+
+// step_down : Follow a newer term.
+func (nm *ClusterManager) step_down(term uint64) {
+	if nm.Info.Role == ROLE_MASTER {
+		log.WithFields(log.Fields{
+			"module": "ClusterManager",
+			"event":  "election",
+		}).Warningf("Step down for newer term %v.", term)
+	}
+
+	nm.Info.Term = term
+	nm.Info.Role = ROLE_FOLLOWER
+	nm.Info.Master = nil
+	nm.Info.VotedFor = uuid.Nil
+	nm.Info.Votes = nil
+	nm.Info.Match = nil
+	nm.persist_election()
+}
+
+func (nm *ClusterManager) new_heartbeat(hb_type uint16) *protocol.Heartbeat {
+	hb := protocol.NewHeartbeat(hb_type)
+	hb.NetName = NetNameKey(nm.Info.Name)
+	if nm.Info.Master != nil {
+		hb.Master = nm.Info.Master.ID
+	}
+	hb.Node = nm.Info.Self.ID
+	hb.Term = nm.Info.Term
+	hb.Index = nm.Info.Index
+	hb.Commit = nm.Info.Commit
+	hb.Reach = nm.direct_reach(time.Now())
+	return hb
+}
+
+func (nm *ClusterManager) broadcast_heartbeat(hb_type uint16) {
+	hb := nm.new_heartbeat(hb_type)
+	for id, node := range nm.Info.ByID {
+		if id == nm.Info.Self.ID {
+			continue
+		}
+		nm.SendMessage(node, hb_type, hb)
+	}
+	if hb_type != protocol.HEARTBEAT_MASTER {
+		return
+	}
+	// Recently removed nodes fetch their removal on master heartbeat.
+	for id, removed := range nm.Info.Removed {
+		if id != nm.Info.Self.ID && nm.recently_removed(id) != nil {
+			nm.SendMessage(removed.Node, hb_type, hb)
+		}
+	}
+}
+
+func (nm *ClusterManager) OnHeartbeat(hb_type uint16, hb *protocol.Heartbeat, in *Inbound) {
+	if hb.NetName != NetNameKey(nm.Info.Name) {
+		return
+	}
+
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+
+	sender, ok := nm.Info.ByID[hb.Node]
+	if !ok || sender == nm.Info.Self || !nm.verify_frame(sender.ID, sender.Identity, in.Frame, hb) {
+		return
+	}
+	nm.mark_seen(sender)
+	sender.Reach = hb.Reach
+	if !in.Relayed {
+		sender.LastDirect = sender.LastSeen
+		if in.Via == nm.NetTun {
+			sender.LastDatagram = sender.LastSeen
+		}
+	}
+
+	if hb.Term < nm.Info.Term {
+		// Let stale master know the newer term.
+		if hb_type == protocol.HEARTBEAT_MASTER {
+			nm.SendMessage(sender, protocol.HEARTBEAT_NODE, nm.new_heartbeat(protocol.HEARTBEAT_NODE))
+		}
+		return
+	}
+	if hb.Term > nm.Info.Term {
+		nm.step_down(hb.Term)
+	}
+
+	if hb_type != protocol.HEARTBEAT_MASTER {
+		return
+	}
+
+	if expected, known := nm.master_of(hb.Term); known && expected != sender.ID {
+		log.WithFields(log.Fields{
+			"module":  "ClusterManager",
+			"event":   "election",
+			"node_id": sender.ID.String(),
+		}).Warningf("Ignore %v claiming master of term %v won by %v.", sender.Name, hb.Term, expected.String())
+		return
+	}
+	if nm.Info.Role != ROLE_FOLLOWER {
+		nm.Info.Role = ROLE_FOLLOWER
+		nm.Info.Votes = nil
+	}
+	if nm.Info.Master != sender {
+		nm.record_master(hb.Term, sender.ID)
+		// Only committed entries are known to match new master.
+		nm.Info.Synced = nm.Info.Commit
+		nm.Info.Master = sender
+		log.WithFields(log.Fields{
+			"module":  "ClusterManager",
+			"event":   "election",
+			"node_id": sender.ID.String(),
+		}).Infof("Follow master %v of term %v.", sender.Name, hb.Term)
+	}
+	nm.reset_election_timer()
+
+	// Catch up membership log.
+	nm.sync_log(sender, hb)
+}
+
+// up_to_date : Log ending at index of term is at least as up-to-date as ours.
+// Term of last entry is compared first, and index only when terms are equal.
+func (nm *ClusterManager) up_to_date(term uint64, index uint64) bool {
+	last := nm.last_log_term()
+	if term != last {
+		return term > last
+	}
+	return index >= nm.Info.Index
+}
+
+func (nm *ClusterManager) OnVoteRequest(req *protocol.VoteRequest, frame protocol.OVTPacket) {
+	if req.NetName != NetNameKey(nm.Info.Name) {
+		return
+	}
+
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+
+	candidate, ok := nm.Info.ByID[req.Candidate]
+	if !ok || candidate == nm.Info.Self || !nm.verify_frame(candidate.ID, candidate.Identity, frame, req) {
+		return
+	}
+
+	if req.Term > nm.Info.Term {
+		nm.step_down(req.Term)
+	}
+
+	granted := false
+	if req.Term == nm.Info.Term &&
+		(nm.Info.VotedFor == uuid.Nil || nm.Info.VotedFor == req.Candidate) &&
+		nm.up_to_date(req.LogTerm, req.Index) {
+
+		nm.Info.VotedFor = req.Candidate
+		if err := nm.persist_election(); err == nil {
+			granted = true
+			nm.reset_election_timer()
+		}
+	}
+
+	resp := protocol.NewVoteResponse(nm.Info.Name, nm.Info.Self.ID, nm.Info.Term, granted)
+	nm.SendMessage(candidate, protocol.VOTE_RESPONSE, resp)
+}
+
+func (nm *ClusterManager) OnVoteResponse(resp *protocol.VoteResponse, frame protocol.OVTPacket) {
+	if resp.NetName != NetNameKey(nm.Info.Name) {
+		return
+	}
+
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+
+	voter, ok := nm.Info.ByID[resp.Voter]
+	if !ok || voter == nm.Info.Self || !nm.verify_frame(voter.ID, voter.Identity, frame, resp) {
+		return
+	}
+
+	if resp.Term > nm.Info.Term {
+		nm.step_down(resp.Term)
+		return
+	}
+
+	if nm.Info.Role != ROLE_CANDIDATE || resp.Term != nm.Info.Term || !resp.Granted {
+		return
+	}
+
+	nm.Info.Votes[resp.Voter] = true
+	if len(nm.Info.Votes) >= nm.quorum() {
+		nm.become_master()
+	}
+}
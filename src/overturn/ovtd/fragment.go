@@ -0,0 +1,230 @@
+package ovtd
+
+import (
+	"github.com/google/uuid"
+	"net"
+	"overturn/protocol"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	FRAGMENT_TIMEOUT      = 3 * time.Second
+	FRAGMENT_PEER_LIMIT   = 1 << 20 // Bytes buffered for a peer.
+	FRAGMENT_MEMORY_LIMIT = 8 << 20 // Bytes buffered for all peers.
+)
+
+type fragmentKey struct {
+	sender uuid.UUID
+	id     uint32
+}
+
+type reassembly struct {
+	buf      []byte
+	ranges   map[uint16]uint16 // offset -> end
+	received int
+	total    int // -1 until last fragment arrives
+	deadline time.Time
+}
+
+// Reassembler : Collect fragments into inner packets.
+type Reassembler struct {
+	TimeoutDropStat uint64
+	LimitDropStat   uint64
+	InvalidDropStat uint64
+
+	lock    sync.Mutex
+	pending map[fragmentKey]*reassembly
+	memory  int
+	peers   map[uuid.UUID]int
+}
+
+func NewReassembler() *Reassembler {
+	return &Reassembler{
+		pending: make(map[fragmentKey]*reassembly),
+		peers:   make(map[uuid.UUID]int),
+	}
+}
+
+// Add : Buffer fragment of sender. Return inner packet once all fragments arrive.
+func (r *Reassembler) Add(sender uuid.UUID, frag *protocol.Fragment, now time.Time) []byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := fragmentKey{sender: sender, id: frag.ID}
+	start, end := int(frag.Offset), int(frag.Offset)+len(frag.Data)
+
+	entry, ok := r.pending[key]
+	if !ok {
+		entry = &reassembly{
+			ranges:   make(map[uint16]uint16),
+			total:    -1,
+			deadline: now.Add(FRAGMENT_TIMEOUT),
+		}
+	}
+
+	// Overlapped, beyond known end, or a second last fragment.
+	invalid := len(frag.Data) < 1 || (entry.total >= 0 && (end > entry.total || frag.Last))
+	if frag.Last && end < len(entry.buf) {
+		invalid = true
+	}
+	for offset, stop := range entry.ranges {
+		if start < int(stop) && int(offset) < end {
+			invalid = true
+			break
+		}
+	}
+	if invalid {
+		atomic.AddUint64(&r.InvalidDropStat, 1)
+		if ok {
+			r.drop(key, entry)
+		}
+		return nil
+	}
+
+	if grow := end - len(entry.buf); grow > 0 {
+		if r.memory+grow > FRAGMENT_MEMORY_LIMIT {
+			r.expire(now)
+		}
+		if r.memory+grow > FRAGMENT_MEMORY_LIMIT || r.peers[sender]+grow > FRAGMENT_PEER_LIMIT {
+			atomic.AddUint64(&r.LimitDropStat, 1)
+			if ok {
+				r.drop(key, entry)
+			}
+			return nil
+		}
+		buf := make([]byte, end)
+		copy(buf, entry.buf)
+		entry.buf = buf
+		r.memory += grow
+		r.peers[sender] += grow
+	}
+	if !ok {
+		r.pending[key] = entry
+	}
+
+	copy(entry.buf[start:end], frag.Data)
+	entry.ranges[frag.Offset] = uint16(end)
+	entry.received += end - start
+	if frag.Last {
+		entry.total = end
+	}
+	if entry.total < 0 || entry.received < entry.total {
+		return nil
+	}
+
+	r.drop(key, entry)
+	return entry.buf
+}
+
+func (r *Reassembler) drop(key fragmentKey, entry *reassembly) {
+	delete(r.pending, key)
+	r.memory -= len(entry.buf)
+	if r.peers[key.sender] -= len(entry.buf); r.peers[key.sender] <= 0 {
+		delete(r.peers, key.sender)
+	}
+}
+
+func (r *Reassembler) expire(now time.Time) {
+	for key, entry := range r.pending {
+		if now.After(entry.deadline) {
+			atomic.AddUint64(&r.TimeoutDropStat, 1)
+			r.drop(key, entry)
+		}
+	}
+}
+
+// Expire : Drop incomplete packets which time out.
+func (r *Reassembler) Expire(now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.expire(now)
+}
+
+// frame_overhead : Bytes of OVT packet besides payload, sealed if session is given.
+func frame_overhead(session *PeerSession) int {
+	if session != nil {
+		return protocol.SECURE_OVERHEAD
+	}
+	return protocol.EXTENDED_HEADER_SIZE
+}
+
+// route_payload : Send inner packet to node, fragmented if it exceeds tunnel MTU.
+func (nm *ClusterManager) route_payload(tun NetTunnel, addr net.Addr, node *NetworkNode, session *PeerSession, payload []byte) {
+	limit := int(nm.path_mtu(tun, node)) - frame_overhead(session)
+	nm.fragment_payload(limit, payload, func(payload_type uint16, data []byte) bool {
+		return nm.write_route_payload(tun, addr, node, session, payload_type, data)
+	})
+}
+
+// fragment_payload : Write inner packet as is if it fits limit, or as fragments. Stop once write fails.
+func (nm *ClusterManager) fragment_payload(limit int, payload []byte, write func(payload_type uint16, data []byte) bool) {
+	if len(payload) <= limit {
+		write(protocol.RAW_PAYLOAD, payload)
+		return
+	}
+
+	chunk := (limit - protocol.FRAGMENT_HEADER_SIZE) &^ 7
+	if chunk <= 0 || len(payload) > protocol.FRAGMENT_MAX_SIZE {
+		return
+	}
+	frag := &protocol.Fragment{ID: atomic.AddUint32(&nm.frag_id, 1)}
+	for offset := 0; offset < len(payload); offset += chunk {
+		end := offset + chunk
+		if end >= len(payload) {
+			end = len(payload)
+			frag.Last = true
+		}
+		frag.Offset = uint16(offset)
+		frag.Data = payload[offset:end]
+		if !write(protocol.FRAGMENT, frag.Marshal()) {
+			return
+		}
+	}
+	atomic.AddUint64(&nm.FragmentStat, 1)
+}
+
+// write_route_payload : Write payload to node. Path MTU is lowered if packet is too large for local stack.
+func (nm *ClusterManager) write_route_payload(tun NetTunnel, addr net.Addr, node *NetworkNode, session *PeerSession, payload_type uint16, payload []byte) bool {
+	size, err := nm.write_payload(tun, addr, node.ID, session, payload_type, payload)
+	if err != nil && tun == nm.NetTun && is_message_size(err) {
+		nm.on_message_size(node, uint32(size))
+		return false
+	}
+	return true
+}
+
+// write_payload : Encapsulate raw payload into one packet. Payload is sealed if session is given.
+// Return size of OVT packet.
+func (nm *ClusterManager) write_payload(tun NetTunnel, addr net.Addr, peer uuid.UUID, session *PeerSession, payload_type uint16, payload []byte) (uint, error) {
+	tun_pkt := tun.NewPacket(uint(frame_overhead(session) + len(payload)))
+	ovt_pkt := nm.place_payload(tun_pkt.PayloadRef(), peer, session, payload_type, payload)
+	_, err := tun.Write(tun_pkt, addr)
+	return uint(len(ovt_pkt)), err
+}
+
+// place_payload : Encapsulate raw payload into buf, sized by frame_overhead.
+func (nm *ClusterManager) place_payload(buf []byte, peer uuid.UUID, session *PeerSession, payload_type uint16, payload []byte) protocol.OVTPacket {
+	sequence := nm.Sequences.Next(peer)
+	size := uint(len(payload))
+	if session == nil {
+		ovt_pkt := protocol.PlaceNewExtendedOVTPacket(buf, size, payload_type, nm.NetID, nm.Info.Self.ID, nm.Epoch, sequence)
+		copy(ovt_pkt.PayloadRef(), payload)
+		return ovt_pkt
+	}
+
+	ovt_pkt := protocol.PlaceNewSecureOVTPacket(buf, size, payload_type, nm.NetID, nm.Info.Self.ID, nm.Epoch, sequence)
+	copy(ovt_pkt.SecurePayloadRef(), payload)
+	ovt_pkt.Seal(session.Send)
+	return ovt_pkt
+}
+
+func (nm *ClusterManager) OnFragment(frag *protocol.Fragment, frame protocol.OVTPacket) {
+	if !frame.IsExtended() {
+		return
+	}
+	if payload := nm.Fragments.Add(frame.Sender(), frag, time.Now()); payload != nil {
+		nm.DeliverPayload(payload)
+	}
+}
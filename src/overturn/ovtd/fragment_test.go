@@ -0,0 +1,131 @@
+package ovtd
+
+import (
+	"bytes"
+	"github.com/google/uuid"
+	"overturn/protocol"
+	"testing"
+	"time"
+)
+
+// test_fragment : Fragment carrying bytes [offset, offset+size) of a pattern payload.
+func test_fragment(id uint32, offset int, size int, last bool) *protocol.Fragment {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(offset + i)
+	}
+	return &protocol.Fragment{ID: id, Offset: uint16(offset), Last: last, Data: data}
+}
+
+func test_payload(size int) []byte {
+	return test_fragment(0, 0, size, true).Data
+}
+
+func TestReassemblerAdd(t *testing.T) {
+	type step struct {
+		offset int
+		size   int
+		last   bool
+		want   int // Size of completed payload, 0 if incomplete or dropped.
+	}
+	cases := []struct {
+		name    string
+		steps   []step
+		invalid uint64
+	}{
+		{"single", []step{{0, 8, true, 8}}, 0},
+		{"in order", []step{{0, 8, false, 0}, {8, 8, false, 0}, {16, 4, true, 20}}, 0},
+		{"out of order", []step{{16, 4, true, 0}, {0, 8, false, 0}, {8, 8, false, 20}}, 0},
+		{"empty", []step{{0, 0, false, 0}}, 1},
+		{"overlapping", []step{{0, 8, false, 0}, {4, 8, false, 0}, {8, 4, true, 0}}, 1},
+		{"duplicate", []step{{0, 8, false, 0}, {0, 8, false, 0}}, 1},
+		{"duplicate last", []step{{8, 4, true, 0}, {8, 4, true, 0}}, 1},
+		{"second last", []step{{8, 4, true, 0}, {0, 8, true, 0}}, 1},
+		{"beyond last", []step{{8, 4, true, 0}, {12, 4, false, 0}}, 1},
+		{"last before buffered end", []step{{8, 8, false, 0}, {0, 4, true, 0}}, 1},
+		{"restart after drop", []step{{0, 8, false, 0}, {4, 8, false, 0}, {8, 4, true, 0}, {0, 8, false, 12}}, 1},
+	}
+
+	for _, c := range cases {
+		r := NewReassembler()
+		sender := uuid.New()
+		now := time.Now()
+		for i, s := range c.steps {
+			got := r.Add(sender, test_fragment(1, s.offset, s.size, s.last), now)
+			if s.want == 0 {
+				if got != nil {
+					t.Errorf("%v: step %v completed %v bytes, want none", c.name, i, len(got))
+				}
+				continue
+			}
+			if !bytes.Equal(got, test_payload(s.want)) {
+				t.Errorf("%v: step %v completed %v, want %v", c.name, i, got, test_payload(s.want))
+			}
+		}
+		if r.InvalidDropStat != c.invalid {
+			t.Errorf("%v: InvalidDropStat = %v, want %v", c.name, r.InvalidDropStat, c.invalid)
+		}
+	}
+}
+
+func TestReassemblerRelease(t *testing.T) {
+	r := NewReassembler()
+	sender := uuid.New()
+	now := time.Now()
+
+	r.Add(sender, test_fragment(1, 0, 100, false), now)
+	r.Add(sender, test_fragment(2, 0, 100, false), now)
+	if r.memory != 200 || r.peers[sender] != 200 {
+		t.Fatalf("Buffered %v bytes, %v of peer, want 200", r.memory, r.peers[sender])
+	}
+
+	r.Add(sender, test_fragment(1, 100, 10, true), now)
+	r.Expire(now.Add(FRAGMENT_TIMEOUT + time.Second))
+	if r.memory != 0 || len(r.peers) != 0 || len(r.pending) != 0 {
+		t.Errorf("Buffered %v bytes of %v peers in %v packets after release, want none", r.memory, len(r.peers), len(r.pending))
+	}
+	if r.TimeoutDropStat != 1 {
+		t.Errorf("TimeoutDropStat = %v, want 1", r.TimeoutDropStat)
+	}
+}
+
+func TestReassemblerLimit(t *testing.T) {
+	const size = 60000
+	per_peer := FRAGMENT_PEER_LIMIT / size
+	// Peers needed to exceed memory limit, and packets beyond it.
+	crowd := FRAGMENT_MEMORY_LIMIT/(per_peer*size) + 1
+	beyond := uint64(crowd*per_peer - FRAGMENT_MEMORY_LIMIT/size)
+
+	cases := []struct {
+		name    string
+		peers   int
+		packets int // Incomplete packets sent by each peer.
+		expired bool
+		limited uint64
+	}{
+		{"peer within limit", 1, per_peer, false, 0},
+		{"peer over limit", 1, per_peer + 2, false, 2},
+		{"memory over limit", crowd, per_peer, false, beyond},
+		{"memory freed by expired", crowd, per_peer, true, 0},
+	}
+
+	for _, c := range cases {
+		r := NewReassembler()
+		now := time.Now()
+		for p := 0; p < c.peers; p++ {
+			sender := uuid.New()
+			for id := 0; id < c.packets; id++ {
+				r.Add(sender, test_fragment(uint32(id), 0, size, false), now)
+			}
+			if c.expired {
+				now = now.Add(FRAGMENT_TIMEOUT + time.Second)
+			}
+		}
+		if r.LimitDropStat != c.limited {
+			t.Errorf("%v: LimitDropStat = %v, want %v", c.name, r.LimitDropStat, c.limited)
+		}
+		if r.memory > FRAGMENT_MEMORY_LIMIT {
+			t.Errorf("%v: Buffered %v bytes beyond limit", c.name, r.memory)
+		}
+	}
+}
@@ -5,11 +5,12 @@ import (
 
 	"encoding/binary"
 	"fmt"
-	//log "github.com/Sirupsen/logrus"
+	log "github.com/Sirupsen/logrus"
 	"net"
 	//"runtime"
 	"errors"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 	"math/rand"
 	"sync/atomic"
 	"time"
@@ -23,28 +24,23 @@ type ICMPTunnel struct {
 
 	RxStat uint64
 	WxStat uint64
-	MTU    uint32
+	mtu    uint32
 
 	worker_count uint32
 	running      uint32
 	conn         net.PacketConn
+	conn6        net.PacketConn // nil if ICMPv6 unavailable.
 	sigStop      chan int
+	on_path_mtu  func(ip net.IP, mtu uint32)
 }
 
 const (
 	ICMP_HEADER_SIZE = 8
+	ICMP_MAX_PACKET  = 65535 - 20
 )
 
 type ICMPTunnelPacket []byte
 
-//type NetTunnel interface {
-//    NewPacket(payload_size uint32) protocol.TunnelPacket
-//    Write(packet protocol.TunnelPacket) (int, error)
-//    Handler(handler func(packet protocol.TunnelPacket))
-//    Start() error
-//    Stop() error
-//}
-
 func (pkt ICMPTunnelPacket) PayloadRef() []byte {
 	return pkt[ICMP_HEADER_SIZE:]
 }
@@ -81,33 +77,79 @@ func NewICMPTunnel(address string) (*ICMPTunnel, error) {
 	tun.worker_count = 0
 	tun.RxStat = 0
 	tun.WxStat = 0
-	tun.MTU = 1464 // Header: IP(20byte) + ICMP(8Byte) + OVT(8Byte)
+	tun.mtu = 1500 - 20 - ICMP_HEADER_SIZE // Header: IP(20byte) + ICMP(8Byte)
 	//tun.DataOut = nil
 	//tun.DataIn = make(chan []byte, tun.MaxWorker)
 	tun.sigStop = make(chan int)
 
-	tun.conn, err = net.ListenPacket("ip4:icmp", address)
-	if err != nil {
+	if tun.conn, err = listen_icmp("ip4:icmp", address); err != nil {
 		return nil, err
 	}
+	if tun.conn6, err = listen_icmp("ip6:ipv6-icmp", address); err != nil {
+		log.WithFields(log.Fields{
+			"module":     "ICMPTunnel",
+			"err_detail": err.Error(),
+		}).Warning("ICMPv6 not available. IPv6 peers are unreachable over icmp.")
+		tun.conn6 = nil
+	} else {
+		tun.mtu = 1500 - 40 - ICMP_HEADER_SIZE // Header: IPv6(40byte) + ICMP(8Byte)
+	}
 	return tun, nil
 }
 
+func listen_icmp(network string, address string) (net.PacketConn, error) {
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if err = set_dont_fragment(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
 func (tun *ICMPTunnel) Destroy() error {
 	tun.Stop()
+	if tun.conn6 != nil {
+		tun.conn6.Close()
+	}
 	return tun.conn.Close()
 }
 
-func (tun *ICMPTunnel) Handler(handler func(tun *ICMPTunnel, pkt protocol.TunnelPacket)) error {
+func (tun *ICMPTunnel) Name() string {
+	return TRANSPORT_ICMP
+}
 
+func (tun *ICMPTunnel) MTU() uint32 {
+	return tun.mtu
+}
+
+func (tun *ICMPTunnel) Stats() (uint64, uint64) {
+	return atomic.LoadUint64(&tun.RxStat), atomic.LoadUint64(&tun.WxStat)
+}
+
+func (tun *ICMPTunnel) PeerAddr(ep *protocol.Endpoint) net.Addr {
+	return &net.IPAddr{IP: ep.IP}
+}
+
+func (tun *ICMPTunnel) Handler(handler func(tun NetTunnel, pkt protocol.TunnelPacket, from net.Addr)) error {
+	tun.reader(tun.conn, false, handler)
+	if tun.conn6 != nil {
+		tun.reader(tun.conn6, true, handler)
+	}
+	return nil
+}
+
+func (tun *ICMPTunnel) reader(conn net.PacketConn, is_ipv6 bool, handler func(tun NetTunnel, pkt protocol.TunnelPacket, from net.Addr)) {
 	atomic.AddUint32(&tun.worker_count, 1)
 	go func() {
-		buf := make([]byte, tun.MTU-20)
+		buf := make([]byte, ICMP_MAX_PACKET)
 
 		for tun.running > 0 {
 			now := time.Now()
-			tun.conn.SetReadDeadline(now.Add(1000000000))
-			sz, _, err := tun.conn.ReadFrom(buf)
+			conn.SetReadDeadline(now.Add(1000000000))
+			sz, from, err := conn.ReadFrom(buf)
 			if err != nil {
 				var op_err *net.OpError
 				var is_err bool
@@ -118,12 +160,26 @@ func (tun *ICMPTunnel) Handler(handler func(tun *ICMPTunnel, pkt protocol.Tunnel
 				}
 			}
 
-			if ipv4.ICMPType(buf[0]) != ipv4.ICMPTypeEchoReply && ipv4.ICMPType(buf[0]) != ipv4.ICMPTypeEcho {
-				continue
+			if is_ipv6 {
+				if sz > 0 && ipv6.ICMPType(buf[0]) == ipv6.ICMPTypePacketTooBig {
+					tun.packet_too_big(buf[:sz])
+					continue
+				}
+				if ipv6.ICMPType(buf[0]) != ipv6.ICMPTypeEchoReply && ipv6.ICMPType(buf[0]) != ipv6.ICMPTypeEchoRequest {
+					continue
+				}
+			} else {
+				if sz > 0 && ipv4.ICMPType(buf[0]) == ipv4.ICMPTypeDestinationUnreachable {
+					tun.frag_needed(buf[:sz])
+					continue
+				}
+				if ipv4.ICMPType(buf[0]) != ipv4.ICMPTypeEchoReply && ipv4.ICMPType(buf[0]) != ipv4.ICMPTypeEcho {
+					continue
+				}
 			}
 
 			atomic.AddUint64(&tun.RxStat, uint64(sz))
-			handler(tun, ICMPTunnelPacket(buf[:sz]))
+			handler(tun, ICMPTunnelPacket(buf[:sz]), from)
 		}
 
 		last := atomic.AddUint32(&tun.worker_count, 0xFFFFFFFF) // -1
@@ -131,8 +187,56 @@ func (tun *ICMPTunnel) Handler(handler func(tun *ICMPTunnel, pkt protocol.Tunnel
 			tun.sigStop <- 0
 		}
 	}()
+}
 
-	return nil
+// OnPathMTU : Handle fragmentation needed reported for tunnel packets.
+func (tun *ICMPTunnel) OnPathMTU(handler func(ip net.IP, mtu uint32)) {
+	tun.on_path_mtu = handler
+}
+
+// frag_needed : Parse destination unreachable (fragmentation needed) quoting one of our packets.
+// +------+------+----------+--------+--------------+-------------------+
+// | Type | Code | Checksum | Unused | Next-hop MTU | Original IP header |
+// |  (+0)| (+1) |   (+2)   |  (+4)  |     (+6)     |        (+8)        |
+// +------+------+----------+--------+--------------+-------------------+
+func (tun *ICMPTunnel) frag_needed(msg []byte) {
+	const code_frag_needed = 4
+
+	if tun.on_path_mtu == nil || len(msg) < ICMP_HEADER_SIZE+ipv4.HeaderLen || msg[1] != code_frag_needed {
+		return
+	}
+	orig := msg[ICMP_HEADER_SIZE:]
+	if orig[0]>>4 != 4 || orig[9] != 1 { // Quoted packet should be ICMP over IPv4.
+		return
+	}
+	mtu := uint32(binary.BigEndian.Uint16(msg[6:8]))
+	if mtu <= ipv4.HeaderLen+ICMP_HEADER_SIZE {
+		return
+	}
+	dst := net.IPv4(orig[16], orig[17], orig[18], orig[19])
+	tun.on_path_mtu(dst, mtu-ipv4.HeaderLen-ICMP_HEADER_SIZE)
+}
+
+// packet_too_big : Parse ICMPv6 packet too big quoting one of our packets.
+// +------+------+----------+-------+----------------------+
+// | Type | Code | Checksum |  MTU  | Original IPv6 header |
+// |  (+0)| (+1) |   (+2)   |  (+4) |         (+8)         |
+// +------+------+----------+-------+----------------------+
+func (tun *ICMPTunnel) packet_too_big(msg []byte) {
+	if tun.on_path_mtu == nil || len(msg) < ICMP_HEADER_SIZE+ipv6.HeaderLen {
+		return
+	}
+	orig := msg[ICMP_HEADER_SIZE:]
+	if orig[0]>>4 != 6 || orig[6] != 58 { // Quoted packet should be ICMPv6.
+		return
+	}
+	mtu := binary.BigEndian.Uint32(msg[4:8])
+	if mtu <= ipv6.HeaderLen+ICMP_HEADER_SIZE {
+		return
+	}
+	dst := make(net.IP, net.IPv6len)
+	copy(dst, orig[24:40])
+	tun.on_path_mtu(dst, mtu-ipv6.HeaderLen-ICMP_HEADER_SIZE)
 }
 
 func (tun *ICMPTunnel) Write(packet protocol.TunnelPacket, address net.Addr) (int, error) {
@@ -141,11 +245,23 @@ func (tun *ICMPTunnel) Write(packet protocol.TunnelPacket, address net.Addr) (in
 		return 0, errors.New("Not a icmp tunnel packet")
 	}
 
-	s := checksum((*pkt)[:])
-	(*pkt)[2] ^= byte(s)
-	(*pkt)[3] ^= byte(s >> 8)
+	conn := tun.conn
+	(*pkt)[2], (*pkt)[3] = 0, 0
+	if ip_addr, ok := address.(*net.IPAddr); ok && ip_addr.IP.To4() == nil {
+		if tun.conn6 == nil {
+			return 0, errors.New("ICMPv6 not available")
+		}
+		// Checksum of ICMPv6 is filled by kernel.
+		(*pkt)[0] = byte(ipv6.ICMPTypeEchoReply)
+		conn = tun.conn6
+	} else {
+		(*pkt)[0] = byte(ipv4.ICMPTypeEchoReply)
+		s := checksum((*pkt)[:])
+		(*pkt)[2] ^= byte(s)
+		(*pkt)[3] ^= byte(s >> 8)
+	}
 
-	wx, err := tun.conn.WriteTo((*pkt)[:], address)
+	wx, err := conn.WriteTo((*pkt)[:], address)
 	atomic.AddUint64(&tun.WxStat, uint64(wx))
 	return wx, err
 }
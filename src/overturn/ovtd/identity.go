@@ -0,0 +1,158 @@
+package ovtd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/google/uuid"
+	"overturn/protocol"
+)
+
+const (
+	ERR_INVALID_SIGNATURE = "Invalid signature."
+)
+
+// NewIdentity : Generate long-term signing key of node.
+func NewIdentity() (ed25519.PrivateKey, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	return private, err
+}
+
+// ParseIdentity : Load signing key from base64 encoded seed.
+func ParseIdentity(raw string) (ed25519.PrivateKey, error) {
+	seed, err := ParseKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed[:]), nil
+}
+
+func EncodeIdentity(private ed25519.PrivateKey) string {
+	var seed [32]byte
+	copy(seed[:], private.Seed())
+	return EncodeKey(seed)
+}
+
+func IdentityKey(public ed25519.PublicKey) [32]byte {
+	var key [32]byte
+	copy(key[:], public)
+	return key
+}
+
+func IdentityFromKey(key [32]byte) ed25519.PublicKey {
+	if key == [32]byte{} {
+		return nil
+	}
+	return ed25519.PublicKey(append([]byte(nil), key[:]...))
+}
+
+func ParsePublicIdentity(raw string) (ed25519.PublicKey, error) {
+	key, err := ParseKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	return IdentityFromKey(key), nil
+}
+
+// Messages signed by sender of packet. Signature covers the packet's extended header.
+var SENDER_SIGNED = map[uint16]bool{
+	protocol.NODE_ACTIVATE:    true,
+	protocol.HEARTBEAT_MASTER: true,
+	protocol.HEARTBEAT_NODE:   true,
+	protocol.VOTE_REQUEST:     true,
+	protocol.VOTE_RESPONSE:    true,
+	protocol.LOG_ACK:          true,
+	protocol.LOG_PROPOSE:      true,
+	protocol.JOIN_REQUEST:     true,
+	protocol.HANDSHAKE:        true,
+}
+
+func (nm *ClusterManager) sign(context []byte, msg protocol.SignedMessage) {
+	protocol.SignMessage(context, msg, nm.ctl.Identity)
+}
+
+// sign_frame : Sign message for packet carrying it, if message is signed by sender.
+func (nm *ClusterManager) sign_frame(frame protocol.OVTPacket, msg protocol.Message) {
+	if !SENDER_SIGNED[frame.PayloadType()] {
+		return
+	}
+	if signed, ok := msg.(protocol.SignedMessage); ok {
+		nm.sign(frame.FrameContext(), signed)
+	}
+}
+
+// verify_signature : Check message is signed by identity.
+// Members configured without identity keep unsigned path until their key is committed,
+// so that clusters upgraded from unsigned membership can elect master to publish keys.
+func (nm *ClusterManager) verify_signature(id uuid.UUID, identity ed25519.PublicKey, context []byte, msg protocol.SignedMessage) bool {
+	if identity == nil {
+		if nm.Config.Insecure {
+			return true
+		}
+		if node, ok := nm.Info.ByID[id]; ok && node.Identity == nil {
+			nm.warn_unsigned(node)
+			return true
+		}
+	} else if protocol.VerifyMessage(context, msg, identity) {
+		return true
+	}
+
+	log.WithFields(log.Fields{
+		"module":     "ClusterManager",
+		"event":      "verify",
+		"err_detail": ERR_INVALID_SIGNATURE,
+		"node_id":    id.String(),
+	}).Warningf("Drop message of type %v claimed from %v.", msg.Type(), id.String())
+	return false
+}
+
+// warn_unsigned : Warn once that member is trusted without signature.
+func (nm *ClusterManager) warn_unsigned(node *NetworkNode) {
+	if nm.unsigned[node.ID] {
+		return
+	}
+	nm.unsigned[node.ID] = true
+	log.WithFields(log.Fields{
+		"module":  "ClusterManager",
+		"event":   "verify",
+		"node_id": node.ID.String(),
+	}).Warningf("No identity of %v in membership. Trust its unsigned messages until it publishes its keys.", node.Name)
+}
+
+func (nm *ClusterManager) verify_node(node *NetworkNode, context []byte, msg protocol.SignedMessage) bool {
+	return nm.verify_signature(node.ID, node.Identity, context, msg)
+}
+
+// verify_frame : Check message is signed by sender of packet, and packet is not replayed.
+// Sealed packets have been checked for replay when opened.
+func (nm *ClusterManager) verify_frame(id uuid.UUID, identity ed25519.PublicKey, frame protocol.OVTPacket, msg protocol.SignedMessage) bool {
+	if !frame.IsExtended() || frame.Sender() != id {
+		return false
+	}
+	if !nm.verify_signature(id, identity, frame.FrameContext(), msg) {
+		return false
+	}
+	return frame.IsSecure() || nm.Replay.Accept(id, frame.Epoch(), frame.Sequence())
+}
+
+func ParseSignature(raw string) ([protocol.SIGNATURE_SIZE]byte, error) {
+	var signature [protocol.SIGNATURE_SIZE]byte
+	decoded, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		return signature, err
+	}
+	if len(decoded) != len(signature) {
+		return signature, errors.New(ERR_INVALID_SIGNATURE)
+	}
+	copy(signature[:], decoded)
+	return signature, nil
+}
+
+func EncodeSignature(signature [protocol.SIGNATURE_SIZE]byte) string {
+	if signature == [protocol.SIGNATURE_SIZE]byte{} {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(signature[:])
+}
@@ -0,0 +1,329 @@
+package ovtd
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/janeczku/go-ipset/ipset"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// Names are suffixed by tag of network.
+const (
+	CAPTURE_MARK_CHAIN = "OVERTURN_CAPTURE_"
+	CAPTURE_IPSET      = "overturned_"
+	CAPTURE_IPSET6     = "overturned6_"
+)
+
+var (
+	ICMP_IGNORE_RULE  []string = []string{"-p", "icmp", "-j", "RETURN"}
+	ICMP6_IGNORE_RULE []string = []string{"-p", "ipv6-icmp", "-j", "RETURN"}
+)
+
+// IptablesCapture : Capture by iptables mark rules matching destinations in ipset.
+type IptablesCapture struct {
+	Mark   uint32
+	Ignore []CapturePort
+
+	Chain    string
+	SetName  string
+	SetName6 string
+
+	Ipt    *iptables.IPTables
+	CapIPs *ipset.IPSet
+
+	// IPv6 capture. nil if IPv6 is unavailable.
+	Ipt6    *iptables.IPTables
+	CapIPs6 *ipset.IPSet
+
+	// Entries in sets when synced.
+	synced  int
+	synced6 int
+}
+
+func NewIptablesCapture(tag string, mark uint32, ignore []CapturePort) (*IptablesCapture, error) {
+	var err error
+
+	capture := &IptablesCapture{
+		Mark:     mark,
+		Ignore:   ignore,
+		Chain:    CAPTURE_MARK_CHAIN + tag,
+		SetName:  CAPTURE_IPSET + tag,
+		SetName6: CAPTURE_IPSET6 + tag,
+	}
+	if capture.Ipt, err = iptables.New(); err != nil {
+		return nil, err
+	}
+	if capture.Ipt6, err = iptables.NewWithProtocol(iptables.ProtocolIPv6); err != nil {
+		log.WithFields(log.Fields{
+			"module":     "Capture",
+			"event":      "initialize",
+			"err_detail": err.Error(),
+		}).Warning("ip6tables not available. IPv6 traffics will not be captured.")
+		capture.Ipt6 = nil
+	}
+	return capture, nil
+}
+
+func (capture *IptablesCapture) Name() string {
+	return CAPTURE_IPTABLES
+}
+
+func (capture *IptablesCapture) IPv6() bool {
+	return capture.Ipt6 != nil
+}
+
+func (capture *IptablesCapture) ClearRules() {
+	capture.clear_iptables(capture.Ipt)
+	if capture.Ipt6 != nil {
+		capture.clear_iptables(capture.Ipt6)
+	}
+
+	// Sets can be destroyed only after rules referencing them are removed. Sets left by others are adopted first.
+	capture.ensure_sets()
+	for _, set := range []*ipset.IPSet{capture.CapIPs, capture.CapIPs6} {
+		if set != nil {
+			set.Flush()
+			set.Destroy()
+		}
+	}
+	capture.CapIPs = nil
+	capture.CapIPs6 = nil
+}
+
+// output_rule : Jump to capture chain from OUTPUT.
+func (capture *IptablesCapture) output_rule() []string {
+	return []string{"-m", "comment", "--comment", "Overturn mark traffics", "-j", capture.Chain}
+}
+
+// not_match_rule : Leave traffics not to captured destinations.
+func not_match_rule(set string) []string {
+	return []string{"-m", "set", "!", "--match-set", set, "dst", "-j", "RETURN"}
+}
+
+func (capture *IptablesCapture) clear_iptables(ipt *iptables.IPTables) {
+	output_rule := capture.output_rule()
+
+	ipt.ClearChain("mangle", capture.Chain)
+	// Jump rule may be duplicated by crashed daemons.
+	for {
+		if ok, err := ipt.Exists("mangle", "OUTPUT", output_rule...); err != nil || !ok {
+			break
+		}
+		if err := ipt.Delete("mangle", "OUTPUT", output_rule...); err != nil {
+			break
+		}
+	}
+	ipt.DeleteChain("mangle", capture.Chain)
+}
+
+// ensure_sets : Create ipsets referenced by rules.
+func (capture *IptablesCapture) ensure_sets() error {
+	var err error
+
+	fallback := func(err error, desp string) error {
+		log.WithFields(log.Fields{
+			"module":     "Capture",
+			"event":      "ipset",
+			"err_detail": err.Error(),
+		}).Error(desp)
+		return err
+	}
+
+	if capture.CapIPs == nil {
+		capture.CapIPs, err = ipset.New(capture.SetName, "hash:net", &ipset.Params{})
+		if err != nil {
+			return fallback(err, "Cannot create ipset.")
+		}
+	}
+	if capture.CapIPs6 == nil && capture.Ipt6 != nil {
+		capture.CapIPs6, err = ipset.New(capture.SetName6, "hash:net", &ipset.Params{HashFamily: "inet6"})
+		if err != nil {
+			return fallback(err, "Cannot create inet6 ipset.")
+		}
+	}
+	return nil
+}
+
+func (capture *IptablesCapture) SyncSet(prefixes []*net.IPNet) error {
+	var err error = nil
+
+	fallback := func(err error, desp string) error {
+		log.WithFields(log.Fields{
+			"module":     "Capture",
+			"event":      "ipset",
+			"err_detail": err.Error(),
+		}).Error(desp)
+		return err
+	}
+
+	if err = capture.ensure_sets(); err != nil {
+		return err
+	}
+
+	if err = capture.CapIPs.Flush(); err != nil {
+		return fallback(err, "Cannot flush ipset.")
+	}
+	if capture.CapIPs6 != nil {
+		if err = capture.CapIPs6.Flush(); err != nil {
+			return fallback(err, "Cannot flush inet6 ipset.")
+		}
+	}
+
+	capture.synced, capture.synced6 = 0, 0
+	for _, prefix := range prefixes {
+		set, synced := capture.CapIPs, &capture.synced
+		if prefix.IP.To4() == nil {
+			if set, synced = capture.CapIPs6, &capture.synced6; set == nil {
+				continue
+			}
+		}
+		if err = set.Add(prefix.String(), 0); err != nil {
+			return fallback(err, fmt.Sprintf("Error occur when add %v", prefix.String()))
+		}
+		*synced++
+	}
+
+	return nil
+}
+
+func (capture *IptablesCapture) Verify() error {
+	if capture.CapIPs == nil {
+		return errors.New(ERR_CAPTURE_DRIFT)
+	}
+	if err := capture.verify_iptables(capture.Ipt, capture.chain_rules(not_match_rule(capture.SetName), ICMP_IGNORE_RULE)); err != nil {
+		return err
+	}
+	if err := verify_ipset(capture.CapIPs, capture.synced); err != nil {
+		return err
+	}
+	if capture.Ipt6 == nil {
+		return nil
+	}
+	if err := capture.verify_iptables(capture.Ipt6, capture.chain_rules(not_match_rule(capture.SetName6), ICMP6_IGNORE_RULE)); err != nil {
+		return err
+	}
+	return verify_ipset(capture.CapIPs6, capture.synced6)
+}
+
+func (capture *IptablesCapture) verify_iptables(ipt *iptables.IPTables, rules [][]string) error {
+	if ok, err := ipt.Exists("mangle", "OUTPUT", capture.output_rule()...); err != nil || !ok {
+		return fmt.Errorf("%v (jump rule missing)", ERR_CAPTURE_DRIFT)
+	}
+	for _, rule := range rules {
+		if ok, err := ipt.Exists("mangle", capture.Chain, rule...); err != nil || !ok {
+			return fmt.Errorf("%v (rule missing: %v)", ERR_CAPTURE_DRIFT, rule)
+		}
+	}
+	return nil
+}
+
+func verify_ipset(set *ipset.IPSet, synced int) error {
+	if set == nil {
+		return errors.New(ERR_CAPTURE_DRIFT)
+	}
+	entries, err := set.List()
+	if err != nil {
+		return err
+	}
+	if len(entries) != synced {
+		return fmt.Errorf("%v (%v entries in set, expect %v)", ERR_CAPTURE_DRIFT, len(entries), synced)
+	}
+	return nil
+}
+
+func (capture *IptablesCapture) RefreshRules() error {
+	if err := capture.ensure_sets(); err != nil {
+		return err
+	}
+	if err := capture.refresh_iptables(capture.Ipt, not_match_rule(capture.SetName), ICMP_IGNORE_RULE); err != nil {
+		return err
+	}
+	if capture.Ipt6 != nil {
+		return capture.refresh_iptables(capture.Ipt6, not_match_rule(capture.SetName6), ICMP6_IGNORE_RULE)
+	}
+	return nil
+}
+
+// ignore_rules : iptables rules to exclude tunnel traffic from capture.
+func (capture *IptablesCapture) ignore_rules() [][]string {
+	rules := make([][]string, 0, len(capture.Ignore))
+	for _, port := range capture.Ignore {
+		proto := "udp"
+		if port.Proto == syscall.IPPROTO_TCP {
+			proto = "tcp"
+		}
+		dir := "--sport"
+		if port.Dst {
+			dir = "--dport"
+		}
+		rules = append(rules, []string{"-p", proto, dir, strconv.Itoa(int(port.Port)), "-j", "RETURN"})
+	}
+	return rules
+}
+
+// chain_rules : Rules in capture chain of one address family.
+func (capture *IptablesCapture) chain_rules(not_match_rule []string, icmp_rule []string) [][]string {
+	rules := [][]string{not_match_rule, icmp_rule}
+
+	// Never capture tunnel traffic itself.
+	rules = append(rules, capture.ignore_rules()...)
+
+	mark := fmt.Sprintf("0x%x", capture.Mark)
+	rules = append(rules, []string{"-j", "MARK", "--set-mark", mark})
+	rules = append(rules, []string{"-j", "RETURN"})
+	return rules
+}
+
+// refresh_iptables : Apply capture rules of one address family.
+func (capture *IptablesCapture) refresh_iptables(ipt *iptables.IPTables, not_match_rule []string, icmp_rule []string) error {
+	var err error = nil
+	var ok bool
+	fallback := true
+
+	capture.clear_iptables(ipt)
+	ipt.NewChain("mangle", capture.Chain)
+	defer func() {
+		if fallback {
+			ipt.DeleteChain("mangle", capture.Chain)
+			log.WithFields(log.Fields{
+				"module":     "Capture",
+				"event":      "iptables",
+				"err_detail": err.Error(),
+			}).Error("Cannot apply rules.")
+		}
+	}()
+
+	output_rule := capture.output_rule()
+	ok, err = ipt.Exists("mangle", "OUTPUT", output_rule...)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err = ipt.Insert("mangle", "OUTPUT", 1, output_rule...); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if fallback {
+			ipt.Delete("mangle", "OUTPUT", output_rule...)
+		}
+	}()
+
+	defer func() {
+		if fallback {
+			ipt.ClearChain("mangle", capture.Chain)
+		}
+	}()
+	for _, rule := range capture.chain_rules(not_match_rule, icmp_rule) {
+		if err = ipt.Append("mangle", capture.Chain, rule...); err != nil {
+			return err
+		}
+	}
+
+	fallback = false
+	return nil
+}
@@ -0,0 +1,515 @@
+package ovtd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/google/uuid"
+	"net"
+	"overturn/protocol"
+	"time"
+)
+
+const (
+	ERR_ALREADY_MEMBER = "Already a member of network."
+	ERR_LEAVE_TIMEOUT  = "Removal from network is not committed in time."
+
+	JOIN_SNAPSHOT_CHUNK = 8
+	LEAVE_TIMEOUT       = 10 * time.Second
+)
+
+// JoinState : Progress of joining a network.
+type JoinState struct {
+	Address  *protocol.Endpoint
+	Token    uuid.UUID
+	Publish  []*protocol.Endpoint
+	Prefixes []*net.IPNet
+	LastSent time.Time
+
+	Index   uint64
+	Records map[uuid.UUID]*protocol.NodeRecord
+}
+
+// EndpointFromAddr : Endpoint of transport address.
+func EndpointFromAddr(addr net.Addr) *protocol.Endpoint {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return &protocol.Endpoint{IP: a.IP}
+	case *net.UDPAddr:
+		return &protocol.Endpoint{IP: a.IP, Port: uint16(a.Port)}
+	case *net.TCPAddr:
+		return &protocol.Endpoint{IP: a.IP, Port: uint16(a.Port)}
+	}
+	return nil
+}
+
+func JoinStatusName(status uint8) string {
+	switch status {
+	case protocol.JOIN_ACCEPT:
+		return "accepted"
+	case protocol.JOIN_REJECT_TOKEN:
+		return "invalid token"
+	case protocol.JOIN_REJECT_EXPIRED:
+		return "token expired"
+	case protocol.JOIN_REJECT_NO_MASTER:
+		return "no master"
+	case protocol.JOIN_REDIRECT:
+		return "redirected"
+	case protocol.JOIN_REJECT_IDENTITY:
+		return "identity mismatch"
+	}
+	return "unknown"
+}
+
+// ParseJoinConfig : Join state of join section in network configure.
+func ParseJoinConfig(cfg *JoinConfigYAML) (*JoinState, error) {
+	var err error
+
+	state := &JoinState{}
+	if state.Address, err = protocol.ParseEndpoint(cfg.Address); err != nil {
+		return nil, err
+	}
+	if state.Token, err = uuid.Parse(cfg.Token); err != nil {
+		return nil, err
+	}
+	for _, raw := range cfg.Publish {
+		ep, err := protocol.ParseEndpoint(raw)
+		if err != nil {
+			return nil, err
+		}
+		state.Publish = append(state.Publish, ep)
+	}
+	for _, raw := range cfg.Prefixes {
+		prefix, err := protocol.ParsePrefix(raw)
+		if err != nil {
+			return nil, err
+		}
+		state.Prefixes = append(state.Prefixes, prefix)
+	}
+	return state, nil
+}
+
+func join_config(state *JoinState) *JoinConfigYAML {
+	cfg := &JoinConfigYAML{
+		Address: state.Address.String(),
+		Token:   state.Token.String(),
+	}
+	for _, ep := range state.Publish {
+		cfg.Publish = append(cfg.Publish, ep.String())
+	}
+	for _, prefix := range state.Prefixes {
+		cfg.Prefixes = append(cfg.Prefixes, prefix.String())
+	}
+	return cfg
+}
+
+// Join : Start joining network via a known publish address. Prefixes are advertised to be routed to this node.
+// Join is saved to network configure, so it is resumed after restart until accepted or rejected.
+func (nm *ClusterManager) Join(address *protocol.Endpoint, token uuid.UUID, publish []*protocol.Endpoint, prefixes []*net.IPNet) error {
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+
+	if nm.is_member() {
+		return errors.New(ERR_ALREADY_MEMBER)
+	}
+
+	nm.joining = &JoinState{
+		Address:  address,
+		Token:    token,
+		Publish:  publish,
+		Prefixes: prefixes,
+	}
+	nm.ctl.config_lock.Lock()
+	nm.Config.Join = join_config(nm.joining)
+	nm.ctl.config_lock.Unlock()
+	if err := nm.ctl.PersistDynamicClusterConfig(); err != nil {
+		return err
+	}
+	return nm.send_join_request()
+}
+
+// resume_join : Continue join in network configure if not a member yet.
+func (nm *ClusterManager) resume_join() {
+	fallback := func(err error) {
+		log.WithFields(log.Fields{
+			"module":     "ClusterManager",
+			"event":      "join",
+			"err_detail": err.Error(),
+		}).Errorf("Cannot resume joining network %v.", nm.Info.Name)
+	}
+
+	state, err := ParseJoinConfig(nm.Config.Join)
+	if err != nil {
+		fallback(err)
+		return
+	}
+	if err = nm.Join(state.Address, state.Token, state.Publish, state.Prefixes); err != nil && err.Error() != ERR_ALREADY_MEMBER {
+		fallback(err)
+	}
+}
+
+// finish_join : Stop joining and forget it in network configure.
+func (nm *ClusterManager) finish_join() {
+	nm.joining = nil
+	nm.ctl.config_lock.Lock()
+	nm.Config.Join = nil
+	nm.ctl.config_lock.Unlock()
+	nm.ctl.PersistDynamicClusterConfig()
+}
+
+func (nm *ClusterManager) send_join_request() error {
+	req := protocol.NewJoinRequest(nm.Info.Name, nm.joining.Token)
+	req.Node = nm.Info.Self.ID
+	req.Key = nm.ctl.Key.Public
+	req.Identity = IdentityKey(nm.ctl.GetIdentity())
+	req.Publish = nm.joining.Publish
+	req.Prefixes = nm.joining.Prefixes
+	nm.joining.LastSent = time.Now()
+
+	log.WithFields(log.Fields{
+		"module": "ClusterManager",
+		"event":  "join",
+	}).Infof("Send join request to %v.", nm.joining.Address.String())
+
+	return nm.SendMessageTo(nm.NetTun.PeerAddr(nm.joining.Address), protocol.JOIN_REQUEST, req)
+}
+
+func (nm *ClusterManager) retry_join() {
+	if time.Since(nm.joining.LastSent) < time.Duration(nm.Info.HeartbeatTimeout)*time.Millisecond {
+		return
+	}
+	nm.send_join_request()
+}
+
+func (nm *ClusterManager) token_valid(token uuid.UUID) uint8 {
+	if nm.Info.Token == uuid.Nil || subtle.ConstantTimeCompare(nm.Info.Token[:], token[:]) != 1 {
+		return protocol.JOIN_REJECT_TOKEN
+	}
+
+	now := uint64(time.Now().Unix())
+	if nm.Info.TokenExpireBefore > 0 && now < nm.Info.TokenExpireBefore {
+		return protocol.JOIN_REJECT_EXPIRED
+	}
+	if nm.Info.TokenExpireAfter > 0 && now > nm.Info.TokenExpireAfter {
+		return protocol.JOIN_REJECT_EXPIRED
+	}
+
+	return protocol.JOIN_ACCEPT
+}
+
+func node_record(node *NetworkNode) *protocol.NodeRecord {
+	return &protocol.NodeRecord{
+		ID:       node.ID,
+		Key:      node.Key,
+		Identity: IdentityKey(node.Identity),
+		Name:     node.Name,
+		Publish:  node.Publish,
+		Prefixes: node.Prefixes,
+	}
+}
+
+func (nm *ClusterManager) OnJoinRequest(req *protocol.JoinRequest, via NetTunnel, from net.Addr, frame protocol.OVTPacket) {
+	if req.Name != NetNameKey(nm.Info.Name) || req.Node == uuid.Nil {
+		return
+	}
+	from_ep := EndpointFromAddr(from)
+	if from_ep == nil {
+		return
+	}
+
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+
+	reject := func(status uint8) {
+		log.WithFields(log.Fields{
+			"module":  "ClusterManager",
+			"event":   "join",
+			"node_id": req.Node.String(),
+		}).Warningf("Join request from %v rejected: %v", from_ep.String(), JoinStatusName(status))
+
+		resp := protocol.NewJoinResponse(nm.Info.Name, status)
+		resp.Node = req.Node
+		nm.send_join_response(via, from, req.Token, resp)
+	}
+
+	if nm.Info.Role != ROLE_MASTER && nm.Info.Master == nil {
+		reject(protocol.JOIN_REJECT_NO_MASTER)
+		return
+	}
+	if status := nm.token_valid(req.Token); status != protocol.JOIN_ACCEPT {
+		reject(status)
+		return
+	}
+
+	if nm.Info.Role != ROLE_MASTER {
+		resp := protocol.NewJoinResponse(nm.Info.Name, protocol.JOIN_REDIRECT)
+		resp.Master = nm.Info.Master.ID
+		resp.Node = req.Node
+		resp.Nodes = []*protocol.NodeRecord{node_record(nm.Info.Master)}
+		nm.send_join_response(via, from, req.Token, resp)
+		return
+	}
+
+	// Joiner proves possession of identity it claims.
+	// Unsigned path of members without identity does not apply to joining.
+	identity := IdentityFromKey(req.Identity)
+	if (identity == nil && !nm.Config.Insecure) || !nm.verify_frame(req.Node, identity, frame, req) {
+		reject(protocol.JOIN_REJECT_IDENTITY)
+		return
+	}
+	existing, exists := nm.Info.ByID[req.Node]
+	if exists && existing.Identity != nil && !existing.Identity.Equal(identity) {
+		reject(protocol.JOIN_REJECT_IDENTITY)
+		return
+	}
+
+	if !exists {
+		publish := req.Publish
+		if len(publish) < 1 {
+			publish = []*protocol.Endpoint{from_ep}
+		}
+		entry := &LogEntryYAML{
+			Op:       LOG_OP_NAMES[protocol.LOG_NODE_ADD],
+			Node:     req.Node.String(),
+			Name:     "node_" + req.Node.String()[0:8],
+			Key:      EncodeKey(req.Key),
+			Identity: EncodeKey(req.Identity),
+		}
+		for _, ep := range publish {
+			entry.Publish = append(entry.Publish, ep.String())
+		}
+		for _, prefix := range req.Prefixes {
+			entry.Prefixes = append(entry.Prefixes, prefix.String())
+		}
+		if err := nm.propose(entry); err != nil {
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"module":  "ClusterManager",
+			"event":   "join",
+			"node_id": req.Node.String(),
+		}).Infof("Node %v joined from %v.", entry.Name, from_ep.String())
+
+	} else if (existing.Key == [32]byte{} && req.Key != [32]byte{}) || (existing.Identity == nil && identity != nil) {
+		// Member configured without keys. Publish its keys once.
+		entry := &LogEntryYAML{
+			Op:       LOG_OP_NAMES[protocol.LOG_NODE_ADD],
+			Node:     req.Node.String(),
+			Name:     existing.Name,
+			Key:      EncodeKey(req.Key),
+			Identity: EncodeKey(req.Identity),
+		}
+		for _, ep := range existing.Publish {
+			entry.Publish = append(entry.Publish, ep.String())
+		}
+		for _, prefix := range existing.Prefixes {
+			entry.Prefixes = append(entry.Prefixes, prefix.String())
+		}
+		if err := nm.propose(entry); err != nil {
+			return
+		}
+	}
+
+	nm.send_snapshot(req.Node, req.Token, via, from)
+}
+
+// join_mac : MAC of join response keyed by join token.
+func join_mac(token uuid.UUID, resp *protocol.JoinResponse) []byte {
+	mac := hmac.New(sha256.New, token[:])
+	mac.Write(protocol.MessageContext(protocol.JOIN_RESPONSE))
+	mac.Write(resp.MACBytes())
+	return mac.Sum(nil)
+}
+
+func (nm *ClusterManager) send_join_response(via NetTunnel, addr net.Addr, token uuid.UUID, resp *protocol.JoinResponse) {
+	copy(resp.MAC[:], join_mac(token, resp))
+	nm.SendMessageVia(via, addr, protocol.JOIN_RESPONSE, resp)
+}
+
+// send_snapshot : Send membership snapshot to joiner in chunks.
+func (nm *ClusterManager) send_snapshot(joiner uuid.UUID, token uuid.UUID, via NetTunnel, addr net.Addr) {
+	records := make([]*protocol.NodeRecord, 0, len(nm.Info.ByID))
+	for _, node := range nm.Info.ByID {
+		records = append(records, node_record(node))
+	}
+
+	for begin := 0; begin < len(records); begin += JOIN_SNAPSHOT_CHUNK {
+		end := begin + JOIN_SNAPSHOT_CHUNK
+		if end > len(records) {
+			end = len(records)
+		}
+		resp := protocol.NewJoinResponse(nm.Info.Name, protocol.JOIN_ACCEPT)
+		resp.Master = nm.Info.Self.ID
+		resp.Node = joiner
+		resp.Term = nm.Info.Term
+		resp.Index = nm.Info.Commit
+		resp.Total = uint16(len(records))
+		resp.Nodes = records[begin:end]
+		nm.send_join_response(via, addr, token, resp)
+	}
+}
+
+// OnJoinResponse : Response is accepted only from address join request is sent to, with MAC of join token.
+func (nm *ClusterManager) OnJoinResponse(resp *protocol.JoinResponse, from net.Addr) {
+	if resp.NetName != NetNameKey(nm.Info.Name) {
+		return
+	}
+
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+
+	joining := nm.joining
+	if joining == nil || resp.Node != nm.Info.Self.ID {
+		return
+	}
+	if expected := nm.NetTun.PeerAddr(joining.Address); from == nil || from.String() != expected.String() {
+		log.WithFields(log.Fields{
+			"module": "ClusterManager",
+			"event":  "join",
+		}).Warningf("Drop join response from %v. (expected: %v)", from, expected)
+		return
+	}
+	if !hmac.Equal(resp.MAC[:], join_mac(joining.Token, resp)) {
+		log.WithFields(log.Fields{
+			"module": "ClusterManager",
+			"event":  "join",
+		}).Warningf("Drop join response from %v with invalid MAC.", from)
+		return
+	}
+
+	switch resp.Status {
+	case protocol.JOIN_ACCEPT:
+
+	case protocol.JOIN_REDIRECT:
+		for _, record := range resp.Nodes {
+			if record.ID == resp.Master && len(record.Publish) > 0 {
+				joining.Address = record.Publish[0]
+				nm.send_join_request()
+				return
+			}
+		}
+		return
+
+	case protocol.JOIN_REJECT_NO_MASTER:
+		// Cluster is electing. Retry later.
+		return
+
+	default:
+		log.WithFields(log.Fields{
+			"module": "ClusterManager",
+			"event":  "join",
+		}).Errorf("Join rejected: %v", JoinStatusName(resp.Status))
+		nm.finish_join()
+		return
+	}
+
+	if joining.Records == nil || joining.Index != resp.Index {
+		joining.Index = resp.Index
+		joining.Records = make(map[uuid.UUID]*protocol.NodeRecord)
+	}
+	for _, record := range resp.Nodes {
+		joining.Records[record.ID] = record
+	}
+	if len(joining.Records) < int(resp.Total) {
+		return
+	}
+
+	nm.install_snapshot(resp, joining.Records)
+	nm.finish_join()
+}
+
+// Leave : Propose removal of this node and wait until it is committed. Join in progress is cancelled.
+// Proposal is resent every heartbeat timeout, since master may change meanwhile.
+func (nm *ClusterManager) Leave(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	retry := time.Duration(nm.Info.HeartbeatTimeout) * time.Millisecond
+	sent := time.Time{}
+
+	nm.lock.Lock()
+	if nm.joining != nil || nm.Config.Join != nil {
+		nm.finish_join()
+	}
+	nm.lock.Unlock()
+
+	for {
+		var err error
+
+		nm.lock.Lock()
+		member := nm.is_member()
+		if member && time.Since(sent) >= retry {
+			sent = time.Now()
+			err = nm.propose_self(&LogEntryYAML{Op: LOG_OP_NAMES[protocol.LOG_NODE_REMOVE]})
+		}
+		nm.lock.Unlock()
+
+		if !member {
+			return nil
+		}
+		if err != nil && err.Error() != ERR_NO_MASTER {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return errors.New(ERR_LEAVE_TIMEOUT)
+		}
+		time.Sleep(time.Duration(nm.Info.HeartbeatPeriod) * time.Millisecond)
+	}
+}
+
+// install_snapshot : Replace membership with snapshot from master.
+func (nm *ClusterManager) install_snapshot(resp *protocol.JoinResponse, records map[uuid.UUID]*protocol.NodeRecord) {
+	nodes := make(map[string]*NodeConfigYAML)
+	for id, record := range records {
+		node := &NodeConfigYAML{
+			Name:     record.Name,
+			Active:   true,
+			Key:      EncodeKey(record.Key),
+			Identity: EncodeKey(record.Identity),
+		}
+		for _, ep := range record.Publish {
+			node.Publish = append(node.Publish, ep.String())
+		}
+		for _, prefix := range record.Prefixes {
+			node.Prefixes = append(node.Prefixes, prefix.String())
+		}
+		nodes[id.String()] = node
+	}
+
+	nm.ctl.config_lock.Lock()
+	nm.Config.Nodes = nodes
+	nm.Config.Log = nil
+	nm.Config.Index = resp.Index
+	nm.Config.Commit = resp.Index
+	// Term of last entry in snapshot is unknown, so it never wins vote by it.
+	nm.Config.Compacted = resp.Index
+	nm.Config.CompactedTerm = 0
+	nm.ctl.config_lock.Unlock()
+	nm.Info.Index = resp.Index
+	nm.Info.Commit = resp.Index
+	nm.Info.Synced = resp.Index
+	if resp.Term > nm.Info.Term {
+		nm.Info.Term = resp.Term
+		nm.Info.VotedFor = uuid.Nil
+	}
+	nm.ctl.config_lock.Lock()
+	nm.Config.Term = nm.Info.Term
+	nm.ctl.config_lock.Unlock()
+	nm.record_master(resp.Term, resp.Master)
+
+	nm.load_nodes()
+	nm.Info.Master = nm.Info.ByID[resp.Master]
+	nm.Info.Role = ROLE_FOLLOWER
+	nm.reset_election_timer()
+	if nm.Capture != nil {
+		nm.RefreshCaptureSet()
+	}
+
+	log.WithFields(log.Fields{
+		"module": "ClusterManager",
+		"event":  "join",
+	}).Warningf("Joined network %v. (index: %v, nodes: %v)", nm.Info.Name, resp.Index, len(nodes))
+
+	nm.persist_election()
+}
@@ -0,0 +1,112 @@
+package ovtd
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"overturn/protocol"
+	"sync/atomic"
+	"time"
+)
+
+// Node liveness states.
+const (
+	NODE_ACTIVE = iota
+	NODE_SUSPECT
+	NODE_DOWN
+)
+
+const (
+	// Node is considered down after missing heartbeats for NODE_DOWN_FACTOR * HeartbeatTimeout.
+	NODE_DOWN_FACTOR = 3
+)
+
+func NodeStateName(state uint32) string {
+	switch state {
+	case NODE_ACTIVE:
+		return "active"
+	case NODE_SUSPECT:
+		return "suspect"
+	case NODE_DOWN:
+		return "down"
+	}
+	return "unknown"
+}
+
+func (node *NetworkNode) LoadState() uint32 {
+	return atomic.LoadUint32(&node.State)
+}
+
+func (node *NetworkNode) set_state(state uint32) {
+	last := atomic.SwapUint32(&node.State, state)
+	node.Active = state != NODE_DOWN
+	if last == state {
+		return
+	}
+
+	entry := log.WithFields(log.Fields{
+		"module":  "ClusterManager",
+		"event":   "liveness",
+		"node_id": node.ID.String(),
+	})
+	if state == NODE_ACTIVE {
+		entry.Infof("Node %v is %v.", node.Name, NodeStateName(state))
+	} else {
+		entry.Warningf("Node %v is %v. (last seen: %v)", node.Name, NodeStateName(state), node.LastSeen)
+	}
+}
+
+// mark_seen : Node proved to be alive.
+func (nm *ClusterManager) mark_seen(node *NetworkNode) {
+	node.LastSeen = time.Now()
+	node.set_state(NODE_ACTIVE)
+}
+
+// check_liveness : Degrade nodes not heard from in time.
+func (nm *ClusterManager) check_liveness() {
+	timeout := time.Duration(nm.Info.HeartbeatTimeout) * time.Millisecond
+	now := time.Now()
+
+	for _, node := range nm.Info.ByID {
+		if node == nm.Info.Self {
+			continue
+		}
+		if nm.Fallback != nil {
+			nm.update_fallback(node, now)
+		}
+
+		silent := now.Sub(node.LastSeen)
+		switch {
+		case silent > timeout*NODE_DOWN_FACTOR:
+			node.set_state(NODE_DOWN)
+		case silent > timeout:
+			node.set_state(NODE_SUSPECT)
+		}
+	}
+}
+
+func (nm *ClusterManager) broadcast_activate() {
+	msg := protocol.NewNodeActivateMessage(nm.Info.Self.ID)
+	for id, node := range nm.Info.ByID {
+		if id == nm.Info.Self.ID {
+			continue
+		}
+		nm.SendMessage(node, protocol.NODE_ACTIVATE, msg)
+	}
+}
+
+func (nm *ClusterManager) OnNodeActivate(msg *protocol.NodeActivate, frame protocol.OVTPacket) {
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+
+	node, ok := nm.Info.ByID[msg.ID]
+	if !ok || node == nm.Info.Self || !nm.verify_frame(node.ID, node.Identity, frame, msg) {
+		return
+	}
+	nm.mark_seen(node)
+
+	// Let the new comer know us and current master.
+	hb_type := uint16(protocol.HEARTBEAT_NODE)
+	if nm.Info.Role == ROLE_MASTER {
+		hb_type = protocol.HEARTBEAT_MASTER
+	}
+	nm.SendMessage(node, hb_type, nm.new_heartbeat(hb_type))
+}
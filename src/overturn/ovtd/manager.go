@@ -1,39 +1,59 @@
 package ovtd
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
-	"github.com/coreos/go-iptables/iptables"
 	"github.com/google/uuid"
-	"github.com/janeczku/go-ipset/ipset"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"hash/fnv"
 	"net"
 	"overturn/protocol"
 	"runtime"
 	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
-	CAPTURE_MARK_CHAIN = "OVERTURN_CAPTURE"
-	CAPTURE_IPSET      = "overturned"
-	IF_NAME_PREFIX     = "ovt"
-)
+	IF_NAME_PREFIX = "ovt"
 
-var (
-	OUTPUT_RULE        []string = []string{"-m", "comment", "--comment", "Overturn mark traffics", "-j", CAPTURE_MARK_CHAIN}
-	ICMP_IGNORE_RULE   []string = []string{"-p", "icmp", "-j", "RETURN"}
-	RULE_NOT_MATCH_RET []string = []string{"-m", "set", "!", "--match-set", CAPTURE_IPSET, "dst", "-j", "RETURN"}
+	// Mark and routing table steering captured traffics to link tunnel. Offset by slot of network.
+	CAPTURE_MARK       = 0x66
+	KERNEL_ROUTE_TABLE = 94
 )
 
 type NetworkNode struct {
-	Active bool
-	Name   string
-	ID     uuid.UUID
+	Active   bool
+	Name     string
+	ID       uuid.UUID
+	Publish  []*protocol.Endpoint
+	Prefixes []*net.IPNet
+	Key      [32]byte
+	Identity ed25519.PublicKey
+
+	// Liveness
+	State        uint32
+	LastSeen     time.Time
+	LastDatagram time.Time
+	Fallback     uint32
+
+	// Relay. Last heartbeat received not via relay, and nodes reported reachable by node.
+	LastDirect time.Time
+	Reach      []uuid.UUID
+
+	// Max OVT packet size over primary transport. 0 if unknown.
+	PathMTU uint32
+
+	// Underlay paths to publish endpoints.
+	Paths *PathSet
 }
 
 type NetworkCluster struct {
+	Name              string
 	Token             uuid.UUID
 	TokenExpireBefore uint64
 	TokenExpireAfter  uint64
@@ -41,38 +61,136 @@ type NetworkCluster struct {
 	Index             uint64
 	HeartbeatPeriod   uint32
 	HeartbeatTimeout  uint32
-	ByIP              map[[4]byte]*NetworkNode
+	ByIP              map[[16]byte]*NetworkNode
 	ByID              map[uuid.UUID]*NetworkNode
+	Routes            *RouteTable
 
 	Master *NetworkNode
 	Self   *NetworkNode
+
+	// Election
+	Role             uint8
+	VotedFor         uuid.UUID
+	Votes            map[uuid.UUID]bool
+	ElectionDeadline time.Time
+
+	// Replication. Entries up to Commit are applied to membership.
+	// Master tracks index acknowledged by each follower. Follower tracks index its log matches master to.
+	Commit       uint64
+	Match        map[uuid.UUID]uint64
+	Synced       uint64
+	MasterCommit uint64
+
+	// Recently removed nodes, served log up to their removal.
+	Removed map[uuid.UUID]*RemovedNode
+}
+
+type RemovedNode struct {
+	Node  *NetworkNode
+	Index uint64
+	At    time.Time
 }
 
 type ClusterManager struct {
+	UnknownStat   uint64
+	FragmentStat  uint64
+	RelayStat     uint64
+	RelayDropStat uint64
+
 	Config *NetworkClusterYAML
 
 	Info *NetworkCluster
 
-	Ipt     *iptables.IPTables
-	CapIPs  *ipset.IPSet
+	Slot    int
+	NetID   uint32
+	Capture CaptureBackend
 	IptMark uint32
+	RtTable int
+
+	NetTun   NetTunnel
+	Fallback NetTunnel
+	LinkTun  *LinkTunnel
+	Sessions *SessionTable
 
-	NetTun  *ICMPTunnel
-	LinkTun *LinkTunnel
+	// Replay protection
+	Epoch     uint32
+	Replay    *ReplayGuard
+	Sequences *SequenceTable
+
+	Fragments *Reassembler
 
 	ctl      *Controller
 	fd_index uint32
+	frag_id  uint32
+	probe_id uint32
+	probes   map[uuid.UUID]*pathSearch
+	unsigned map[uuid.UUID]bool // members warned for unsigned bootstrap
+	lock     sync.Mutex
+	running  uint32
+	stopSig  chan int
+	joining  *JoinState
+
+	reconcile_at time.Time
+	publish_at   time.Time
+
+	// Message types warned as unknown.
+	unknown_types sync.Map
+
+	// Next hops to nodes reached via relay.
+	relays     map[uuid.UUID]*NetworkNode
+	relay_lock sync.RWMutex
+
+	// Guards routes, self and node maps of Info against packet path.
+	route_lock sync.RWMutex
+
+	handlers     map[uint16]MessageHandler
+	handler_lock sync.RWMutex
 }
 
-func ToIPv4Key(ip net.IP) [4]byte {
-	return [4]byte{ip[0], ip[1], ip[2], ip[3]}
+// ToIPKey : Key of IP in 16-byte form. IPv4 is IPv4-mapped.
+func ToIPKey(ip net.IP) [16]byte {
+	var key [16]byte
+	copy(key[:], ip.To16())
+	return key
 }
 
-func NewClusterManager(ctl *Controller, config *NetworkClusterYAML) (*ClusterManager, error) {
+func NetNameKey(name string) [16]byte {
+	var key [16]byte
+	copy(key[:], name)
+	return key
+}
+
+// NetID : Hash of network name, carried in extended header of packets of network.
+func NetID(name string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	return hash.Sum32()
+}
+
+// NetTag : Short tag of network naming its chains and sets.
+func NetTag(name string) string {
+	return fmt.Sprintf("%08x", NetID(name))
+}
+
+// NewClusterManager : Create manager of network. Networks running in one daemon occupy distinct slots.
+func NewClusterManager(ctl *Controller, name string, slot int, config *NetworkClusterYAML) (*ClusterManager, error) {
 	var err error = nil
 
 	nm := new(ClusterManager)
-	nm.IptMark = 0x66
+	nm.Slot = slot
+	nm.NetID = NetID(name)
+	nm.IptMark = CAPTURE_MARK + uint32(slot)
+	nm.RtTable = KERNEL_ROUTE_TABLE + slot
+	nm.stopSig = make(chan int)
+	nm.Sessions = NewSessionTable()
+	nm.Epoch = uint32(time.Now().Unix())
+	nm.Replay = NewReplayGuard()
+	nm.Sequences = NewSequenceTable()
+	nm.Fragments = NewReassembler()
+	nm.probes = make(map[uuid.UUID]*pathSearch)
+	nm.unsigned = make(map[uuid.UUID]bool)
+	nm.handlers = make(map[uint16]MessageHandler)
+	nm.register_handlers()
 	fallback := func(err error, desp string) (*ClusterManager, error) {
 		var detail string
 		if err != nil {
@@ -92,13 +210,20 @@ func NewClusterManager(ctl *Controller, config *NetworkClusterYAML) (*ClusterMan
 	nm.Config = config
 	nm.ctl = ctl
 
-	if err = nm.prepare(); err != nil {
+	switch config.Multipath {
+	case "", MULTIPATH_BEST, MULTIPATH_SPREAD:
+	default:
+		err = fmt.Errorf("Unknown multipath mode %v.", config.Multipath)
+		return fallback(err, "Invalid network configure.")
+	}
+
+	if err = nm.prepare(name); err != nil {
 		return nil, err
 	}
 
-	nm.NetTun, err = NewICMPTunnel("0.0.0.0")
+	nm.NetTun, err = NewNetTunnel(config)
 	if err != nil {
-		return fallback(err, "Cannot listen icmp")
+		return fallback(err, "Cannot create network tunnel.")
 	}
 	defer func() {
 		if err != nil {
@@ -106,6 +231,16 @@ func NewClusterManager(ctl *Controller, config *NetworkClusterYAML) (*ClusterMan
 		}
 	}()
 
+	nm.Fallback, err = NewFallbackTunnel(config)
+	if err != nil {
+		return fallback(err, "Cannot create fallback tunnel.")
+	}
+	defer func() {
+		if err != nil && nm.Fallback != nil {
+			nm.Fallback.Destroy()
+		}
+	}()
+
 	// create p2p device
 	var net_ns *netlink.Handle
 	var li []netlink.Link
@@ -115,10 +250,17 @@ func NewClusterManager(ctl *Controller, config *NetworkClusterYAML) (*ClusterMan
 	}
 	defer net_ns.Delete()
 
+	// Free names taken by links of dead daemons.
+	if err = ReconcileLinks(); err != nil {
+		return fallback(err, "Cannot reconcile links.")
+	}
+
 	var link_name string
-	tail_num, found := 0, true
 	li, err = net_ns.LinkList()
-	for ; tail_num < 10 && found; tail_num++ {
+	if err != nil {
+		return fallback(err, "Cannot list links.")
+	}
+	for tail_num, found := 0, true; found; tail_num++ {
 		link_name = IF_NAME_PREFIX + strconv.Itoa(tail_num)
 		found = false
 		for _, link := range li {
@@ -129,26 +271,32 @@ func NewClusterManager(ctl *Controller, config *NetworkClusterYAML) (*ClusterMan
 			}
 		}
 	}
-	if tail_num >= 10 {
-		fallback(nil, "Too many links.")
-		return nil, err
-	}
-	nm.LinkTun, err = NewLinkTunnel(link_name, runtime.NumCPU())
+	nm.LinkTun, err = NewLinkTunnel(link_name, runtime.NumCPU(), nm.link_mtu())
 	if err != nil {
 		return fallback(err, fmt.Sprintf("Cannot add link %v", link_name))
 	}
+	defer func() {
+		if err != nil {
+			nm.LinkTun.Close(nil)
+		}
+	}()
+	if err = nm.LinkTun.SetAlias(owner_alias(name)); err != nil {
+		return fallback(err, fmt.Sprintf("Cannot tag link %v", link_name))
+	}
 
-	if nm.Ipt, err = iptables.New(); err != nil {
-		return fallback(err, "Cannot create iptables controller instance.")
+	tag := NetTag(name)
+	if nm.Capture, err = NewCaptureBackend(ctl.Options.Capture, tag, nm.IptMark, nm.tunnel_ignore_ports()); err != nil {
+		return fallback(err, "Cannot create capture backend.")
 	}
+	clear_stale_capture(nm.Capture, tag, nm.IptMark)
 
-	// setup iptables rules
+	// setup capture rules
 	if err = nm.RefreshRules(); err != nil {
 		log.WithFields(log.Fields{
 			"module":     "ClusterManager",
 			"event":      "configure",
 			"err_detail": err.Error(),
-		}).Error("Cannot initialize iptables rules.")
+		}).Errorf("Cannot initialize %v capture rules.", nm.Capture.Name())
 		return nil, err
 	}
 
@@ -160,8 +308,7 @@ func (nm *ClusterManager) Start() error {
 
 	defer func() {
 		if err != nil {
-			nm.ClearIPSetRules()
-			nm.ClearIptablesRules()
+			nm.Capture.ClearRules()
 		}
 	}()
 
@@ -174,24 +321,75 @@ func (nm *ClusterManager) Start() error {
 		}
 	}()
 
+	// Routes via link can be installed only after link is up.
+	if err = nm.RefreshKernelRoute(); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			nm.ClearKernelRoute()
+		}
+	}()
+
 	if err = nm.NetTun.Start(); err != nil {
 		return err
 	}
 	defer func() {
 		if err != nil {
-			nm.LinkTun.Stop()
+			nm.NetTun.Stop()
 		}
 	}()
 
+	if nm.Fallback != nil {
+		if err = nm.Fallback.Start(); err != nil {
+			return err
+		}
+	}
+
+	if reporter, ok := nm.NetTun.(PathMTUReporter); ok {
+		reporter.OnPathMTU(nm.OnPathMTU)
+	}
 	nm.start_handler()
-	// Forwarder
-	//go nm.cluster_bootstrap()
+	nm.reconcile_at = time.Now().Add(RECONCILE_PERIOD)
+	atomic.StoreUint32(&nm.running, 1)
+
+	nm.lock.Lock()
+	nm.broadcast_activate()
+	nm.lock.Unlock()
+
+	if nm.Config.Join != nil {
+		nm.resume_join()
+	}
+
+	go nm.cluster_bootstrap()
 	//go nm.log_stat()
 	return nil
 }
 
+// PacketDestination : Destination of IPv4 or IPv6 packet.
+func PacketDestination(buf []byte) (net.IP, error) {
+	if len(buf) < 1 {
+		return nil, fmt.Errorf("Empty packet.")
+	}
+	switch buf[0] >> 4 {
+	case ipv4.Version:
+		header, err := ipv4.ParseHeader(buf)
+		if err != nil {
+			return nil, err
+		}
+		return header.Dst, nil
+	case ipv6.Version:
+		header, err := ipv6.ParseHeader(buf)
+		if err != nil {
+			return nil, err
+		}
+		return header.Dst, nil
+	}
+	return nil, fmt.Errorf("Unknown IP version %v.", buf[0]>>4)
+}
+
 func (nm *ClusterManager) PacketRoute(buf []byte) {
-	header, err := ipv4.ParseHeader(buf)
+	dst, err := PacketDestination(buf)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"module": "ClusterManager",
@@ -200,30 +398,103 @@ func (nm *ClusterManager) PacketRoute(buf []byte) {
 		return
 	}
 
-	// ignore all non-ipv4 packet
-	if header.Version != 4 {
+	// Packet path does not take manager lock. Membership is published under route lock.
+	nm.route_lock.RLock()
+	node := nm.Info.Routes.Lookup(dst)
+	self := nm.Info.Self
+	nm.route_lock.RUnlock()
+	if node == nil || node == self || node.LoadState() == NODE_DOWN {
+		return
+	}
+
+	session := nm.Sessions.Get(node.ID)
+	if session == nil && !nm.Config.Insecure {
+		// Drop until session established.
+		nm.handshake(node)
+		return
+	}
+	if hop := nm.relay_hop(node); hop != nil {
+		nm.relay_payload(hop, node, session, buf)
+		return
+	}
+	tun := nm.route_tunnel(node)
+	ep := nm.route_endpoint(node, buf)
+	if ep == nil {
 		return
 	}
+	nm.route_payload(tun, tun.PeerAddr(ep), node, session, buf)
+}
 
-	node, ok := nm.Info.ByIP[ToIPv4Key(header.Dst.To4())]
-	if ok && node != nil {
-		tun_pkt := nm.NetTun.NewPacket(uint(len(buf)) + protocol.OVT_HEADER_SIZE)
-		ovt_pkt := protocol.PlaceNewOVTPacket(tun_pkt.PayloadRef(), uint(len(buf)), protocol.RAW_PAYLOAD)
-		copy(ovt_pkt.PayloadRef(), buf)
-		ovt_pkt.Pack()
-		nm.NetTun.Write(tun_pkt, &net.IPAddr{header.Dst, ""})
+// SendMessage : Encapsulate message and send it to node. Message goes via next hop if node is relayed.
+func (nm *ClusterManager) SendMessage(node *NetworkNode, msg_type uint16, msg protocol.Message) error {
+	if node == nil {
+		return fmt.Errorf("No route to node.")
 	}
+	hop := nm.relay_hop(node)
+	if node.Paths.Best() == nil && hop == nil {
+		return fmt.Errorf("No route to node.")
+	}
+
+	// Handshake is never sealed, since peer may have lost session.
+	var session *PeerSession
+	if msg_type != protocol.HANDSHAKE {
+		session = nm.Sessions.Get(node.ID)
+	}
+
+	// Keep probing datagram path while relayed or falling back, so it can be recovered.
+	var err error
+	ep := node.Paths.Best()
+	if ep != nil {
+		err = nm.send_message(nm.NetTun, nm.NetTun.PeerAddr(ep), node.ID, session, msg_type, msg)
+	}
+	if hop != nil {
+		err = nm.relay_message(hop, node, session, msg_type, msg)
+	} else if tun := nm.route_tunnel(node); tun != nm.NetTun {
+		err = nm.send_message(tun, tun.PeerAddr(ep), node.ID, session, msg_type, msg)
+	}
+	return err
 }
 
-func (nm *ClusterManager) DispatchOVTPacket(pkt protocol.OVTPacket) {
+// SendMessageTo : Encapsulate message and send it to address.
+func (nm *ClusterManager) SendMessageTo(addr net.Addr, msg_type uint16, msg protocol.Message) error {
+	return nm.SendMessageVia(nm.NetTun, addr, msg_type, msg)
+}
 
-	switch pkt.PayloadType() {
-	case protocol.RAW_PAYLOAD:
-		nm.DeliverPayload(pkt.PayloadRef())
-	default:
-		break
+// SendMessageVia : Encapsulate message and send it to address by specified tunnel.
+func (nm *ClusterManager) SendMessageVia(tun NetTunnel, addr net.Addr, msg_type uint16, msg protocol.Message) error {
+	return nm.send_message(tun, addr, uuid.Nil, nil, msg_type, msg)
+}
+
+// send_message : Encapsulate message with extended header, sealed if session is given.
+func (nm *ClusterManager) send_message(tun NetTunnel, addr net.Addr, peer uuid.UUID, session *PeerSession, msg_type uint16, msg protocol.Message) error {
+	tun_pkt := tun.NewPacket(uint(frame_overhead(session)) + msg.Size())
+	if _, err := nm.place_message(tun_pkt.PayloadRef(), peer, session, msg_type, msg); err != nil {
+		return err
+	}
+	_, err := tun.Write(tun_pkt, addr)
+	return err
+}
+
+// place_message : Encapsulate message into buf, sized by frame_overhead.
+func (nm *ClusterManager) place_message(buf []byte, peer uuid.UUID, session *PeerSession, msg_type uint16, msg protocol.Message) (protocol.OVTPacket, error) {
+	size := msg.Size()
+	sequence := nm.Sequences.Next(peer)
+	if session == nil {
+		ovt_pkt := protocol.PlaceNewExtendedOVTPacket(buf, size, msg_type, nm.NetID, nm.Info.Self.ID, nm.Epoch, sequence)
+		nm.sign_frame(ovt_pkt, msg)
+		if err := msg.Place(ovt_pkt.PayloadRef()); err != nil {
+			return nil, err
+		}
+		return ovt_pkt, nil
 	}
 
+	ovt_pkt := protocol.PlaceNewSecureOVTPacket(buf, size, msg_type, nm.NetID, nm.Info.Self.ID, nm.Epoch, sequence)
+	nm.sign_frame(ovt_pkt, msg)
+	if err := msg.Place(ovt_pkt.SecurePayloadRef()); err != nil {
+		return nil, err
+	}
+	ovt_pkt.Seal(session.Send)
+	return ovt_pkt, nil
 }
 
 func (nm *ClusterManager) DeliverPayload(payload []byte) {
@@ -233,7 +504,7 @@ func (nm *ClusterManager) DeliverPayload(payload []byte) {
 
 func (nm *ClusterManager) start_handler() {
 
-	nm.NetTun.Handler(func(tun *ICMPTunnel, pkt protocol.TunnelPacket) {
+	handler := func(tun NetTunnel, pkt protocol.TunnelPacket, from net.Addr) {
 		payload := pkt.PayloadRef()
 		is_encap, packet, err := protocol.OVTPacketUnpack(payload, 65536)
 
@@ -246,47 +517,127 @@ func (nm *ClusterManager) start_handler() {
 					}).Error(err.Error())
 				}
 			} else {
-				nm.DispatchOVTPacket(packet)
+				// Packets of other networks arrive at shared sockets, such as raw ICMP ones.
+				if !packet.IsExtended() || packet.Network() != nm.NetID {
+					return
+				}
+				if packet.IsSecure() {
+					if packet = nm.open_packet(packet); packet == nil {
+						return
+					}
+				} else if !nm.accept_plain(packet) {
+					return
+				}
+				nm.DispatchOVTPacket(tun, packet, from)
 			}
 		}
-	})
+	}
+	nm.NetTun.Handler(handler)
+	if nm.Fallback != nil {
+		nm.Fallback.Handler(handler)
+	}
 
 	nm.LinkTun.Handler(func(tun *LinkTunnel, data []byte) {
 		nm.PacketRoute(data)
 	})
 }
 
-func (nm *ClusterManager) ClearIPSetRules() {
-	nm.CapIPs.Flush()
-	nm.CapIPs.Destroy()
-	nm.CapIPs = nil
+// kernel_route_families : Address families steered to link tunnel. IPv6 only if it is captured.
+func (nm *ClusterManager) kernel_route_families() []int {
+	if nm.Capture.IPv6() {
+		return []int{netlink.FAMILY_V4, netlink.FAMILY_V6}
+	}
+	return []int{netlink.FAMILY_V4}
+}
+
+func default_route_dst(family int) *net.IPNet {
+	if family == netlink.FAMILY_V6 {
+		return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 8*net.IPv6len)}
+	}
+	return &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 8*net.IPv4len)}
 }
 
-func (nm *ClusterManager) ClearIptablesRules() {
-	nm.Ipt.ClearChain("mangle", CAPTURE_MARK_CHAIN)
-	nm.Ipt.Delete("mangle", "OUTPUT", OUTPUT_RULE...)
-	nm.Ipt.DeleteChain("mangle", CAPTURE_MARK_CHAIN)
+// ClearKernelRoute : Remove fwmark rules and routes in table of network.
+func (nm *ClusterManager) ClearKernelRoute() {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, _ := netlink.RuleListFiltered(family, &netlink.Rule{Table: nm.RtTable}, netlink.RT_FILTER_TABLE)
+		for idx := range rules {
+			netlink.RuleDel(&rules[idx])
+		}
+		routes, _ := netlink.RouteListFiltered(family, &netlink.Route{Table: nm.RtTable}, netlink.RT_FILTER_TABLE)
+		for idx := range routes {
+			netlink.RouteDel(&routes[idx])
+		}
+	}
 }
 
-//func (nm *ClusterManager) ClearKernelRoute() {
-//    rule := netlink.NewRule()
-//    rule.Table = 94
-//    rule.Mark = nm.IptMark
-//
-//    netlink.RuleDel(&rule)
-//
-//    route := netlink.
-//}
-//
-//func (nm *ClusterManager) RefreshKernelRoute() {
-//
-//}
+// RefreshKernelRoute : Reconcile fwmark rule and default route via link tunnel, so that marked traffics reach link.
+// Stale rules and routes in table of network are removed.
+func (nm *ClusterManager) RefreshKernelRoute() error {
+	if err := nm.LinkTun.update_attrs(); err != nil {
+		return err
+	}
+	link_index := nm.LinkTun.Link.Attrs().Index
+
+	for _, family := range nm.kernel_route_families() {
+		rules, err := netlink.RuleListFiltered(family, &netlink.Rule{Table: nm.RtTable}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return err
+		}
+		found := false
+		for idx := range rules {
+			if rules[idx].Mark == nm.IptMark && !found {
+				found = true
+				continue
+			}
+			if err = netlink.RuleDel(&rules[idx]); err != nil {
+				return err
+			}
+		}
+		if !found {
+			rule := netlink.NewRule()
+			rule.Family = family
+			rule.Table = nm.RtTable
+			rule.Mark = nm.IptMark
+			if err = netlink.RuleAdd(rule); err != nil {
+				return err
+			}
+		}
+
+		routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: nm.RtTable}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return err
+		}
+		for idx := range routes {
+			if routes[idx].LinkIndex == link_index {
+				continue
+			}
+			if err = netlink.RouteDel(&routes[idx]); err != nil {
+				return err
+			}
+		}
+		if err = netlink.RouteReplace(&netlink.Route{
+			LinkIndex: link_index,
+			Dst:       default_route_dst(family),
+			Table:     nm.RtTable,
+			Scope:     netlink.SCOPE_LINK,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
 
 func (nm *ClusterManager) Stop() error {
 	var err error
 
-	nm.ClearIPSetRules()
-	nm.ClearIptablesRules()
+	if atomic.CompareAndSwapUint32(&nm.running, 1, 0) {
+		<-nm.stopSig
+	}
+
+	nm.ClearKernelRoute()
+	nm.Capture.ClearRules()
 
 	defer func() {
 		if err != nil {
@@ -303,32 +654,52 @@ func (nm *ClusterManager) Stop() error {
 	if err = nm.NetTun.Stop(); err != nil {
 		return err
 	}
+	if nm.Fallback != nil {
+		if err = nm.Fallback.Stop(); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
 func (nm *ClusterManager) RefreshRules() error {
-	if err := nm.RefreshIPSetRules(); err != nil {
+	if err := nm.Capture.RefreshRules(); err != nil {
 		return err
 	}
 
-	if err := nm.RefreshIptablesRules(); err != nil {
+	if err := nm.RefreshCaptureSet(); err != nil {
 		return err
 	}
 
+	// Kernel routes are installed when started.
+	if atomic.LoadUint32(&nm.running) > 0 {
+		if err := nm.RefreshKernelRoute(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// Destroy : Release link and transports of stopped manager.
 func (nm *ClusterManager) Destroy() error {
-	return nil
+	var err error
+
+	if nm.Fallback != nil {
+		nm.Fallback.Destroy()
+	}
+	if err = nm.NetTun.Destroy(); err != nil {
+		return err
+	}
+	return nm.LinkTun.Close(nil)
 }
 
-func (nm *ClusterManager) prepare() error {
+func (nm *ClusterManager) prepare(name string) error {
 	var err error
-	var id uuid.UUID
-	var ok bool
 
 	nm.Info = new(NetworkCluster)
+	nm.Info.Name = name
 	nm.Info.Token, err = uuid.Parse(nm.Config.Token)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -341,11 +712,46 @@ func (nm *ClusterManager) prepare() error {
 	nm.Info.TokenExpireAfter = nm.Config.TokenExpireAfter
 	nm.Info.HeartbeatPeriod = nm.Config.HeartbeatPeriod
 	nm.Info.HeartbeatTimeout = nm.Config.HeartbeatTimeout
+	if nm.Info.HeartbeatPeriod == 0 {
+		nm.Info.HeartbeatPeriod = nm.ctl.Options.HeartbeatPeriod
+	}
+	if nm.Info.HeartbeatTimeout == 0 {
+		nm.Info.HeartbeatTimeout = nm.ctl.Options.HeartbeatTimeout
+	}
 	nm.Info.Term = nm.Config.Term
 	nm.Info.Index = nm.Config.Index
+	if nm.Config.Commit == 0 {
+		// Configures written before commit index have all entries applied.
+		nm.ctl.config_lock.Lock()
+		nm.Config.Commit = nm.Config.Index
+		nm.ctl.config_lock.Unlock()
+	}
+	nm.Info.Commit = nm.Config.Commit
+	if nm.Config.Vote != "" {
+		if nm.Info.VotedFor, err = uuid.Parse(nm.Config.Vote); err != nil {
+			log.WithFields(log.Fields{
+				"module":     "ClusterManager",
+				"event":      "initialize",
+				"err_detail": err.Error(),
+			}).Warning("Invalid vote record. Ignore.")
+			nm.Info.VotedFor = uuid.Nil
+		}
+	}
+	nm.Info.Role = ROLE_FOLLOWER
+
+	nm.load_nodes()
+	nm.Info.Master = nil
+
+	return nil
+}
+
+// load_nodes : (Re)build node indexes from membership configure.
+func (nm *ClusterManager) load_nodes() {
+	var err error
+	var id uuid.UUID
 
-	nm.Info.ByIP = make(map[[4]byte]*NetworkNode)
-	nm.Info.ByID = make(map[uuid.UUID]*NetworkNode)
+	by_ip := make(map[[16]byte]*NetworkNode)
+	by_id := make(map[uuid.UUID]*NetworkNode)
 
 	// load configure
 	node_info := new(NetworkNode)
@@ -363,35 +769,65 @@ func (nm *ClusterManager) prepare() error {
 			continue
 		}
 
-		nm.Info.ByID[node_info.ID] = node_info
+		by_id[node_info.ID] = node_info
 		node_info.Active = cfg.Active
 		node_info.Name = cfg.Name
+		if last, ok := nm.Info.ByID[node_info.ID]; ok {
+			node_info.State = last.LoadState()
+			node_info.LastSeen = last.LastSeen
+			node_info.LastDatagram = last.LastDatagram
+			node_info.LastDirect = last.LastDirect
+			node_info.Reach = last.Reach
+			node_info.Fallback = atomic.LoadUint32(&last.Fallback)
+			node_info.PathMTU = atomic.LoadUint32(&last.PathMTU)
+		} else if cfg.Active {
+			// Give a grace period to nodes assumed active.
+			node_info.State = NODE_ACTIVE
+			node_info.LastSeen = time.Now()
+			node_info.LastDatagram = node_info.LastSeen
+		} else {
+			node_info.State = NODE_DOWN
+		}
+		if cfg.Key != "" {
+			if node_info.Key, err = ParseKey(cfg.Key); err != nil {
+				log.WithFields(log.Fields{
+					"module":     "ClusterManager",
+					"event":      "initialize",
+					"err_detail": err.Error(),
+					"node_id":    ID,
+				}).Errorf("Invalid key of node %v. Ignore.", cfg.Name)
+			}
+		}
+		if cfg.Identity != "" {
+			if node_info.Identity, err = ParsePublicIdentity(cfg.Identity); err != nil {
+				log.WithFields(log.Fields{
+					"module":     "ClusterManager",
+					"event":      "initialize",
+					"err_detail": err.Error(),
+					"node_id":    ID,
+				}).Errorf("Invalid identity of node %v. Ignore.", cfg.Name)
+			}
+		}
 
 		// Parse IP
 		for _, ip_raw := range cfg.Publish {
-			ip := net.ParseIP(ip_raw)
-			if ip == nil {
+			ep, err := protocol.ParseEndpoint(ip_raw)
+			if err != nil {
 				log.WithFields(log.Fields{
 					"module":     "ClusterManager",
 					"event":      "initialize",
-					"err_detail": "",
+					"err_detail": err.Error(),
 					"node_id":    ID,
-				}).Errorf("Invalid IP Address %v. Ignore.", ip_raw)
+				}).Errorf("Invalid publish address %v. Ignore.", ip_raw)
 
 				continue
 			}
-			ip = ip.To4()
-			if ip == nil {
-				log.WithFields(log.Fields{
-					"module":  "ClusterManager",
-					"event":   "initialize",
-					"node_if": ID,
-				}).Errorf("Not a IPv4 Address: %v. Ignore.", ip_raw)
-
-				continue
+			ip := ep.IP
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
 			}
 
-			if test_node, _ := nm.Info.ByIP[ToIPv4Key(ip.To4())]; test_node != nil {
+			if test_node, _ := by_ip[ToIPKey(ip)]; test_node != nil {
 				log.WithFields(log.Fields{
 					"module":     "ClusterManager",
 					"event":      "initialize",
@@ -402,7 +838,25 @@ func (nm *ClusterManager) prepare() error {
 				conflict_ips = append(conflict_ips, ip)
 				continue
 			}
-			nm.Info.ByIP[ToIPv4Key(ip)] = node_info
+			ep.IP = ip
+			by_ip[ToIPKey(ip)] = node_info
+			node_info.Publish = append(node_info.Publish, ep)
+		}
+
+		// Parse prefixes
+		for _, prefix_raw := range cfg.Prefixes {
+			prefix, err := protocol.ParsePrefix(prefix_raw)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"module":     "ClusterManager",
+					"event":      "initialize",
+					"err_detail": err.Error(),
+					"node_id":    ID,
+				}).Errorf("Invalid prefix %v. Ignore.", prefix_raw)
+
+				continue
+			}
+			node_info.Prefixes = append(node_info.Prefixes, prefix)
 		}
 
 		node_info = new(NetworkNode)
@@ -410,122 +864,70 @@ func (nm *ClusterManager) prepare() error {
 
 	// remove conflict ip
 	for _, ip := range conflict_ips {
-		node_info, ok = nm.Info.ByIP[ToIPv4Key(ip)]
+		conflict_node, ok := by_ip[ToIPKey(ip)]
 		if ok {
 			log.WithFields(log.Fields{
 				"module":     "ClusterManager",
 				"event":      "initialize",
 				"err_detail": "",
-				"node_id":    node_info.ID.String(),
-			}).Warningf("IP %v removed from %v due to conflict.", ip.String(), node_info.Name)
-			delete(nm.Info.ByIP, ToIPv4Key(ip))
+				"node_id":    conflict_node.ID.String(),
+			}).Warningf("IP %v removed from %v due to conflict.", ip.String(), conflict_node.Name)
+			delete(by_ip, ToIPKey(ip))
+			publish := conflict_node.Publish[:0]
+			for _, published := range conflict_node.Publish {
+				if !published.IP.Equal(ip) {
+					publish = append(publish, published)
+				}
+			}
+			conflict_node.Publish = publish
 		}
 	}
 
 	//Find myself
 	id = nm.ctl.GetMachineID()
-	if existing, ok := nm.Info.ByID[id]; !ok {
+	self, ok := by_id[id]
+	if !ok {
 		// If not exists
-		nm.Info.Self = node_info
+		self = node_info
 		node_info.Active = false
 		node_info.Name = "node_" + id.String()[0:8]
 		node_info.ID = id
-	} else {
-		nm.Info.Self = existing
-	}
-	nm.Info.Master = nil
-
-	return nil
-}
-
-func (nm *ClusterManager) RefreshIPSetRules() error {
-	var err error = nil
-
-	fallback := func(err error, desp string) error {
-		log.WithFields(log.Fields{
-			"module":     "ClusterManager",
-			"event":      "ipset",
-			"err_detail": err.Error(),
-		}).Error(desp)
-		return err
 	}
+	self.State = NODE_ACTIVE
+	self.LastSeen = time.Now()
+	self.Key = nm.ctl.Key.Public
+	self.Identity = nm.ctl.GetIdentity()
 
-	if nm.CapIPs == nil {
-		nm.CapIPs, err = ipset.New(CAPTURE_IPSET, "hash:ip", &ipset.Params{})
-		if err != nil {
-			return fallback(err, "Cannot create ipset.")
+	// Keep measurements of paths to unchanged endpoints.
+	for id, node := range by_id {
+		var last_paths *PathSet
+		if last, ok := nm.Info.ByID[id]; ok {
+			last_paths = last.Paths
 		}
+		node.Paths = NewPathSet(node.Publish, last_paths)
 	}
 
-	if err = nm.CapIPs.Flush(); err != nil {
-		return fallback(err, "Cannot flush ipset.")
+	routes := build_routes(by_ip, by_id)
+	nm.route_lock.Lock()
+	nm.Info.Self = self
+	nm.Info.ByIP = by_ip
+	nm.Info.ByID = by_id
+	nm.Info.Routes = routes
+	nm.route_lock.Unlock()
+	if nm.Info.Master != nil {
+		nm.Info.Master = by_id[nm.Info.Master.ID]
 	}
-
-	for key_ip, _ := range nm.Info.ByIP {
-		ip := net.IP(key_ip[:])
-		if err = nm.CapIPs.Add(ip.String(), 0); err != nil {
-			return fallback(err, fmt.Sprintf("Error occur when add %v", ip.String()))
-		}
-	}
-
-	return nil
+	nm.Sessions.Forget(by_id)
+	nm.Replay.Forget(by_id)
 }
 
-func (nm *ClusterManager) RefreshIptablesRules() error {
-	var err error = nil
-	var ok bool
-	fallback := true
-
-	nm.ClearIptablesRules()
-	nm.Ipt.NewChain("mangle", CAPTURE_MARK_CHAIN)
-	defer func() {
-		if fallback {
-			nm.Ipt.DeleteChain("mangle", CAPTURE_MARK_CHAIN)
-			log.WithFields(log.Fields{
-				"module":     "ClusterManager",
-				"event":      "iptables",
-				"err_detail": err.Error(),
-			}).Error("Cannot apply rules.")
-		}
-	}()
-
-	ok, err = nm.Ipt.Exists("mangle", "OUTPUT", OUTPUT_RULE...)
-	if err != nil {
-		return err
-	}
-	if !ok {
-		if err = nm.Ipt.Insert("mangle", "OUTPUT", 1, OUTPUT_RULE...); err != nil {
-			return err
-		}
-	}
-	defer func() {
-		if fallback {
-			nm.Ipt.Delete("mangle", "OUTPUT", OUTPUT_RULE...)
-		}
-	}()
-
-	if err = nm.Ipt.Append("mangle", CAPTURE_MARK_CHAIN, RULE_NOT_MATCH_RET...); err != nil {
-		return err
-	}
-	defer func() {
-		if fallback {
-			nm.Ipt.ClearChain("mangle", CAPTURE_MARK_CHAIN)
+// RefreshCaptureSet : Capture destinations routed to other nodes.
+func (nm *ClusterManager) RefreshCaptureSet() error {
+	prefixes := make([]*net.IPNet, 0)
+	nm.Info.Routes.Each(func(prefix *net.IPNet, node *NetworkNode) {
+		if node != nm.Info.Self {
+			prefixes = append(prefixes, prefix)
 		}
-	}()
-
-	if err = nm.Ipt.Append("mangle", CAPTURE_MARK_CHAIN, ICMP_IGNORE_RULE...); err != nil {
-		return err
-	}
-
-	mark := fmt.Sprintf("0x%x", nm.IptMark)
-	if err = nm.Ipt.Append("mangle", CAPTURE_MARK_CHAIN, "-j", "MARK", "--set-mark", mark); err != nil {
-		return err
-	}
-
-	if err = nm.Ipt.Append("mangle", CAPTURE_MARK_CHAIN, "-j", "RETURN"); err != nil {
-		return err
-	}
-
-	fallback = false
-	return nil
+	})
+	return nm.Capture.SyncSet(prefixes)
 }
@@ -0,0 +1,827 @@
+package ovtd
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/google/uuid"
+	"net"
+	"overturn/protocol"
+	"time"
+)
+
+const (
+	ERR_NOT_MASTER     = "Not master of network."
+	ERR_NO_MASTER      = "No master of network."
+	ERR_INVALID_LOG_OP = "Invalid membership log operation."
+
+	LOG_FETCH_MAX = 64
+	// Committed entries kept in log for lagging followers. Older ones are compacted into membership.
+	LOG_KEEP = 4 * LOG_FETCH_MAX
+
+	// Removed nodes are served log up to their removal for a while, so they learn it even if entry is lost.
+	REMOVED_KEEP = 3 * LEAVE_TIMEOUT
+)
+
+var LOG_OP_NAMES = map[uint8]string{
+	protocol.LOG_NODE_ADD:     "node_add",
+	protocol.LOG_NODE_REMOVE:  "node_remove",
+	protocol.LOG_NODE_PUBLISH: "node_publish",
+	protocol.LOG_TOKEN_ROTATE: "token_rotate",
+}
+
+func LogOpCode(name string) uint8 {
+	for code, op_name := range LOG_OP_NAMES {
+		if op_name == name {
+			return code
+		}
+	}
+	return 0
+}
+
+// LogEntryToMessage : Message of entry. Master of message is issuer of entry.
+func LogEntryToMessage(network string, entry *LogEntryYAML) (*protocol.LogEntry, error) {
+	var err error
+
+	msg := protocol.NewLogEntry(network, uuid.Nil)
+	msg.Index = entry.Index
+	msg.Term = entry.Term
+	if msg.Op = LogOpCode(entry.Op); msg.Op == 0 {
+		return nil, errors.New(ERR_INVALID_LOG_OP)
+	}
+	if entry.Node != "" {
+		if msg.Node, err = uuid.Parse(entry.Node); err != nil {
+			return nil, err
+		}
+	}
+	if entry.Token != "" {
+		if msg.Token, err = uuid.Parse(entry.Token); err != nil {
+			return nil, err
+		}
+	}
+	msg.TokenExpireBefore = entry.TokenExpireBefore
+	msg.TokenExpireAfter = entry.TokenExpireAfter
+	msg.Name = entry.Name
+	if entry.Key != "" {
+		if msg.Key, err = ParseKey(entry.Key); err != nil {
+			return nil, err
+		}
+	}
+	if entry.Identity != "" {
+		if msg.Identity, err = ParseKey(entry.Identity); err != nil {
+			return nil, err
+		}
+	}
+	if entry.Issuer != "" {
+		if msg.Issuer, err = uuid.Parse(entry.Issuer); err != nil {
+			return nil, err
+		}
+		msg.Master = msg.Issuer
+	}
+	if entry.Signature != "" {
+		if msg.Signature, err = ParseSignature(entry.Signature); err != nil {
+			return nil, err
+		}
+	}
+	for _, ep_raw := range entry.Publish {
+		ep, err := protocol.ParseEndpoint(ep_raw)
+		if err != nil {
+			return nil, err
+		}
+		msg.Publish = append(msg.Publish, ep)
+	}
+	for _, prefix_raw := range entry.Prefixes {
+		prefix, err := protocol.ParsePrefix(prefix_raw)
+		if err != nil {
+			return nil, err
+		}
+		msg.Prefixes = append(msg.Prefixes, prefix)
+	}
+	return msg, nil
+}
+
+func LogEntryFromMessage(msg *protocol.LogEntry) (*LogEntryYAML, error) {
+	op_name, ok := LOG_OP_NAMES[msg.Op]
+	if !ok {
+		return nil, errors.New(ERR_INVALID_LOG_OP)
+	}
+
+	entry := &LogEntryYAML{
+		Index:             msg.Index,
+		Term:              msg.Term,
+		Op:                op_name,
+		Name:              msg.Name,
+		TokenExpireBefore: msg.TokenExpireBefore,
+		TokenExpireAfter:  msg.TokenExpireAfter,
+		Key:               EncodeKey(msg.Key),
+		Identity:          EncodeKey(msg.Identity),
+		Signature:         EncodeSignature(msg.Signature),
+	}
+	if msg.Node != uuid.Nil {
+		entry.Node = msg.Node.String()
+	}
+	if msg.Token != uuid.Nil {
+		entry.Token = msg.Token.String()
+	}
+	if msg.Issuer != uuid.Nil {
+		entry.Issuer = msg.Issuer.String()
+	}
+	for _, ep := range msg.Publish {
+		entry.Publish = append(entry.Publish, ep.String())
+	}
+	for _, prefix := range msg.Prefixes {
+		entry.Prefixes = append(entry.Prefixes, prefix.String())
+	}
+	return entry, nil
+}
+
+// Propose : Append a membership change to log and replicate it. Master only.
+// Change is applied once majority of members acknowledge it.
+func (nm *ClusterManager) Propose(entry *LogEntryYAML) error {
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+
+	return nm.propose(entry)
+}
+
+func (nm *ClusterManager) propose(entry *LogEntryYAML) error {
+	if nm.Info.Role != ROLE_MASTER {
+		return errors.New(ERR_NOT_MASTER)
+	}
+	if err := nm.validate_log_entry(entry); err != nil {
+		return err
+	}
+
+	entry.Index = nm.Info.Index + 1
+	entry.Term = nm.Info.Term
+	entry.Issuer = nm.Info.Self.ID.String()
+	entry.Signature = ""
+
+	msg, err := LogEntryToMessage(nm.Info.Name, entry)
+	if err != nil {
+		return err
+	}
+	nm.sign(protocol.MessageContext(protocol.LOG_ENTRY), msg)
+	entry.Signature = EncodeSignature(msg.Signature)
+
+	if err = nm.append_log_entry(entry); err != nil {
+		return err
+	}
+
+	// removed node should also learn the change.
+	for _, node := range nm.Info.ByID {
+		if node.ID == nm.Info.Self.ID {
+			continue
+		}
+		nm.SendMessage(node, protocol.LOG_ENTRY, msg)
+	}
+
+	nm.advance_commit()
+	return nil
+}
+
+// validate_log_entry : Reject entry that can not be applied to current membership.
+func (nm *ClusterManager) validate_log_entry(entry *LogEntryYAML) error {
+	op := LogOpCode(entry.Op)
+	switch op {
+	case protocol.LOG_NODE_ADD, protocol.LOG_NODE_REMOVE, protocol.LOG_NODE_PUBLISH:
+		id, err := uuid.Parse(entry.Node)
+		if err != nil {
+			return err
+		}
+		if _, exists := nm.Info.ByID[id]; !exists && op != protocol.LOG_NODE_ADD {
+			return fmt.Errorf("Node %v not found.", entry.Node)
+		}
+	case protocol.LOG_TOKEN_ROTATE:
+		if _, err := uuid.Parse(entry.Token); err != nil {
+			return err
+		}
+	default:
+		return errors.New(ERR_INVALID_LOG_OP)
+	}
+	return nil
+}
+
+// append_log_entry : Append entry to log and persist it. Uncommitted entries after a rewritten one are dropped.
+func (nm *ClusterManager) append_log_entry(entry *LogEntryYAML) error {
+	nm.ctl.config_lock.Lock()
+	kept := nm.Config.Log[:0]
+	for _, existing := range nm.Config.Log {
+		if existing.Index < entry.Index {
+			kept = append(kept, existing)
+		}
+	}
+	nm.Config.Log = append(kept, entry)
+	nm.Config.Index = entry.Index
+	nm.ctl.config_lock.Unlock()
+	nm.Info.Index = entry.Index
+
+	return nm.ctl.PersistDynamicClusterConfig()
+}
+
+// truncate_log : Drop uncommitted entries after index.
+func (nm *ClusterManager) truncate_log(index uint64) {
+	if index < nm.Info.Commit {
+		index = nm.Info.Commit
+	}
+	nm.ctl.config_lock.Lock()
+	kept := nm.Config.Log[:0]
+	for _, existing := range nm.Config.Log {
+		if existing.Index <= index {
+			kept = append(kept, existing)
+		}
+	}
+	nm.Config.Log = kept
+	nm.Config.Index = index
+	nm.ctl.config_lock.Unlock()
+	nm.Info.Index = index
+
+	log.WithFields(log.Fields{
+		"module": "ClusterManager",
+		"event":  "membership",
+	}).Warningf("Uncommitted log entries after %v dropped.", index)
+
+	nm.ctl.PersistDynamicClusterConfig()
+}
+
+// advance_commit : Commit entries of current term acknowledged by majority. Master only.
+// Entries of earlier terms are committed with them.
+func (nm *ClusterManager) advance_commit() {
+	for index := nm.Info.Index; index > nm.Info.Commit; index-- {
+		if term, ok := nm.log_entry_term(index); !ok || term != nm.Info.Term {
+			break
+		}
+		acked := 0
+		for id := range nm.Info.ByID {
+			if id == nm.Info.Self.ID || nm.Info.Match[id] >= index {
+				acked++
+			}
+		}
+		if acked >= nm.quorum() {
+			nm.commit_to(index)
+			return
+		}
+	}
+}
+
+// commit_to : Apply entries up to index to membership.
+func (nm *ClusterManager) commit_to(index uint64) {
+	if index > nm.Info.Index {
+		index = nm.Info.Index
+	}
+	if index <= nm.Info.Commit {
+		return
+	}
+
+	removed := make([]*NetworkNode, 0)
+	for next := nm.Info.Commit + 1; next <= index; next++ {
+		entry := nm.log_entry(next)
+		if entry == nil {
+			break
+		}
+		if LogOpCode(entry.Op) == protocol.LOG_NODE_REMOVE {
+			if id, err := uuid.Parse(entry.Node); err == nil && nm.Info.ByID[id] != nil {
+				removed = append(removed, nm.Info.ByID[id])
+				nm.record_removed(nm.Info.ByID[id], next)
+			}
+		}
+		// Committed entries are applied by every member alike, so a failed one is skipped.
+		nm.ctl.config_lock.Lock()
+		nm.apply_log_entry(entry)
+		nm.ctl.config_lock.Unlock()
+		nm.Info.Commit = next
+	}
+	nm.ctl.config_lock.Lock()
+	nm.Config.Commit = nm.Info.Commit
+	nm.compact_log()
+	nm.ctl.config_lock.Unlock()
+
+	nm.load_nodes()
+	if nm.Capture != nil {
+		nm.RefreshCaptureSet()
+	}
+	nm.ctl.PersistDynamicClusterConfig()
+
+	// Tell removed nodes the commit at once. They get heartbeats for REMOVED_KEEP after.
+	if nm.Info.Role == ROLE_MASTER {
+		hb := nm.new_heartbeat(protocol.HEARTBEAT_MASTER)
+		for _, node := range removed {
+			if node != nm.Info.Self {
+				nm.SendMessage(node, protocol.HEARTBEAT_MASTER, hb)
+			}
+		}
+	}
+}
+
+// compact_log : Drop committed entries older than LOG_KEEP. They are applied to membership already.
+// Index and term of last dropped entry are kept for vote comparison. Called with configure lock held.
+func (nm *ClusterManager) compact_log() {
+	if nm.Info.Commit <= LOG_KEEP {
+		return
+	}
+	bound := nm.Info.Commit - LOG_KEEP
+	if bound <= nm.Config.Compacted {
+		return
+	}
+
+	kept := make([]*LogEntryYAML, 0, len(nm.Config.Log))
+	for _, entry := range nm.Config.Log {
+		if entry.Index > bound {
+			kept = append(kept, entry)
+		} else if entry.Index == bound {
+			nm.Config.CompactedTerm = entry.Term
+		}
+	}
+	nm.Config.Log = kept
+	nm.Config.Compacted = bound
+
+	// Masters of compacted terms are not asked anymore.
+	for term := range nm.Config.Masters {
+		if term < nm.Config.CompactedTerm {
+			delete(nm.Config.Masters, term)
+		}
+	}
+}
+
+// record_removed : Remember node removed by entry at index. Expired ones are forgotten.
+func (nm *ClusterManager) record_removed(node *NetworkNode, index uint64) {
+	now := time.Now()
+	if nm.Info.Removed == nil {
+		nm.Info.Removed = make(map[uuid.UUID]*RemovedNode)
+	}
+	for id, removed := range nm.Info.Removed {
+		if now.Sub(removed.At) > REMOVED_KEEP {
+			delete(nm.Info.Removed, id)
+		}
+	}
+	nm.Info.Removed[node.ID] = &RemovedNode{Node: node, Index: index, At: now}
+}
+
+// recently_removed : Node removed within REMOVED_KEEP, or nil.
+func (nm *ClusterManager) recently_removed(id uuid.UUID) *RemovedNode {
+	removed, ok := nm.Info.Removed[id]
+	if !ok || time.Since(removed.At) > REMOVED_KEEP {
+		return nil
+	}
+	return removed
+}
+
+// apply_log_entry : Apply committed entry to membership.
+func (nm *ClusterManager) apply_log_entry(entry *LogEntryYAML) error {
+	fallback := func(err error) error {
+		log.WithFields(log.Fields{
+			"module":     "ClusterManager",
+			"event":      "membership",
+			"err_detail": err.Error(),
+		}).Errorf("Cannot apply log entry %v.", entry.Index)
+		return err
+	}
+
+	switch LogOpCode(entry.Op) {
+	case protocol.LOG_NODE_ADD:
+		if _, err := uuid.Parse(entry.Node); err != nil {
+			return fallback(err)
+		}
+		nm.Config.Nodes[entry.Node] = &NodeConfigYAML{
+			Name:     entry.Name,
+			Publish:  entry.Publish,
+			Prefixes: entry.Prefixes,
+			Active:   true,
+			Key:      entry.Key,
+			Identity: entry.Identity,
+		}
+
+	case protocol.LOG_NODE_REMOVE:
+		delete(nm.Config.Nodes, entry.Node)
+
+	case protocol.LOG_NODE_PUBLISH:
+		node, ok := nm.Config.Nodes[entry.Node]
+		if !ok {
+			return fallback(fmt.Errorf("Node %v not found.", entry.Node))
+		}
+		node.Publish = entry.Publish
+		node.Prefixes = entry.Prefixes
+		if entry.Key != "" {
+			node.Key = entry.Key
+		}
+		if entry.Identity != "" {
+			node.Identity = entry.Identity
+		}
+
+	case protocol.LOG_TOKEN_ROTATE:
+		token, err := uuid.Parse(entry.Token)
+		if err != nil {
+			return fallback(err)
+		}
+		nm.Config.Token = entry.Token
+		nm.Config.TokenExpireBefore = entry.TokenExpireBefore
+		nm.Config.TokenExpireAfter = entry.TokenExpireAfter
+		nm.Info.Token = token
+		nm.Info.TokenExpireBefore = entry.TokenExpireBefore
+		nm.Info.TokenExpireAfter = entry.TokenExpireAfter
+
+	default:
+		return fallback(errors.New(ERR_INVALID_LOG_OP))
+	}
+
+	log.WithFields(log.Fields{
+		"module": "ClusterManager",
+		"event":  "membership",
+	}).Infof("Log entry %v applied: %v %v", entry.Index, entry.Op, entry.Node)
+
+	return nil
+}
+
+func (nm *ClusterManager) log_entry(index uint64) *LogEntryYAML {
+	for _, entry := range nm.Config.Log {
+		if entry.Index == index {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (nm *ClusterManager) log_entry_term(index uint64) (uint64, bool) {
+	if index > 0 && index == nm.Config.Compacted {
+		return nm.Config.CompactedTerm, true
+	}
+	for _, entry := range nm.Config.Log {
+		if entry.Index == index {
+			return entry.Term, true
+		}
+	}
+	return 0, false
+}
+
+// last_log_term : Term of last entry in log.
+func (nm *ClusterManager) last_log_term() uint64 {
+	term, _ := nm.log_entry_term(nm.Info.Index)
+	return term
+}
+
+func (nm *ClusterManager) fetch_log(master *NetworkNode, begin uint64, end uint64) {
+	if end-begin > LOG_FETCH_MAX {
+		end = begin + LOG_FETCH_MAX
+	}
+	req := protocol.NewLogFetch(nm.Info.Name, nm.Info.Self.ID, begin, end)
+	nm.SendMessage(master, protocol.LOG_FETCH, req)
+}
+
+// OnLogEntry : Apply entry replicated by current master. Entry must be issued and signed by master of its term.
+func (nm *ClusterManager) OnLogEntry(msg *protocol.LogEntry, frame protocol.OVTPacket) {
+	if msg.NetName != NetNameKey(nm.Info.Name) {
+		return
+	}
+
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+
+	// Only current master replicates entries.
+	if nm.Info.Master == nil || nm.Info.Master == nm.Info.Self || !frame.IsExtended() || frame.Sender() != nm.Info.Master.ID {
+		return
+	}
+	// Replayed entries must not rewrite uncommitted ones. Sealed packets are checked when opened.
+	if !frame.IsSecure() && !nm.Replay.Accept(frame.Sender(), frame.Epoch(), frame.Sequence()) {
+		return
+	}
+	if msg.Term > nm.Info.Term || msg.Master != msg.Issuer {
+		nm.drop_log_entry(msg, "not issued by master of its term")
+		return
+	}
+
+	// Entries of terms whose master is not seen here are trusted only if current master relays them authenticated.
+	if expected, known := nm.master_of(msg.Term); known {
+		if msg.Issuer != expected {
+			nm.drop_log_entry(msg, "not issued by master of its term")
+			return
+		}
+	} else if !frame.IsSecure() && !nm.Config.Insecure {
+		nm.drop_log_entry(msg, "master of its term unknown")
+		return
+	}
+
+	issuer, ok := nm.Info.ByID[msg.Issuer]
+	if !ok {
+		nm.drop_log_entry(msg, "issued by unknown node")
+		return
+	}
+	if !nm.verify_node(issuer, protocol.MessageContext(protocol.LOG_ENTRY), msg) {
+		return
+	}
+	nm.record_master(msg.Term, issuer.ID)
+
+	if msg.Index > nm.Info.Synced+1 {
+		nm.fetch_log(nm.Info.Master, nm.Info.Synced+1, msg.Index+1)
+		return
+	}
+	if msg.Index <= nm.Info.Commit {
+		return
+	}
+
+	if term, ok := nm.log_entry_term(msg.Index); !ok || term != msg.Term {
+		if ok {
+			log.WithFields(log.Fields{
+				"module": "ClusterManager",
+				"event":  "membership",
+			}).Warningf("Log entry %v diverged from master. (local term: %v, master term: %v)", msg.Index, term, msg.Term)
+		}
+		entry, err := LogEntryFromMessage(msg)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"module":     "ClusterManager",
+				"event":      "membership",
+				"err_detail": err.Error(),
+			}).Error("Drop invalid log entry.")
+			return
+		}
+		if nm.append_log_entry(entry) != nil {
+			return
+		}
+	}
+
+	if msg.Index > nm.Info.Synced {
+		nm.Info.Synced = msg.Index
+		ack := protocol.NewLogAck(nm.Info.Name, nm.Info.Self.ID, nm.Info.Term, nm.Info.Synced)
+		nm.SendMessage(nm.Info.Master, protocol.LOG_ACK, ack)
+	}
+	nm.follow_commit()
+}
+
+// follow_commit : Commit entries committed by master, as far as log matches master.
+func (nm *ClusterManager) follow_commit() {
+	commit := nm.Info.MasterCommit
+	if commit > nm.Info.Synced {
+		commit = nm.Info.Synced
+	}
+	nm.commit_to(commit)
+}
+
+// sync_log : Catch up log of master on its heartbeat.
+func (nm *ClusterManager) sync_log(master *NetworkNode, hb *protocol.Heartbeat) {
+	nm.Info.MasterCommit = hb.Commit
+	if hb.Index > nm.Info.Synced {
+		nm.fetch_log(master, nm.Info.Synced+1, hb.Index+1)
+	} else if hb.Index == nm.Info.Synced && nm.Info.Index > hb.Index {
+		// Entries master does not have are never committed.
+		nm.truncate_log(hb.Index)
+	}
+	nm.follow_commit()
+}
+
+// OnLogAck : Follower has entries of master up to index. Master only.
+func (nm *ClusterManager) OnLogAck(ack *protocol.LogAck, frame protocol.OVTPacket) {
+	if ack.NetName != NetNameKey(nm.Info.Name) {
+		return
+	}
+
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+
+	if nm.Info.Role != ROLE_MASTER || ack.Term != nm.Info.Term {
+		return
+	}
+	node, ok := nm.Info.ByID[ack.Node]
+	if !ok || node == nm.Info.Self || !nm.verify_frame(node.ID, node.Identity, frame, ack) {
+		return
+	}
+	if ack.Index > nm.Info.Index || ack.Index <= nm.Info.Match[node.ID] {
+		return
+	}
+	nm.Info.Match[node.ID] = ack.Index
+	nm.advance_commit()
+}
+
+func (nm *ClusterManager) OnLogFetch(msg *protocol.LogFetch) {
+	if msg.NetName != NetNameKey(nm.Info.Name) {
+		return
+	}
+
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+
+	if nm.Info.Role != ROLE_MASTER {
+		return
+	}
+	last := nm.Info.Index
+	node, ok := nm.Info.ByID[msg.Node]
+	if !ok {
+		// Removed node is served entries up to its removal only.
+		removed := nm.recently_removed(msg.Node)
+		if removed == nil {
+			return
+		}
+		node, last = removed.Node, removed.Index
+	}
+	if node == nm.Info.Self {
+		return
+	}
+
+	if msg.Begin <= nm.Config.Compacted {
+		log.WithFields(log.Fields{
+			"module":  "ClusterManager",
+			"event":   "membership",
+			"node_id": msg.Node.String(),
+		}).Warningf("Node %v lags behind compacted log at %v. It should leave and join again.", node.Name, nm.Config.Compacted)
+		return
+	}
+
+	end := msg.End
+	if end > last+1 {
+		end = last + 1
+	}
+	if end > msg.Begin && end-msg.Begin > LOG_FETCH_MAX {
+		end = msg.Begin + LOG_FETCH_MAX
+	}
+
+	entries, err := nm.ctl.DynamicConfig.GetPart(nm.Info.Name, msg.Begin, end)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"module":     "ClusterManager",
+			"event":      "membership",
+			"err_detail": err.Error(),
+			"node_id":    msg.Node.String(),
+		}).Warning("Cannot serve log fetch.")
+	}
+
+	for _, entry := range entries {
+		reply, err := LogEntryToMessage(nm.Info.Name, entry)
+		if err != nil {
+			continue
+		}
+		nm.SendMessage(node, protocol.LOG_ENTRY, reply)
+	}
+}
+
+func (nm *ClusterManager) drop_log_entry(msg *protocol.LogEntry, reason string) {
+	log.WithFields(log.Fields{
+		"module":  "ClusterManager",
+		"event":   "membership",
+		"node_id": msg.Issuer.String(),
+	}).Warningf("Drop log entry %v of term %v: %v", msg.Index, msg.Term, reason)
+}
+
+// master_of : Master won term, as seen by this node.
+func (nm *ClusterManager) master_of(term uint64) (uuid.UUID, bool) {
+	raw, ok := nm.Config.Masters[term]
+	if !ok {
+		return uuid.Nil, false
+	}
+	id, err := uuid.Parse(raw)
+	if err != nil {
+		return uuid.Nil, false
+	}
+	return id, true
+}
+
+// record_master : Remember master of term. First master seen for a term is kept.
+func (nm *ClusterManager) record_master(term uint64, id uuid.UUID) {
+	if _, known := nm.Config.Masters[term]; known {
+		return
+	}
+	nm.ctl.config_lock.Lock()
+	if nm.Config.Masters == nil {
+		nm.Config.Masters = make(map[uint64]string)
+	}
+	nm.Config.Masters[term] = id.String()
+	nm.ctl.config_lock.Unlock()
+	nm.ctl.PersistDynamicClusterConfig()
+}
+
+// propose_self : Propose change about this node. Master proposes it directly, followers pass it to master.
+func (nm *ClusterManager) propose_self(entry *LogEntryYAML) error {
+	entry.Node = nm.Info.Self.ID.String()
+	if nm.Info.Role == ROLE_MASTER {
+		if nm.pending(entry) {
+			return nil
+		}
+		return nm.propose(entry)
+	}
+	if nm.Info.Master == nil {
+		return errors.New(ERR_NO_MASTER)
+	}
+
+	entry.Term = nm.Info.Term
+	entry.Issuer = nm.Info.Self.ID.String()
+	msg, err := LogEntryToMessage(nm.Info.Name, entry)
+	if err != nil {
+		return err
+	}
+	return nm.SendMessage(nm.Info.Master, protocol.LOG_PROPOSE, &protocol.LogPropose{LogEntry: *msg})
+}
+
+// pending : Same change about the node is proposed and not committed yet.
+func (nm *ClusterManager) pending(entry *LogEntryYAML) bool {
+	for _, existing := range nm.Config.Log {
+		if existing.Index > nm.Info.Commit && existing.Op == entry.Op && existing.Node == entry.Node {
+			return true
+		}
+	}
+	return false
+}
+
+// publish_keys : Publish keys of this node while membership lacks them, so that peers can verify it and establish sessions.
+func (nm *ClusterManager) publish_keys(now time.Time) {
+	self_cfg, ok := nm.Config.Nodes[nm.Info.Self.ID.String()]
+	if !ok || (self_cfg.Key != "" && self_cfg.Identity != "") || now.Before(nm.publish_at) {
+		return
+	}
+	nm.publish_at = now.Add(time.Duration(nm.Info.HeartbeatTimeout) * time.Millisecond)
+
+	entry := &LogEntryYAML{
+		Op:       LOG_OP_NAMES[protocol.LOG_NODE_PUBLISH],
+		Publish:  self_cfg.Publish,
+		Prefixes: self_cfg.Prefixes,
+		Key:      EncodeKey(nm.ctl.Key.Public),
+		Identity: EncodeKey(IdentityKey(nm.Info.Self.Identity)),
+	}
+	if err := nm.propose_self(entry); err != nil {
+		log.WithFields(log.Fields{
+			"module":     "ClusterManager",
+			"event":      "membership",
+			"err_detail": err.Error(),
+		}).Warning("Cannot publish keys of this node.")
+	}
+}
+
+// OnLogPropose : Change proposed by member about itself. Master only.
+// Member without identity in membership proves the one it publishes, from one of its publish addresses.
+func (nm *ClusterManager) OnLogPropose(msg *protocol.LogPropose, in *Inbound) {
+	if msg.NetName != NetNameKey(nm.Info.Name) {
+		return
+	}
+
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+
+	if nm.Info.Role != ROLE_MASTER {
+		return
+	}
+	node, ok := nm.Info.ByID[msg.Issuer]
+	if !ok || node == nm.Info.Self || msg.Node != msg.Issuer {
+		return
+	}
+
+	drop := func(reason string) {
+		log.WithFields(log.Fields{
+			"module":  "ClusterManager",
+			"event":   "membership",
+			"node_id": node.ID.String(),
+		}).Warningf("Drop proposal from %v: %v", node.Name, reason)
+	}
+
+	identity := node.Identity
+	switch msg.Op {
+	case protocol.LOG_NODE_REMOVE:
+	case protocol.LOG_NODE_PUBLISH:
+		claimed := IdentityFromKey(msg.Identity)
+		if identity == nil && claimed != nil {
+			if in.Relayed || !nm.from_publish(node, in.From) {
+				drop("identity published from unknown address")
+				return
+			}
+			identity = claimed
+		} else if claimed != nil && !claimed.Equal(identity) {
+			drop("identity mismatch")
+			return
+		}
+	default:
+		drop("operation not allowed")
+		return
+	}
+	if !nm.verify_frame(node.ID, identity, in.Frame, msg) {
+		return
+	}
+
+	entry, err := LogEntryFromMessage(&msg.LogEntry)
+	if err != nil {
+		drop(err.Error())
+		return
+	}
+	if nm.pending(entry) {
+		return
+	}
+	if err = nm.propose(entry); err != nil {
+		drop(err.Error())
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"module":  "ClusterManager",
+		"event":   "membership",
+		"node_id": node.ID.String(),
+	}).Infof("Proposal %v from %v accepted. (index: %v)", entry.Op, node.Name, entry.Index)
+}
+
+// from_publish : Address is one of publish addresses of node.
+func (nm *ClusterManager) from_publish(node *NetworkNode, from net.Addr) bool {
+	ep := EndpointFromAddr(from)
+	if ep == nil {
+		return false
+	}
+	for _, published := range node.Publish {
+		if published.IP.Equal(ep.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,261 @@
+package ovtd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+	"net"
+)
+
+const (
+	NFT_TABLE         = "overturn_" // Suffixed by tag of network.
+	NFT_CAPTURE_CHAIN = "capture"
+	NFT_CAPTURE_SET   = "overturned"
+	NFT_CAPTURE_SET6  = "overturned6"
+)
+
+// NftablesCapture : Capture by mark rule in own inet table, matching destinations in native interval sets.
+type NftablesCapture struct {
+	Mark   uint32
+	Ignore []CapturePort
+
+	conn     *nftables.Conn
+	table    *nftables.Table
+	set      *nftables.Set
+	set6     *nftables.Set
+	prefixes []*net.IPNet
+}
+
+func NewNftablesCapture(tag string, mark uint32, ignore []CapturePort) (*NftablesCapture, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+	// Probe kernel support.
+	if _, err = conn.ListTablesOfFamily(nftables.TableFamilyINet); err != nil {
+		return nil, err
+	}
+
+	capture := &NftablesCapture{
+		Mark:   mark,
+		Ignore: ignore,
+		conn:   conn,
+		table:  &nftables.Table{Family: nftables.TableFamilyINet, Name: NFT_TABLE + tag},
+	}
+	capture.set = &nftables.Set{Table: capture.table, Name: NFT_CAPTURE_SET, KeyType: nftables.TypeIPAddr, Interval: true}
+	capture.set6 = &nftables.Set{Table: capture.table, Name: NFT_CAPTURE_SET6, KeyType: nftables.TypeIP6Addr, Interval: true}
+	return capture, nil
+}
+
+func (capture *NftablesCapture) Name() string {
+	return CAPTURE_NFTABLES
+}
+
+func (capture *NftablesCapture) IPv6() bool {
+	return true
+}
+
+func (capture *NftablesCapture) table_exists() (bool, error) {
+	tables, err := capture.conn.ListTablesOfFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return false, err
+	}
+	for _, table := range tables {
+		if table.Name == capture.table.Name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (capture *NftablesCapture) ClearRules() {
+	if exists, err := capture.table_exists(); err != nil || !exists {
+		return
+	}
+	capture.conn.DelTable(capture.table)
+	capture.conn.Flush()
+}
+
+// RefreshRules : Rebuild table in one transaction.
+func (capture *NftablesCapture) RefreshRules() error {
+	exists, err := capture.table_exists()
+	if err != nil {
+		return err
+	}
+	if exists {
+		capture.conn.DelTable(capture.table)
+	}
+	capture.conn.AddTable(capture.table)
+
+	elements, elements6 := interval_elements(capture.prefixes)
+	if err = capture.conn.AddSet(capture.set, elements); err != nil {
+		return err
+	}
+	if err = capture.conn.AddSet(capture.set6, elements6); err != nil {
+		return err
+	}
+
+	chain := capture.conn.AddChain(&nftables.Chain{
+		Name:     NFT_CAPTURE_CHAIN,
+		Table:    capture.table,
+		Type:     nftables.ChainTypeRoute,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityMangle,
+	})
+
+	// Never capture tunnel traffic itself.
+	for _, proto := range []byte{unix.IPPROTO_ICMP, unix.IPPROTO_ICMPV6} {
+		capture.conn.AddRule(&nftables.Rule{
+			Table: capture.table,
+			Chain: chain,
+			Exprs: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+				&expr.Verdict{Kind: expr.VerdictReturn},
+			},
+		})
+	}
+	for _, port := range capture.Ignore {
+		offset := uint32(0) // Source port
+		if port.Dst {
+			offset = 2
+		}
+		capture.conn.AddRule(&nftables.Rule{
+			Table: capture.table,
+			Chain: chain,
+			Exprs: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{port.Proto}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: offset, Len: 2},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(port.Port)},
+				&expr.Verdict{Kind: expr.VerdictReturn},
+			},
+		})
+	}
+
+	// Mark traffics to captured destinations.
+	for _, match := range []struct {
+		family byte
+		offset uint32
+		set    *nftables.Set
+	}{
+		{unix.NFPROTO_IPV4, 16, capture.set},
+		{unix.NFPROTO_IPV6, 24, capture.set6},
+	} {
+		capture.conn.AddRule(&nftables.Rule{
+			Table: capture.table,
+			Chain: chain,
+			Exprs: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{match.family}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: match.offset, Len: match.set.KeyType.Bytes},
+				&expr.Lookup{SourceRegister: 1, SetName: match.set.Name, SetID: match.set.ID},
+				&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(capture.Mark)},
+				&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+			},
+		})
+	}
+
+	return capture.conn.Flush()
+}
+
+func (capture *NftablesCapture) Verify() error {
+	exists, err := capture.table_exists()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New(ERR_CAPTURE_DRIFT)
+	}
+
+	chain, err := capture.conn.ListChain(capture.table, NFT_CAPTURE_CHAIN)
+	if err != nil {
+		return fmt.Errorf("%v (%v)", ERR_CAPTURE_DRIFT, err.Error())
+	}
+	rules, err := capture.conn.GetRules(capture.table, chain)
+	if err != nil {
+		return err
+	}
+	// ICMP, ignored ports and marks of two families.
+	if expect := 2 + len(capture.Ignore) + 2; len(rules) != expect {
+		return fmt.Errorf("%v (%v rules, expect %v)", ERR_CAPTURE_DRIFT, len(rules), expect)
+	}
+
+	elements, elements6 := interval_elements(capture.prefixes)
+	for _, expect := range []struct {
+		name     string
+		elements []nftables.SetElement
+	}{
+		{NFT_CAPTURE_SET, elements},
+		{NFT_CAPTURE_SET6, elements6},
+	} {
+		set, err := capture.conn.GetSetByName(capture.table, expect.name)
+		if err != nil {
+			return fmt.Errorf("%v (%v)", ERR_CAPTURE_DRIFT, err.Error())
+		}
+		got, err := capture.conn.GetSetElements(set)
+		if err != nil {
+			return err
+		}
+		// Kernel may represent intervals differently. Only flushed sets are detected.
+		if (len(got) == 0) != (len(expect.elements) == 0) {
+			return fmt.Errorf("%v (set %v flushed)", ERR_CAPTURE_DRIFT, expect.name)
+		}
+	}
+
+	return nil
+}
+
+func (capture *NftablesCapture) SyncSet(prefixes []*net.IPNet) error {
+	capture.prefixes = prefixes
+	if exists, err := capture.table_exists(); err != nil || !exists {
+		// Elements are added when rules are refreshed.
+		return err
+	}
+
+	elements, elements6 := interval_elements(prefixes)
+	capture.conn.FlushSet(capture.set)
+	capture.conn.FlushSet(capture.set6)
+	if err := capture.conn.SetAddElements(capture.set, elements); err != nil {
+		return err
+	}
+	if err := capture.conn.SetAddElements(capture.set6, elements6); err != nil {
+		return err
+	}
+	return capture.conn.Flush()
+}
+
+// interval_elements : Encode prefixes as [first, last + 1) intervals of IPv4 and IPv6 sets.
+func interval_elements(prefixes []*net.IPNet) ([]nftables.SetElement, []nftables.SetElement) {
+	var elements, elements6 []nftables.SetElement
+
+	for _, prefix := range merge_prefixes(prefixes) {
+		first := prefix.IP.Mask(prefix.Mask)
+		if len(first) != len(prefix.Mask) {
+			continue
+		}
+		end := make(net.IP, len(first))
+		carry := true
+		for idx := len(first) - 1; idx >= 0; idx-- {
+			end[idx] = first[idx] | ^prefix.Mask[idx]
+			if carry {
+				end[idx]++
+				carry = end[idx] == 0
+			}
+		}
+
+		interval := []nftables.SetElement{{Key: []byte(first)}}
+		if !carry { // Interval to end of address space is left open.
+			interval = append(interval, nftables.SetElement{Key: []byte(end), IntervalEnd: true})
+		}
+		if len(first) == net.IPv4len {
+			elements = append(elements, interval...)
+		} else {
+			elements6 = append(elements6, interval...)
+		}
+	}
+	return elements, elements6
+}
@@ -1,5 +1,9 @@
 package ovtd
 
+import (
+	"os"
+)
+
 func Main() {
 
 	opts := parse_args()
@@ -8,5 +12,9 @@ func Main() {
 	}
 
 	ctrl := NewController(opts)
-	ctrl.Run()
+	if err := ctrl.Run(); err != nil {
+		os.Exit(1)
+	}
+	// Wait for teardown to finish.
+	os.Exit(ctrl.Stop())
 }
@@ -0,0 +1,254 @@
+package ovtd
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"hash/fnv"
+	"overturn/protocol"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Multipath modes.
+const (
+	MULTIPATH_BEST   = "best"   // All traffics go over best path.
+	MULTIPATH_SPREAD = "spread" // Flows are spread over usable paths by flow hash.
+)
+
+const (
+	PATH_LOSS_MAX     = 0.5 // Paths losing more are not usable.
+	PATH_MISS_MAX     = 3   // Paths missing more probes in a row are not usable.
+	PATH_SWITCH_RATIO = 0.8 // Usable path takes over best path only if it is this much cheaper.
+)
+
+// UnderlayPath : Path to one publish endpoint of peer, measured by probes over primary transport.
+type UnderlayPath struct {
+	Endpoint *protocol.Endpoint
+	Stats    ProbeStats
+
+	window probeWindow
+}
+
+func (path *UnderlayPath) usable() bool {
+	return path.Stats.Replied > 0 && path.Stats.Loss < PATH_LOSS_MAX && path.Stats.Misses < PATH_MISS_MAX
+}
+
+// cost : Expected delay, considering jitter and that lost packets are retried.
+func (path *UnderlayPath) cost() float64 {
+	return float64(path.Stats.RTT+path.Stats.Jitter) / (1 - path.Stats.Loss)
+}
+
+// PathSet : Underlay paths to peer, one per publish endpoint.
+type PathSet struct {
+	lock  sync.RWMutex
+	paths []*UnderlayPath
+	best  int
+}
+
+// NewPathSet : Paths to publish endpoints. Measurements of endpoints in last set are kept.
+func NewPathSet(publish []*protocol.Endpoint, last *PathSet) *PathSet {
+	set := &PathSet{paths: make([]*UnderlayPath, 0, len(publish))}
+
+	var kept map[string]*UnderlayPath
+	var last_best string
+	if last != nil {
+		last.lock.RLock()
+		kept = make(map[string]*UnderlayPath, len(last.paths))
+		for idx, path := range last.paths {
+			kept[path.Endpoint.String()] = path
+			if idx == last.best {
+				last_best = path.Endpoint.String()
+			}
+		}
+		last.lock.RUnlock()
+	}
+
+	for idx, ep := range publish {
+		path := &UnderlayPath{Endpoint: ep}
+		if previous, ok := kept[ep.String()]; ok {
+			path.Stats = previous.Stats
+			path.window = previous.window
+		}
+		if ep.String() == last_best {
+			set.best = idx
+		}
+		set.paths = append(set.paths, path)
+	}
+	return set
+}
+
+// Best : Endpoint of best path. nil if no path.
+func (set *PathSet) Best() *protocol.Endpoint {
+	if set == nil {
+		return nil
+	}
+	set.lock.RLock()
+	defer set.lock.RUnlock()
+	if set.best >= len(set.paths) {
+		return nil
+	}
+	return set.paths[set.best].Endpoint
+}
+
+// Flow : Endpoint of path carrying flow of hash. Best path if no path is usable.
+func (set *PathSet) Flow(hash uint32) *protocol.Endpoint {
+	if set == nil {
+		return nil
+	}
+	set.lock.RLock()
+	usable := make([]*protocol.Endpoint, 0, len(set.paths))
+	for _, path := range set.paths {
+		if path.usable() {
+			usable = append(usable, path.Endpoint)
+		}
+	}
+	set.lock.RUnlock()
+
+	if len(usable) < 1 {
+		return set.Best()
+	}
+	return usable[hash%uint32(len(usable))]
+}
+
+// Endpoints : Endpoints of all paths, indexed as paths.
+func (set *PathSet) Endpoints() []*protocol.Endpoint {
+	set.lock.RLock()
+	defer set.lock.RUnlock()
+	endpoints := make([]*protocol.Endpoint, 0, len(set.paths))
+	for _, path := range set.paths {
+		endpoints = append(endpoints, path.Endpoint)
+	}
+	return endpoints
+}
+
+// Probes : Probe results of paths.
+func (set *PathSet) Probes() []PathProbes {
+	if set == nil {
+		return nil
+	}
+	set.lock.RLock()
+	defer set.lock.RUnlock()
+	probes := make([]PathProbes, 0, len(set.paths))
+	for idx, path := range set.paths {
+		probes = append(probes, PathProbes{Endpoint: path.Endpoint, Best: idx == set.best, Stats: path.Stats})
+	}
+	return probes
+}
+
+// Sent : Probe of ID is sent over path of index.
+func (set *PathSet) Sent(idx int, id uint32, now time.Time) {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	if idx < len(set.paths) {
+		path := set.paths[idx]
+		path.window.add(id, now)
+		path.Stats = path.window.stats()
+	}
+}
+
+// Reply : Probe of ID is replied after rtt. Return true if best path changes.
+func (set *PathSet) Reply(id uint32, rtt time.Duration) bool {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+
+	for _, path := range set.paths {
+		if path.window.reply(id, rtt) {
+			path.Stats = path.window.stats()
+			return set.reselect()
+		}
+	}
+	return false
+}
+
+// Expire : Count probes without reply in time as lost. Return true if best path changes.
+func (set *PathSet) Expire(now time.Time) bool {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+
+	for _, path := range set.paths {
+		path.window.expire(now)
+		path.Stats = path.window.stats()
+	}
+	return set.reselect()
+}
+
+// reselect : Fail over to usable path if best path is not, or switch to a much cheaper one.
+func (set *PathSet) reselect() bool {
+	if len(set.paths) < 1 {
+		return false
+	}
+
+	best := set.best
+	for idx, path := range set.paths {
+		if !path.usable() || idx == best {
+			continue
+		}
+		current := set.paths[best]
+		if !current.usable() || path.cost() < current.cost()*PATH_SWITCH_RATIO {
+			best = idx
+		}
+	}
+	if best == set.best {
+		return false
+	}
+	set.best = best
+	return true
+}
+
+// FlowHash : Hash of addresses, protocol and ports of IP packet. Packets of a flow share hash.
+func FlowHash(buf []byte) uint32 {
+	if len(buf) < 1 {
+		return 0
+	}
+	hash := fnv.New32a()
+
+	var proto byte
+	var l4 []byte
+	switch buf[0] >> 4 {
+	case ipv4.Version:
+		if len(buf) < ipv4.HeaderLen {
+			return 0
+		}
+		proto = buf[9]
+		hash.Write(buf[12:20])
+		if ihl := int(buf[0]&0x0f) * 4; ihl >= ipv4.HeaderLen && len(buf) >= ihl {
+			l4 = buf[ihl:]
+		}
+	case ipv6.Version:
+		if len(buf) < ipv6.HeaderLen {
+			return 0
+		}
+		proto = buf[6]
+		hash.Write(buf[8:40])
+		l4 = buf[ipv6.HeaderLen:]
+	default:
+		return 0
+	}
+
+	hash.Write([]byte{proto})
+	if (proto == syscall.IPPROTO_TCP || proto == syscall.IPPROTO_UDP) && len(l4) >= 4 {
+		// Source and destination ports.
+		hash.Write(l4[0:4])
+	}
+	return hash.Sum32()
+}
+
+// route_endpoint : Endpoint to send inner packet to node, by multipath mode.
+func (nm *ClusterManager) route_endpoint(node *NetworkNode, buf []byte) *protocol.Endpoint {
+	if nm.Config.Multipath == MULTIPATH_SPREAD {
+		return node.Paths.Flow(FlowHash(buf))
+	}
+	return node.Paths.Best()
+}
+
+func (nm *ClusterManager) on_path_switch(node *NetworkNode) {
+	if ep := node.Paths.Best(); ep != nil {
+		log.WithFields(log.Fields{
+			"module":  "ClusterManager",
+			"event":   "path",
+			"node_id": node.ID.String(),
+		}).Infof("Best path to %v is %v.", node.Name, ep.String())
+	}
+}
@@ -0,0 +1,245 @@
+package ovtd
+
+import (
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"net"
+	"overturn/protocol"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	PMTU_MIN            = 576 - 20 - 8 // OVT packet size fits in minimal IPv4 MTU.
+	PMTU_PRECISION      = 8
+	PMTU_PROBE_TIMEOUT  = time.Second
+	PMTU_PROBE_RETRY    = 2
+	PMTU_REPROBE_PERIOD = 10 * time.Minute
+)
+
+// pathSearch : Binary search of path MTU of a peer. Sizes in [lo, hi] are unknown except lo.
+type pathSearch struct {
+	lo       uint32
+	hi       uint32
+	size     uint32 // Size being probed. 0 if idle.
+	id       uint32
+	tries    int
+	deadline time.Time
+	next     time.Time
+}
+
+// path_mtu : Max OVT packet size to node over tunnel.
+func (nm *ClusterManager) path_mtu(tun NetTunnel, node *NetworkNode) uint32 {
+	mtu := tun.MTU()
+	if tun == nm.NetTun {
+		if path := atomic.LoadUint32(&node.PathMTU); path > 0 && path < mtu {
+			return path
+		}
+	}
+	return mtu
+}
+
+// min_path_mtu : Smallest path MTU among nodes, which decides link MTU.
+func (nm *ClusterManager) min_path_mtu() uint32 {
+	mtu := nm.NetTun.MTU()
+	if nm.Info == nil {
+		return mtu
+	}
+	for _, node := range nm.Info.ByID {
+		if path := atomic.LoadUint32(&node.PathMTU); path > 0 && path < mtu {
+			mtu = path
+		}
+	}
+	return mtu
+}
+
+// adjust_link_mtu : Follow smallest path MTU unless link MTU is configured.
+func (nm *ClusterManager) adjust_link_mtu() {
+	if nm.Config.MTU > 0 || nm.LinkTun == nil {
+		return
+	}
+	mtu := nm.link_mtu()
+	if mtu == nm.LinkTun.Link.Attrs().MTU {
+		return
+	}
+	if err := nm.LinkTun.SetMTU(mtu); err != nil {
+		log.WithFields(log.Fields{
+			"module":     "ClusterManager",
+			"event":      "pmtu",
+			"err_detail": err.Error(),
+		}).Errorf("Cannot set MTU of %v to %v.", nm.LinkTun.Link.Name, mtu)
+		return
+	}
+	log.WithFields(log.Fields{
+		"module": "ClusterManager",
+		"event":  "pmtu",
+	}).Infof("Set MTU of %v to %v.", nm.LinkTun.Link.Name, mtu)
+}
+
+func (nm *ClusterManager) set_path_mtu(node *NetworkNode, mtu uint32) {
+	if atomic.SwapUint32(&node.PathMTU, mtu) == mtu {
+		return
+	}
+	log.WithFields(log.Fields{
+		"module":  "ClusterManager",
+		"event":   "pmtu",
+		"node_id": node.ID.String(),
+	}).Infof("Path MTU to %v is %v.", node.Name, mtu)
+	nm.adjust_link_mtu()
+}
+
+// lower_path_mtu : Path is known to carry mtu bytes at least and hi bytes at most. Search again in between.
+func (nm *ClusterManager) lower_path_mtu(node *NetworkNode, mtu uint32, hi uint32) {
+	if mtu < PMTU_MIN {
+		mtu = PMTU_MIN
+	}
+	if hi < mtu {
+		hi = mtu
+	}
+	if current := nm.path_mtu(nm.NetTun, node); current <= hi {
+		return
+	}
+	nm.set_path_mtu(node, mtu)
+	nm.probes[node.ID] = &pathSearch{lo: mtu, hi: hi, next: time.Now()}
+}
+
+// OnPathMTU : Underlay reports path MTU to address.
+func (nm *ClusterManager) OnPathMTU(ip net.IP, mtu uint32) {
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+
+	for _, node := range nm.Info.ByID {
+		for _, ep := range node.Publish {
+			if ep.IP.Equal(ip) {
+				nm.lower_path_mtu(node, mtu, mtu)
+				break
+			}
+		}
+	}
+}
+
+// on_message_size : Packet of size to node is rejected by local stack as too large.
+func (nm *ClusterManager) on_message_size(node *NetworkNode, size uint32) {
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+	nm.lower_path_mtu(node, PMTU_MIN, size-1)
+}
+
+func is_message_size(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE)
+}
+
+// maintain_path_mtu : Drive path MTU searches. Called with lock held.
+func (nm *ClusterManager) maintain_path_mtu(now time.Time) {
+	for id := range nm.probes {
+		if _, ok := nm.Info.ByID[id]; !ok {
+			delete(nm.probes, id)
+		}
+	}
+
+	for id, node := range nm.Info.ByID {
+		if id == nm.Info.Self.ID || len(node.Publish) < 1 || node.LoadState() == NODE_DOWN {
+			continue
+		}
+		if nm.route_tunnel(node) != nm.NetTun || nm.relay_hop(node) != nil {
+			continue
+		}
+
+		search, ok := nm.probes[id]
+		if !ok {
+			search = &pathSearch{lo: PMTU_MIN, hi: nm.NetTun.MTU(), next: now}
+			nm.probes[id] = search
+		}
+		if search.size == 0 {
+			if now.After(search.next) {
+				nm.step_path_search(node, search, now)
+			}
+			continue
+		}
+		if now.After(search.deadline) {
+			if search.tries++; search.tries >= PMTU_PROBE_RETRY {
+				search.hi = search.size - 1
+				search.size = 0
+			}
+			nm.step_path_search(node, search, now)
+		}
+	}
+}
+
+// step_path_search : Probe next size, or settle path MTU if search converges.
+func (nm *ClusterManager) step_path_search(node *NetworkNode, search *pathSearch, now time.Time) {
+	session := nm.Sessions.Get(node.ID)
+	if session == nil && !nm.Config.Insecure {
+		return
+	}
+	overhead := uint32(protocol.EXTENDED_HEADER_SIZE)
+	if session != nil {
+		overhead = protocol.SECURE_OVERHEAD
+	}
+
+	for {
+		if search.size == 0 {
+			if search.hi < search.lo+PMTU_PRECISION {
+				nm.set_path_mtu(node, search.lo)
+				*search = pathSearch{lo: PMTU_MIN, hi: nm.NetTun.MTU(), next: now.Add(PMTU_REPROBE_PERIOD)}
+				return
+			}
+			nm.probe_id++
+			search.id = nm.probe_id
+			search.size = (search.lo + search.hi + 1) / 2
+			search.tries = 0
+		}
+
+		probe := &protocol.PathProbe{
+			Node:    nm.Info.Self.ID,
+			ID:      search.id,
+			Length:  uint16(search.size),
+			Padding: uint16(search.size - overhead - protocol.PATH_PROBE_FIXED_SIZE),
+		}
+		search.deadline = now.Add(PMTU_PROBE_TIMEOUT)
+		err := nm.send_message(nm.NetTun, nm.NetTun.PeerAddr(node.Paths.Best()), node.ID, session, protocol.PATH_PROBE, probe)
+		if err == nil || !is_message_size(err) {
+			return
+		}
+		// Larger than local stack allows.
+		search.hi = search.size - 1
+		search.size = 0
+	}
+}
+
+func (nm *ClusterManager) OnPathProbe(probe *protocol.PathProbe, frame protocol.OVTPacket) {
+	if !frame.IsExtended() || frame.Sender() != probe.Node {
+		return
+	}
+	if !frame.IsSecure() && !nm.Config.Insecure {
+		return
+	}
+
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+
+	node, ok := nm.Info.ByID[probe.Node]
+	if !ok || node == nm.Info.Self {
+		return
+	}
+
+	if !probe.Reply {
+		reply := &protocol.PathProbe{
+			Node:   nm.Info.Self.ID,
+			ID:     probe.ID,
+			Length: probe.Length,
+			Reply:  true,
+		}
+		nm.SendMessage(node, protocol.PATH_PROBE, reply)
+		return
+	}
+
+	search, ok := nm.probes[node.ID]
+	if !ok || search.size == 0 || search.id != probe.ID || search.size != uint32(probe.Length) {
+		return
+	}
+	search.lo = search.size
+	search.size = 0
+	nm.step_path_search(node, search, time.Now())
+}
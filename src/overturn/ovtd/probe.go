@@ -0,0 +1,221 @@
+package ovtd
+
+import (
+	"overturn/protocol"
+	"sort"
+	"time"
+)
+
+const (
+	PROBE_WINDOW  = 32 // Latest probes measured per path.
+	PROBE_TIMEOUT = 2 * time.Second
+)
+
+// Probe states.
+const (
+	PROBE_PENDING = iota
+	PROBE_REPLIED
+	PROBE_LOST
+)
+
+// ProbeStats : Measurement of path over probes in window.
+type ProbeStats struct {
+	Sent    int
+	Replied int
+	Lost    int
+	Misses  int           // Probes lost in a row by now.
+	RTT     time.Duration // Mean of replied probes. 0 if none.
+	MinRTT  time.Duration
+	Jitter  time.Duration // Mean RTT difference between consecutive replies.
+	Loss    float64       // Ratio of lost probes in settled ones.
+}
+
+type probeSample struct {
+	id    uint32
+	sent  time.Time
+	rtt   time.Duration
+	state uint8
+}
+
+// probeWindow : Ring of latest probes sent over a path.
+type probeWindow struct {
+	samples [PROBE_WINDOW]probeSample
+	next    int
+	count   int
+}
+
+func (w *probeWindow) add(id uint32, now time.Time) {
+	w.samples[w.next] = probeSample{id: id, sent: now, state: PROBE_PENDING}
+	w.next = (w.next + 1) % PROBE_WINDOW
+	if w.count < PROBE_WINDOW {
+		w.count++
+	}
+}
+
+// each : Visit probes from oldest to latest.
+func (w *probeWindow) each(visit func(sample *probeSample)) {
+	start := (w.next - w.count + PROBE_WINDOW) % PROBE_WINDOW
+	for idx := 0; idx < w.count; idx++ {
+		visit(&w.samples[(start+idx)%PROBE_WINDOW])
+	}
+}
+
+// reply : Settle pending probe of ID. False if no such probe in window.
+func (w *probeWindow) reply(id uint32, rtt time.Duration) bool {
+	found := false
+	w.each(func(sample *probeSample) {
+		if sample.id == id && sample.state == PROBE_PENDING {
+			sample.rtt = rtt
+			sample.state = PROBE_REPLIED
+			found = true
+		}
+	})
+	return found
+}
+
+// expire : Settle probes without reply in time as lost.
+func (w *probeWindow) expire(now time.Time) {
+	w.each(func(sample *probeSample) {
+		if sample.state == PROBE_PENDING && now.Sub(sample.sent) > PROBE_TIMEOUT {
+			sample.state = PROBE_LOST
+		}
+	})
+}
+
+func (w *probeWindow) stats() ProbeStats {
+	var stats ProbeStats
+	var total, jitter, last time.Duration
+	jitters := 0
+
+	w.each(func(sample *probeSample) {
+		stats.Sent++
+		switch sample.state {
+		case PROBE_REPLIED:
+			if stats.Replied > 0 {
+				diff := sample.rtt - last
+				if diff < 0 {
+					diff = -diff
+				}
+				jitter += diff
+				jitters++
+			}
+			if stats.Replied == 0 || sample.rtt < stats.MinRTT {
+				stats.MinRTT = sample.rtt
+			}
+			stats.Replied++
+			stats.Misses = 0
+			total += sample.rtt
+			last = sample.rtt
+
+		case PROBE_LOST:
+			stats.Lost++
+			stats.Misses++
+		}
+	})
+
+	if stats.Replied > 0 {
+		stats.RTT = total / time.Duration(stats.Replied)
+	}
+	if jitters > 0 {
+		stats.Jitter = jitter / time.Duration(jitters)
+	}
+	if settled := stats.Replied + stats.Lost; settled > 0 {
+		stats.Loss = float64(stats.Lost) / float64(settled)
+	}
+	return stats
+}
+
+// PathProbes : Probe results of path to endpoint.
+type PathProbes struct {
+	Endpoint *protocol.Endpoint
+	Best     bool
+	Stats    ProbeStats
+}
+
+// PeerProbes : Probe results of all paths to peer.
+type PeerProbes struct {
+	Node  *NetworkNode
+	Paths []PathProbes
+}
+
+// Probes : Probe results of peers, ordered by name.
+func (nm *ClusterManager) Probes() []PeerProbes {
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+
+	peers := make([]PeerProbes, 0, len(nm.Info.ByID))
+	for id, node := range nm.Info.ByID {
+		if id == nm.Info.Self.ID || node.Paths == nil {
+			continue
+		}
+		peers = append(peers, PeerProbes{Node: node, Paths: node.Paths.Probes()})
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Node.Name < peers[j].Node.Name
+	})
+	return peers
+}
+
+// maintain_probes : Settle lost probes and send new ones over every path. Called with lock held.
+func (nm *ClusterManager) maintain_probes(now time.Time) {
+	for id, node := range nm.Info.ByID {
+		if id == nm.Info.Self.ID || node.Paths == nil {
+			continue
+		}
+		if node.Paths.Expire(now) {
+			nm.on_path_switch(node)
+		}
+
+		session := nm.Sessions.Get(id)
+		if session == nil && !nm.Config.Insecure {
+			continue
+		}
+		for idx, ep := range node.Paths.Endpoints() {
+			nm.probe_id++
+			echo := &protocol.PathEcho{
+				Node:      nm.Info.Self.ID,
+				ID:        nm.probe_id,
+				Timestamp: now.UnixNano(),
+			}
+			node.Paths.Sent(idx, echo.ID, now)
+			nm.send_message(nm.NetTun, nm.NetTun.PeerAddr(ep), id, session, protocol.PATH_ECHO, echo)
+		}
+	}
+}
+
+func (nm *ClusterManager) OnPathEcho(echo *protocol.PathEcho, in *Inbound) {
+	// Probe measures the path it comes over.
+	if in.Relayed || !in.Frame.IsExtended() || in.Frame.Sender() != echo.Node {
+		return
+	}
+	if !in.Frame.IsSecure() && !nm.Config.Insecure {
+		return
+	}
+
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+
+	node, ok := nm.Info.ByID[echo.Node]
+	if !ok || node == nm.Info.Self {
+		return
+	}
+
+	if !echo.Reply {
+		reply := &protocol.PathEcho{
+			Node:      nm.Info.Self.ID,
+			ID:        echo.ID,
+			Reply:     true,
+			Timestamp: echo.Timestamp,
+		}
+		nm.send_message(in.Via, in.From, node.ID, nm.Sessions.Get(node.ID), protocol.PATH_ECHO, reply)
+		return
+	}
+
+	rtt := time.Since(time.Unix(0, echo.Timestamp))
+	if rtt < 0 || rtt > PROBE_TIMEOUT {
+		return
+	}
+	if node.Paths.Reply(echo.ID, rtt) {
+		nm.on_path_switch(node)
+	}
+}
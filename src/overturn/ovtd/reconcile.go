@@ -0,0 +1,261 @@
+package ovtd
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	ERR_CAPTURE_DRIFT = "Capture rules drifted."
+
+	// Owner tag of links, in alias of link.
+	OWNER_TAG = "overturn"
+
+	RECONCILE_PERIOD = 30 * time.Second
+
+	// Capture names used before networks were tagged.
+	LEGACY_CAPTURE_CHAIN  = "OVERTURN_CAPTURE"
+	LEGACY_CAPTURE_IPSET  = "overturned"
+	LEGACY_CAPTURE_IPSET6 = "overturned6"
+	LEGACY_NFT_TABLE      = "overturn"
+)
+
+// owner_alias : Tag link with owner process and network.
+func owner_alias(network string) string {
+	return fmt.Sprintf("%v pid=%v net=%v", OWNER_TAG, os.Getpid(), network)
+}
+
+// parse_owner_alias : Owner process and network of tagged link.
+func parse_owner_alias(alias string) (int, string, bool) {
+	var pid int
+	var network string
+
+	if !strings.HasPrefix(alias, OWNER_TAG+" ") {
+		return 0, "", false
+	}
+	if _, err := fmt.Sscanf(alias, OWNER_TAG+" pid=%d net=%s", &pid, &network); err != nil {
+		return 0, "", false
+	}
+	return pid, network, true
+}
+
+func process_alive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// ReconcileLinks : Remove links left by dead daemons. Links without owner tag are never touched.
+func ReconcileLinks() error {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+
+	for _, link := range links {
+		attrs := link.Attrs()
+		if !strings.HasPrefix(attrs.Name, IF_NAME_PREFIX) {
+			continue
+		}
+		pid, network, ok := parse_owner_alias(attrs.Alias)
+		if !ok || pid == os.Getpid() || process_alive(pid) {
+			continue
+		}
+
+		if err = netlink.LinkDel(link); err != nil {
+			log.WithFields(log.Fields{
+				"module":     "Reconciler",
+				"event":      "link",
+				"err_detail": err.Error(),
+			}).Warningf("Cannot remove stale link %v of network %v.", attrs.Name, network)
+			continue
+		}
+		log.WithFields(log.Fields{
+			"module": "Reconciler",
+			"event":  "link",
+		}).Infof("Stale link %v of network %v (pid: %v) removed.", attrs.Name, network, pid)
+	}
+
+	return nil
+}
+
+// ReconcileCapture : Remove capture chains, sets and tables of networks not to be attached, and those of
+// untagged versions. Marks are offset by slot, so stale rules would steer traffics into network reusing the slot.
+func ReconcileCapture(attached []string) {
+	keep := make(map[string]bool, len(attached))
+	for _, name := range attached {
+		keep[NetTag(name)] = true
+	}
+
+	stale_ipt := make(map[string]bool)
+	for _, tag := range iptables_capture_tags() {
+		if !keep[tag] {
+			stale_ipt[tag] = true
+		}
+	}
+	for tag := range stale_ipt {
+		if capture, err := NewIptablesCapture(tag, 0, nil); err == nil {
+			capture.ClearRules()
+			log_stale_capture(CAPTURE_IPTABLES, CAPTURE_MARK_CHAIN+tag)
+		}
+	}
+	if capture, err := NewIptablesCapture("", 0, nil); err == nil && legacy_iptables_capture() {
+		capture.Chain = LEGACY_CAPTURE_CHAIN
+		capture.SetName = LEGACY_CAPTURE_IPSET
+		capture.SetName6 = LEGACY_CAPTURE_IPSET6
+		capture.ClearRules()
+		log_stale_capture(CAPTURE_IPTABLES, LEGACY_CAPTURE_CHAIN)
+	}
+
+	for _, tag := range nftables_capture_tags() {
+		if keep[tag] {
+			continue
+		}
+		if capture, err := NewNftablesCapture(tag, 0, nil); err == nil {
+			if tag == "" {
+				capture.table.Name = LEGACY_NFT_TABLE
+			}
+			capture.ClearRules()
+			log_stale_capture(CAPTURE_NFTABLES, capture.table.Name)
+		}
+	}
+}
+
+func log_stale_capture(backend string, name string) {
+	log.WithFields(log.Fields{
+		"module": "Reconciler",
+		"event":  "capture",
+	}).Infof("Stale %v capture %v removed.", backend, name)
+}
+
+// iptables_capture_tags : Tags of capture chains and ipsets in place.
+func iptables_capture_tags() []string {
+	tags := make([]string, 0)
+	for _, proto := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			continue
+		}
+		chains, err := ipt.ListChains("mangle")
+		if err != nil {
+			continue
+		}
+		for _, chain := range chains {
+			if strings.HasPrefix(chain, CAPTURE_MARK_CHAIN) {
+				tags = append(tags, strings.TrimPrefix(chain, CAPTURE_MARK_CHAIN))
+			}
+		}
+	}
+	for _, set := range ipset_names() {
+		for _, prefix := range []string{CAPTURE_IPSET, CAPTURE_IPSET6} {
+			if strings.HasPrefix(set, prefix) {
+				tags = append(tags, strings.TrimPrefix(set, prefix))
+			}
+		}
+	}
+	return tags
+}
+
+// legacy_iptables_capture : Untagged capture chain or ipsets in place.
+func legacy_iptables_capture() bool {
+	for _, proto := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		if ipt, err := iptables.NewWithProtocol(proto); err == nil {
+			if exists, err := ipt.ChainExists("mangle", LEGACY_CAPTURE_CHAIN); err == nil && exists {
+				return true
+			}
+		}
+	}
+	for _, set := range ipset_names() {
+		if set == LEGACY_CAPTURE_IPSET || set == LEGACY_CAPTURE_IPSET6 {
+			return true
+		}
+	}
+	return false
+}
+
+// ipset_names : Names of all ipsets. Empty if ipset is unavailable.
+func ipset_names() []string {
+	out, err := exec.Command("ipset", "list", "-n").Output()
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(out))
+}
+
+// nftables_capture_tags : Tags of capture tables in place. Untagged table has empty tag.
+func nftables_capture_tags() []string {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil
+	}
+	tables, err := conn.ListTablesOfFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return nil
+	}
+	tags := make([]string, 0)
+	for _, table := range tables {
+		if table.Name == LEGACY_NFT_TABLE {
+			tags = append(tags, "")
+		} else if strings.HasPrefix(table.Name, NFT_TABLE) {
+			tags = append(tags, strings.TrimPrefix(table.Name, NFT_TABLE))
+		}
+	}
+	return tags
+}
+
+// clear_stale_capture : Remove rules left by capture backends other than active one.
+// Rules of active backend are adopted and rebuilt when refreshed.
+func clear_stale_capture(active CaptureBackend, tag string, mark uint32) {
+	for _, name := range []string{CAPTURE_IPTABLES, CAPTURE_NFTABLES} {
+		if name == active.Name() {
+			continue
+		}
+		if stale, err := NewCaptureBackend(name, tag, mark, nil); err == nil {
+			stale.ClearRules()
+		}
+	}
+}
+
+// maintain_capture : Repair capture rules, sets and kernel routes drifted by others, e.g. flushed by admin.
+func (nm *ClusterManager) maintain_capture(now time.Time) {
+	if now.Before(nm.reconcile_at) {
+		return
+	}
+	nm.reconcile_at = now.Add(RECONCILE_PERIOD)
+
+	fallback := func(err error, desp string) {
+		log.WithFields(log.Fields{
+			"module":     "Reconciler",
+			"event":      "capture",
+			"err_detail": err.Error(),
+		}).Error(desp)
+	}
+
+	if err := nm.Capture.Verify(); err != nil {
+		log.WithFields(log.Fields{
+			"module":     "Reconciler",
+			"event":      "capture",
+			"err_detail": err.Error(),
+		}).Warningf("Repair %v capture rules.", nm.Capture.Name())
+
+		if err = nm.Capture.RefreshRules(); err != nil {
+			fallback(err, "Cannot repair capture rules.")
+			return
+		}
+		if err = nm.RefreshCaptureSet(); err != nil {
+			fallback(err, "Cannot repair captured set.")
+			return
+		}
+	}
+
+	if err := nm.RefreshKernelRoute(); err != nil {
+		fallback(err, "Cannot repair kernel routes.")
+	}
+}
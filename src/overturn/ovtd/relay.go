@@ -0,0 +1,235 @@
+package ovtd
+
+import (
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/google/uuid"
+	"overturn/protocol"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Max links on relay path, including the last one to destination.
+	RELAY_MAX_HOPS = 4
+
+	ERR_RELAY_NO_SESSION = "No session to relay node."
+	ERR_RELAY_NO_ROUTE   = "No route to relay node."
+)
+
+// is_direct : Node is heard from without relay recently.
+func (nm *ClusterManager) is_direct(node *NetworkNode, now time.Time) bool {
+	timeout := time.Duration(nm.Info.HeartbeatTimeout) * time.Millisecond
+	return now.Sub(node.LastDirect) <= timeout
+}
+
+// direct_reach : Nodes heard from directly, reported in heartbeats.
+func (nm *ClusterManager) direct_reach(now time.Time) []uuid.UUID {
+	reach := make([]uuid.UUID, 0)
+	for id, node := range nm.Info.ByID {
+		if node == nm.Info.Self || !nm.is_direct(node, now) {
+			continue
+		}
+		if len(reach) >= protocol.HEARTBEAT_MAX_REACH {
+			break
+		}
+		reach = append(reach, id)
+	}
+	return reach
+}
+
+// update_relays : Compute next hops to nodes not reachable directly, by breadth first search over
+// direct neighbours and reachability reported by other nodes. Paths are limited to RELAY_MAX_HOPS links.
+func (nm *ClusterManager) update_relays(now time.Time) {
+	self := nm.Info.Self
+
+	// First hop of reached nodes. Direct neighbours are first hops of themselves.
+	first := make(map[uuid.UUID]*NetworkNode)
+	frontier := make([]*NetworkNode, 0)
+	for id, node := range nm.Info.ByID {
+		if node == self || !nm.is_direct(node, now) {
+			continue
+		}
+		first[id] = node
+		frontier = append(frontier, node)
+	}
+
+	relays := make(map[uuid.UUID]*NetworkNode)
+	for depth := 1; depth < RELAY_MAX_HOPS && len(frontier) > 0; depth++ {
+		next := make([]*NetworkNode, 0)
+		for _, via := range frontier {
+			// Reports of nodes considered down are stale.
+			if via.LoadState() == NODE_DOWN {
+				continue
+			}
+			for _, id := range via.Reach {
+				node, ok := nm.Info.ByID[id]
+				if !ok || node == self {
+					continue
+				}
+				if _, reached := first[id]; reached {
+					continue
+				}
+				first[id] = first[via.ID]
+				relays[id] = first[via.ID]
+				next = append(next, node)
+			}
+		}
+		frontier = next
+	}
+
+	nm.relay_lock.Lock()
+	last := nm.relays
+	nm.relays = relays
+	nm.relay_lock.Unlock()
+
+	for id, hop := range relays {
+		if last[id] == hop {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"module":  "ClusterManager",
+			"event":   "relay",
+			"node_id": id.String(),
+		}).Infof("Relay to %v via %v.", nm.Info.ByID[id].Name, hop.Name)
+	}
+	for id := range last {
+		if _, ok := relays[id]; ok {
+			continue
+		}
+		entry := log.WithFields(log.Fields{
+			"module":  "ClusterManager",
+			"event":   "relay",
+			"node_id": id.String(),
+		})
+		if node, ok := nm.Info.ByID[id]; ok && nm.is_direct(node, now) {
+			entry.Infof("Direct path to %v recovered.", node.Name)
+		} else {
+			entry.Warningf("No relay route to %v.", id.String())
+		}
+	}
+}
+
+// relay_hop : Next hop to node. nil if node is reached directly or no relay route is known.
+func (nm *ClusterManager) relay_hop(node *NetworkNode) *NetworkNode {
+	if node == nil {
+		return nil
+	}
+	nm.relay_lock.RLock()
+	defer nm.relay_lock.RUnlock()
+	return nm.relays[node.ID]
+}
+
+// relay_frame : Wrap OVT packet to destination in relay message, and send it to next hop.
+// Relay message is sealed by session of next hop.
+func (nm *ClusterManager) relay_frame(hop *NetworkNode, dest uuid.UUID, hops uint8, frame []byte) error {
+	ep := hop.Paths.Best()
+	if ep == nil {
+		return errors.New(ERR_RELAY_NO_ROUTE)
+	}
+	session := nm.Sessions.Get(hop.ID)
+	if session == nil && !nm.Config.Insecure {
+		nm.handshake(hop)
+		return errors.New(ERR_RELAY_NO_SESSION)
+	}
+
+	relay := &protocol.Relay{Dest: dest, Hops: hops, Packet: frame}
+	tun := nm.route_tunnel(hop)
+	return nm.send_message(tun, tun.PeerAddr(ep), hop.ID, session, protocol.RELAY, relay)
+}
+
+// relay_message : Send message to node via next hop. Message is sealed end-to-end if session is given.
+func (nm *ClusterManager) relay_message(hop *NetworkNode, node *NetworkNode, session *PeerSession, msg_type uint16, msg protocol.Message) error {
+	frame := make([]byte, uint(frame_overhead(session))+msg.Size())
+	if _, err := nm.place_message(frame, node.ID, session, msg_type, msg); err != nil {
+		return err
+	}
+	return nm.relay_frame(hop, node.ID, RELAY_MAX_HOPS, frame)
+}
+
+// relay_payload : Send inner packet to node via next hop, fragmented to fit path to next hop.
+func (nm *ClusterManager) relay_payload(hop *NetworkNode, node *NetworkNode, session *PeerSession, payload []byte) {
+	tun := nm.route_tunnel(hop)
+	hop_overhead := frame_overhead(nm.Sessions.Get(hop.ID)) + protocol.RELAY_HEADER_SIZE
+	limit := int(nm.path_mtu(tun, hop)) - hop_overhead - frame_overhead(session)
+
+	nm.fragment_payload(limit, payload, func(payload_type uint16, data []byte) bool {
+		frame := make([]byte, frame_overhead(session)+len(data))
+		nm.place_payload(frame, node.ID, session, payload_type, data)
+		return nm.relay_frame(hop, node.ID, RELAY_MAX_HOPS, frame) == nil
+	})
+}
+
+func (nm *ClusterManager) drop_relay(relay *protocol.Relay, reason string) {
+	atomic.AddUint64(&nm.RelayDropStat, 1)
+	log.WithFields(log.Fields{
+		"module":  "ClusterManager",
+		"event":   "relay",
+		"node_id": relay.Dest.String(),
+	}).Warningf("Drop relayed packet to %v: %v", relay.Dest.String(), reason)
+}
+
+// OnRelay : Deliver relayed packet destined for us, or forward it to next hop.
+func (nm *ClusterManager) OnRelay(relay *protocol.Relay, in *Inbound) {
+	if !in.Frame.IsExtended() {
+		return
+	}
+	// Only members relay.
+	from, ok := nm.Info.ByID[in.Frame.Sender()]
+	if !ok || from == nm.Info.Self {
+		nm.drop_relay(relay, "sender is not a member")
+		return
+	}
+
+	if relay.Dest == nm.Info.Self.ID {
+		nm.deliver_relayed(relay, in)
+		return
+	}
+
+	dest, ok := nm.Info.ByID[relay.Dest]
+	if !ok {
+		nm.drop_relay(relay, "unknown destination")
+		return
+	}
+	if relay.Hops <= 1 {
+		nm.drop_relay(relay, "hop limit exceeded")
+		return
+	}
+	hop := nm.relay_hop(dest)
+	if hop == nil {
+		hop = dest
+	}
+	if hop == from {
+		nm.drop_relay(relay, "loop detected")
+		return
+	}
+
+	if err := nm.relay_frame(hop, dest.ID, relay.Hops-1, relay.Packet); err != nil {
+		nm.drop_relay(relay, err.Error())
+		return
+	}
+	atomic.AddUint64(&nm.RelayStat, 1)
+}
+
+func (nm *ClusterManager) deliver_relayed(relay *protocol.Relay, in *Inbound) {
+	is_encap, pkt, err := protocol.OVTPacketUnpack(relay.Packet, 65536)
+	if !is_encap || pkt == nil {
+		if err != nil {
+			nm.drop_relay(relay, err.Error())
+		}
+		return
+	}
+	if !pkt.IsExtended() || pkt.Network() != nm.NetID || pkt.PayloadType() == protocol.RELAY {
+		nm.drop_relay(relay, "invalid inner packet")
+		return
+	}
+
+	if pkt.IsSecure() {
+		if pkt = nm.open_packet(pkt); pkt == nil {
+			return
+		}
+	} else if !nm.accept_plain(pkt) {
+		return
+	}
+	nm.dispatch(pkt, &Inbound{Via: in.Via, From: in.From, Frame: pkt, Relayed: true})
+}
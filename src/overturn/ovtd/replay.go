@@ -0,0 +1,135 @@
+package ovtd
+
+import (
+	"github.com/google/uuid"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	REPLAY_WINDOW_SIZE = 64
+)
+
+// ReplayWindow : Sliding window of received sequences.
+type ReplayWindow struct {
+	top    uint64
+	bitmap uint64
+}
+
+// Accept : Record sequence. False if sequence is replayed or too old.
+func (w *ReplayWindow) Accept(sequence uint64) bool {
+	if sequence == 0 {
+		return false
+	}
+	if sequence > w.top {
+		shift := sequence - w.top
+		if shift >= REPLAY_WINDOW_SIZE {
+			w.bitmap = 1
+		} else {
+			w.bitmap = w.bitmap<<shift | 1
+		}
+		w.top = sequence
+		return true
+	}
+
+	offset := w.top - sequence
+	if offset >= REPLAY_WINDOW_SIZE {
+		return false
+	}
+	mask := uint64(1) << offset
+	if w.bitmap&mask != 0 {
+		return false
+	}
+	w.bitmap |= mask
+	return true
+}
+
+type peerReplay struct {
+	epoch  uint32
+	window ReplayWindow
+}
+
+// ReplayGuard : Replay windows of peers. Only authenticated packets should be fed.
+type ReplayGuard struct {
+	ReplayDropStat uint64
+	EpochDropStat  uint64
+
+	lock  sync.Mutex
+	peers map[uuid.UUID]*peerReplay
+}
+
+func NewReplayGuard() *ReplayGuard {
+	return &ReplayGuard{
+		peers: make(map[uuid.UUID]*peerReplay),
+	}
+}
+
+// Accept : Check packet of sender is fresh. Newer epoch means peer restarted and resets its window.
+func (guard *ReplayGuard) Accept(sender uuid.UUID, epoch uint32, sequence uint64) bool {
+	guard.lock.Lock()
+	defer guard.lock.Unlock()
+
+	peer, ok := guard.peers[sender]
+	if !ok || epoch > peer.epoch {
+		peer = &peerReplay{epoch: epoch}
+		guard.peers[sender] = peer
+	} else if epoch < peer.epoch {
+		atomic.AddUint64(&guard.EpochDropStat, 1)
+		return false
+	}
+
+	if !peer.window.Accept(sequence) {
+		atomic.AddUint64(&guard.ReplayDropStat, 1)
+		return false
+	}
+	return true
+}
+
+// Forget : Drop windows of nodes no longer in membership.
+func (guard *ReplayGuard) Forget(keep map[uuid.UUID]*NetworkNode) {
+	guard.lock.Lock()
+	defer guard.lock.Unlock()
+	for id := range guard.peers {
+		if _, ok := keep[id]; !ok {
+			delete(guard.peers, id)
+		}
+	}
+}
+
+// SequenceTable : Outgoing sequences of peers.
+// Packets to unknown peer (join traffic) take sequence above all peers, and peers continue
+// above it, so a peer never sees sequence going backward when it becomes known.
+type SequenceTable struct {
+	lock  sync.Mutex
+	top   uint64
+	peers map[uuid.UUID]uint64
+}
+
+func NewSequenceTable() *SequenceTable {
+	return &SequenceTable{
+		peers: make(map[uuid.UUID]uint64),
+	}
+}
+
+func (table *SequenceTable) Next(peer uuid.UUID) uint64 {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	if peer == uuid.Nil {
+		for _, sequence := range table.peers {
+			if sequence > table.top {
+				table.top = sequence
+			}
+		}
+		table.top++
+		return table.top
+	}
+
+	sequence := table.peers[peer]
+	if sequence < table.top {
+		sequence = table.top
+	}
+	sequence++
+	table.peers[peer] = sequence
+	return sequence
+}
@@ -0,0 +1,63 @@
+package ovtd
+
+import (
+	"github.com/google/uuid"
+	"testing"
+)
+
+func TestReplayWindowAccept(t *testing.T) {
+	type step struct {
+		sequence uint64
+		accept   bool
+	}
+	cases := []struct {
+		name  string
+		steps []step
+	}{
+		{"zero", []step{{0, false}}},
+		{"in order", []step{{1, true}, {2, true}, {3, true}}},
+		{"duplicate", []step{{1, true}, {1, false}}},
+		{"duplicate top", []step{{5, true}, {3, true}, {5, false}, {3, false}}},
+		{"reorder in window", []step{{10, true}, {8, true}, {9, true}, {8, false}, {1, true}}},
+		{"oldest in window", []step{{64, true}, {1, true}, {1, false}}},
+		{"behind window", []step{{65, true}, {1, false}}},
+		{"shift 63 keeps old bit", []step{{1, true}, {64, true}, {1, false}, {2, true}}},
+		{"shift 64 drops old bits", []step{{1, true}, {65, true}, {1, false}, {2, true}, {2, false}}},
+		{"shift beyond window", []step{{1, true}, {2, true}, {200, true}, {2, false}, {137, true}, {136, false}}},
+	}
+
+	for _, c := range cases {
+		var w ReplayWindow
+		for i, s := range c.steps {
+			if got := w.Accept(s.sequence); got != s.accept {
+				t.Errorf("%v: step %v Accept(%v) = %v, want %v", c.name, i, s.sequence, got, s.accept)
+			}
+		}
+	}
+}
+
+func TestReplayGuardEpoch(t *testing.T) {
+	type step struct {
+		epoch    uint32
+		sequence uint64
+		accept   bool
+	}
+	cases := []struct {
+		name  string
+		steps []step
+	}{
+		{"same epoch replay", []step{{1, 1, true}, {1, 1, false}}},
+		{"newer epoch resets window", []step{{1, 5, true}, {2, 1, true}, {2, 5, true}}},
+		{"older epoch dropped", []step{{2, 1, true}, {1, 2, false}}},
+	}
+
+	for _, c := range cases {
+		guard := NewReplayGuard()
+		sender := uuid.New()
+		for i, s := range c.steps {
+			if got := guard.Accept(sender, s.epoch, s.sequence); got != s.accept {
+				t.Errorf("%v: step %v Accept(%v, %v) = %v, want %v", c.name, i, s.epoch, s.sequence, got, s.accept)
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package ovtd
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/google/uuid"
+	"net"
+	"overturn/protocol"
+	"sort"
+)
+
+// RouteTable : Longest prefix match from destination to node.
+// IPv4 prefixes are kept as IPv4-mapped IPv6 prefixes, so both families share one table.
+type RouteTable struct {
+	lengths []int // Prefix lengths in use, longest first.
+	routes  map[int]map[[16]byte]*NetworkNode
+}
+
+const (
+	IPV4_MAPPED_BITS = 96
+)
+
+func NewRouteTable() *RouteTable {
+	return &RouteTable{
+		routes: make(map[int]map[[16]byte]*NetworkNode),
+	}
+}
+
+func prefix_key(prefix *net.IPNet) ([16]byte, int, bool) {
+	ones, bits := prefix.Mask.Size()
+	switch {
+	case bits == 8*net.IPv4len && prefix.IP.To4() != nil:
+		ones += IPV4_MAPPED_BITS
+	case bits == 8*net.IPv6len && prefix.IP.To4() == nil:
+	default:
+		return [16]byte{}, 0, false
+	}
+	return ToIPKey(prefix.IP.To16().Mask(net.CIDRMask(ones, 8*net.IPv6len))), ones, true
+}
+
+// Get : Node owning exactly the prefix.
+func (table *RouteTable) Get(prefix *net.IPNet) *NetworkNode {
+	key, ones, ok := prefix_key(prefix)
+	if !ok {
+		return nil
+	}
+	return table.routes[ones][key]
+}
+
+// Insert : Route prefix to node. False if prefix is invalid or owned by another node.
+func (table *RouteTable) Insert(prefix *net.IPNet, node *NetworkNode) bool {
+	key, ones, ok := prefix_key(prefix)
+	if !ok {
+		return false
+	}
+	routes, ok := table.routes[ones]
+	if !ok {
+		routes = make(map[[16]byte]*NetworkNode)
+		table.routes[ones] = routes
+		table.lengths = append(table.lengths, ones)
+		sort.Sort(sort.Reverse(sort.IntSlice(table.lengths)))
+	}
+	if owner, exists := routes[key]; exists && owner != node {
+		return false
+	}
+	routes[key] = node
+	return true
+}
+
+func (table *RouteTable) Remove(prefix *net.IPNet) {
+	key, ones, ok := prefix_key(prefix)
+	if !ok {
+		return
+	}
+	delete(table.routes[ones], key)
+}
+
+// Lookup : Node of longest prefix containing ip.
+func (table *RouteTable) Lookup(ip net.IP) *NetworkNode {
+	ip = ip.To16()
+	if ip == nil {
+		return nil
+	}
+	is_ipv4 := ip.To4() != nil
+	for _, ones := range table.lengths {
+		if is_ipv4 && ones < IPV4_MAPPED_BITS {
+			// Shorter IPv6 prefixes never cover IPv4.
+			break
+		}
+		key := ToIPKey(ip.Mask(net.CIDRMask(ones, 8*net.IPv6len)))
+		if node, ok := table.routes[ones][key]; ok {
+			return node
+		}
+	}
+	return nil
+}
+
+// Each : Visit all routes.
+func (table *RouteTable) Each(visit func(prefix *net.IPNet, node *NetworkNode)) {
+	for _, ones := range table.lengths {
+		for key, node := range table.routes[ones] {
+			ip := net.IP(append([]byte(nil), key[:]...))
+			if ip4 := ip.To4(); ip4 != nil && ones >= IPV4_MAPPED_BITS {
+				visit(&net.IPNet{IP: ip4, Mask: net.CIDRMask(ones-IPV4_MAPPED_BITS, 8*net.IPv4len)}, node)
+			} else {
+				visit(&net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 8*net.IPv6len)}, node)
+			}
+		}
+	}
+}
+
+// build_routes : Route publish addresses and advertised prefixes of nodes.
+// Prefix advertised by several nodes is routed to none of them. Publish addresses always win over advertised prefixes.
+func build_routes(by_ip map[[16]byte]*NetworkNode, by_id map[uuid.UUID]*NetworkNode) *RouteTable {
+	table := NewRouteTable()
+	hosts := NewRouteTable()
+	for key_ip, node := range by_ip {
+		prefix, _ := protocol.ParsePrefix(net.IP(key_ip[:]).String())
+		table.Insert(prefix, node)
+		hosts.Insert(prefix, node)
+	}
+
+	conflicts := make([]*net.IPNet, 0)
+	for _, node := range by_id {
+		for _, prefix := range node.Prefixes {
+			if owner := hosts.Get(prefix); owner != nil {
+				if owner != node {
+					log.WithFields(log.Fields{
+						"module":  "ClusterManager",
+						"event":   "initialize",
+						"node_id": node.ID.String(),
+					}).Warningf("Prefix %v of %v ignored. It is publish address of %v.", prefix.String(), node.Name, owner.Name)
+				}
+				continue
+			}
+			if !table.Insert(prefix, node) {
+				conflicts = append(conflicts, prefix)
+			}
+		}
+	}
+
+	for _, prefix := range conflicts {
+		owner := table.Get(prefix)
+		if owner == nil {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"module":  "ClusterManager",
+			"event":   "initialize",
+			"node_id": owner.ID.String(),
+		}).Warningf("Prefix %v removed from %v due to conflict.", prefix.String(), owner.Name)
+		table.Remove(prefix)
+	}
+	return table
+}
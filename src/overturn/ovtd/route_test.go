@@ -0,0 +1,122 @@
+package ovtd
+
+import (
+	"github.com/google/uuid"
+	"net"
+	"overturn/protocol"
+	"testing"
+)
+
+func test_prefix(t *testing.T, raw string) *net.IPNet {
+	prefix, err := protocol.ParsePrefix(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prefix
+}
+
+func TestRouteTableLookup(t *testing.T) {
+	a := &NetworkNode{Name: "a", ID: uuid.New()}
+	b := &NetworkNode{Name: "b", ID: uuid.New()}
+	c := &NetworkNode{Name: "c", ID: uuid.New()}
+	d := &NetworkNode{Name: "d", ID: uuid.New()}
+
+	table := NewRouteTable()
+	routes := []struct {
+		prefix string
+		node   *NetworkNode
+		insert bool
+	}{
+		{"10.0.0.0/8", a, true},
+		{"10.1.0.0/16", b, true},
+		{"10.1.2.3", c, true},
+		{"10.1.0.0/16", c, false}, // Owned by b.
+		{"10.1.0.0/16", b, true},  // Same owner again.
+		{"::/0", d, true},
+		{"fd00::/8", a, true},
+		{"fd00:1::/32", b, true},
+		{"fd00:1::1", c, true},
+		{"::ffff:0:0/96", c, false}, // IPv4-mapped prefix in IPv6 form.
+	}
+	for _, r := range routes {
+		if got := table.Insert(test_prefix(t, r.prefix), r.node); got != r.insert {
+			t.Errorf("Insert(%v, %v) = %v, want %v", r.prefix, r.node.Name, got, r.insert)
+		}
+	}
+
+	cases := []struct {
+		ip   string
+		want *NetworkNode
+	}{
+		{"10.9.9.9", a},
+		{"10.1.9.9", b},
+		{"10.1.2.3", c},
+		{"10.1.2.4", b},
+		{"::ffff:10.1.2.3", c}, // IPv4-mapped form of IPv4 address.
+		{"192.168.0.1", nil},   // IPv6 default route never covers IPv4.
+		{"::a01:203", d},       // IPv4-compatible IPv6 address is IPv6.
+		{"fd00::1", a},
+		{"fd00:1::2", b},
+		{"fd00:1::1", c},
+		{"2001:db8::1", d},
+	}
+	for _, c := range cases {
+		if got := table.Lookup(net.ParseIP(c.ip)); got != c.want {
+			t.Errorf("Lookup(%v) = %v, want %v", c.ip, got, c.want)
+		}
+	}
+	if got := table.Lookup(nil); got != nil {
+		t.Errorf("Lookup(nil) = %v, want none", got)
+	}
+
+	table.Remove(test_prefix(t, "10.1.2.3"))
+	if got := table.Lookup(net.ParseIP("10.1.2.3")); got != b {
+		t.Errorf("Lookup after Remove = %v, want %v", got, b)
+	}
+
+	ipv4_default := NewRouteTable()
+	ipv4_default.Insert(test_prefix(t, "0.0.0.0/0"), a)
+	for ip, want := range map[string]*NetworkNode{"192.168.0.1": a, "2001:db8::1": nil} {
+		if got := ipv4_default.Lookup(net.ParseIP(ip)); got != want {
+			t.Errorf("Lookup(%v) with IPv4 default = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestBuildRoutes(t *testing.T) {
+	a := &NetworkNode{Name: "a", ID: uuid.New()}
+	b := &NetworkNode{Name: "b", ID: uuid.New()}
+	c := &NetworkNode{Name: "c", ID: uuid.New()}
+
+	by_ip := map[[16]byte]*NetworkNode{
+		ToIPKey(net.ParseIP("192.168.0.1")): a,
+		ToIPKey(net.ParseIP("fd00::1")):     a,
+		ToIPKey(net.ParseIP("192.168.0.2")): b,
+	}
+	a.Prefixes = []*net.IPNet{test_prefix(t, "10.1.0.0/16"), test_prefix(t, "192.168.0.1/32")}
+	b.Prefixes = []*net.IPNet{test_prefix(t, "10.2.0.0/16"), test_prefix(t, "192.168.0.1/32"), test_prefix(t, "fd00::1/128"), test_prefix(t, "10.3.0.0/16")}
+	c.Prefixes = []*net.IPNet{test_prefix(t, "10.3.0.0/16"), test_prefix(t, "10.0.0.0/8")}
+	by_id := map[uuid.UUID]*NetworkNode{a.ID: a, b.ID: b, c.ID: c}
+
+	table := build_routes(by_ip, by_id)
+	cases := []struct {
+		ip   string
+		want *NetworkNode
+	}{
+		{"192.168.0.1", a}, // Publish address wins over prefix of b.
+		{"fd00::1", a},
+		{"192.168.0.2", b},
+		{"10.1.0.1", a},
+		{"10.2.0.1", b},
+		{"10.3.0.1", c}, // Conflicting prefix is removed, shorter one of c covers it.
+		{"10.4.0.1", c},
+	}
+	for _, c := range cases {
+		if got := table.Lookup(net.ParseIP(c.ip)); got != c.want {
+			t.Errorf("Lookup(%v) = %v, want %v", c.ip, got, c.want)
+		}
+	}
+	if got := table.Get(test_prefix(t, "10.3.0.0/16")); got != nil {
+		t.Errorf("Conflicting prefix routed to %v", got.Name)
+	}
+}
@@ -5,21 +5,32 @@ import (
 	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"github.com/google/uuid"
 	"net"
 	"net/rpc"
 	"os"
 	ctlrpc "overturn/ovtd/rpc"
+	"overturn/protocol"
+	"sort"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type UserRPCServer struct {
 	Listener net.Listener
 	Server   *rpc.Server
 
+	ctl     *Controller
 	running uint32
+
+	// Active client connections.
+	conns     map[net.Conn]bool
+	conn_lock sync.Mutex
+	wait      sync.WaitGroup
 }
 
-func NewUserRPCServer(path string) (*UserRPCServer, error) {
+func NewUserRPCServer(path string, ctl *Controller) (*UserRPCServer, error) {
 	var err error
 	var domain, address string
 	var listener net.Listener
@@ -49,7 +60,9 @@ func NewUserRPCServer(path string) (*UserRPCServer, error) {
 	rpc_server := &UserRPCServer{
 		Listener: listener,
 		Server:   rpc.NewServer(),
+		ctl:      ctl,
 		running:  1,
+		conns:    make(map[net.Conn]bool),
 	}
 	if err = rpc_server.Server.RegisterName("DaemonControl", rpc_server); err != nil {
 		return fallback(err)
@@ -58,24 +71,31 @@ func NewUserRPCServer(path string) (*UserRPCServer, error) {
 	return rpc_server, nil
 }
 
+// Close : Stop accepting and disconnect clients. Calls in progress still get replies.
 func (rpc *UserRPCServer) Close() error {
-	for {
-		running := rpc.running
-		if running == 0 {
-			return errors.New("RPCServer not running.")
-		}
-		if atomic.CompareAndSwapUint32(&rpc.running, running, 0) {
-			return nil
-		}
+	if !atomic.CompareAndSwapUint32(&rpc.running, 1, 0) {
+		return errors.New("RPCServer not running.")
 	}
+	err := rpc.Listener.Close()
 
-	return rpc.Listener.Close()
+	// Connections stop reading requests, and are closed after pending calls return.
+	rpc.conn_lock.Lock()
+	for conn := range rpc.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	rpc.conn_lock.Unlock()
+
+	return err
 }
 
+// Serve : Serve every connection concurrently until closed. Return after all connections finish.
 func (rpc *UserRPCServer) Serve() error {
-	for rpc.running > 0 {
+	for atomic.LoadUint32(&rpc.running) > 0 {
 		conn, err := rpc.Listener.Accept()
 		if err != nil {
+			if atomic.LoadUint32(&rpc.running) == 0 {
+				break
+			}
 			log.WithFields(log.Fields{
 				"module": "RPCControl",
 				"event":  "Connect",
@@ -83,11 +103,33 @@ func (rpc *UserRPCServer) Serve() error {
 			continue
 		}
 
-		rpc.Server.ServeConn(conn)
+		rpc.conn_lock.Lock()
+		if atomic.LoadUint32(&rpc.running) == 0 {
+			rpc.conn_lock.Unlock()
+			conn.Close()
+			break
+		}
+		rpc.conns[conn] = true
+		rpc.wait.Add(1)
+		rpc.conn_lock.Unlock()
+
+		go rpc.serve_conn(conn)
 	}
+
+	rpc.wait.Wait()
 	return nil
 }
 
+func (rpc *UserRPCServer) serve_conn(conn net.Conn) {
+	defer rpc.wait.Done()
+
+	rpc.Server.ServeConn(conn)
+
+	rpc.conn_lock.Lock()
+	delete(rpc.conns, conn)
+	rpc.conn_lock.Unlock()
+}
+
 // RPC Exported methods
 func (rpc *UserRPCServer) Version(args ctlrpc.VersionArgs, result *ctlrpc.VersionResult) error {
 	var err error = nil
@@ -103,24 +145,416 @@ func (rpc *UserRPCServer) Version(args ctlrpc.VersionArgs, result *ctlrpc.Versio
 	}
 
 	copy(result.Magic[:], args.Magic[:])
-	args.Minor = ctlrpc.RPC_VERSION_MINOR
-	args.Major = ctlrpc.RPC_VERSION_MAJOR
+	result.Minor = ctlrpc.RPC_VERSION_MINOR
+	result.Major = ctlrpc.RPC_VERSION_MAJOR
 
 	log.WithFields(log.Fields{
 		"module": "RPCControl",
 		"event":  "Call",
-	}).Infof("RPC: Version (RequestVersion: %v.%v) [Return: %v, %v]", args.Minor, args.Major, args.Minor, args.Major)
+	}).Infof("RPC: Version (RequestVersion: %v.%v) [Return: %v, %v]", args.Major, args.Minor, result.Major, result.Minor)
 
 	return nil
 }
 
+// StopDaemon : Tear down networks and stop daemon. Reply is sent after teardown.
 func (rpc *UserRPCServer) StopDaemon(args ctlrpc.StopDaemonArgs, result *ctlrpc.StopDaemonResult) error {
-	err := errors.New("RPC StopDaemon not available.")
+	log.WithFields(log.Fields{
+		"module": "RPCControl",
+		"event":  "Call",
+	}).Info("RPC: StopDaemon")
+
+	result.ExitCode = rpc.ctl.Stop()
 
 	log.WithFields(log.Fields{
 		"module": "RPCControl",
 		"event":  "Call",
-	}).Infof(err.Error())
+	}).Infof("RPC: StopDaemon [Return: %v]", result.ExitCode)
+
+	return nil
+}
+
+func (rpc *UserRPCServer) AttachNetwork(args ctlrpc.AttachNetworkArgs, result *ctlrpc.AttachNetworkResult) error {
+	nm, err := rpc.ctl.AttachNetwork(args.Name)
+	if nm != nil {
+		result.Link = nm.LinkTun.Link.Name
+	}
+
+	log.WithFields(log.Fields{
+		"module": "RPCControl",
+		"event":  "Call",
+	}).Infof("RPC: AttachNetwork (Name: %v) [Return: %v, %v]", args.Name, result.Link, err)
+
+	return err
+}
+
+func (rpc *UserRPCServer) DetachNetwork(args ctlrpc.DetachNetworkArgs, result *ctlrpc.DetachNetworkResult) error {
+	err := rpc.ctl.DetachNetwork(args.Name)
+
+	log.WithFields(log.Fields{
+		"module": "RPCControl",
+		"event":  "Call",
+	}).Infof("RPC: DetachNetwork (Name: %v) [Return: %v]", args.Name, err)
 
 	return err
 }
+
+// LeaveNetwork : Wait until removal of this node is committed, then detach network.
+func (rpc *UserRPCServer) LeaveNetwork(args ctlrpc.LeaveNetworkArgs, result *ctlrpc.LeaveNetworkResult) error {
+	err := rpc.leave_network(&args)
+
+	log.WithFields(log.Fields{
+		"module": "RPCControl",
+		"event":  "Call",
+	}).Infof("RPC: LeaveNetwork (Network: %v, Force: %v) [Return: %v]", args.Network, args.Force, err)
+
+	return err
+}
+
+func (rpc *UserRPCServer) leave_network(args *ctlrpc.LeaveNetworkArgs) error {
+	nm, err := rpc.ctl.LookupNetwork(args.Network)
+	if err != nil {
+		return err
+	}
+	if err = nm.Leave(LEAVE_TIMEOUT); err != nil && !args.Force {
+		return err
+	}
+	return rpc.ctl.DetachNetwork(args.Network)
+}
+
+func (rpc *UserRPCServer) GetProbes(args ctlrpc.GetProbesArgs, result *ctlrpc.GetProbesResult) error {
+	networks, err := rpc.ctl.LookupNetworks(args.Network)
+	if err != nil {
+		return err
+	}
+
+	result.Peers = make([]ctlrpc.PeerProbeInfo, 0)
+	for _, name := range sorted_networks(networks) {
+		for _, peer := range networks[name].Probes() {
+			info := ctlrpc.PeerProbeInfo{
+				Network: name,
+				ID:      peer.Node.ID.String(),
+				Name:    peer.Node.Name,
+				Paths:   make([]ctlrpc.PathProbeInfo, 0, len(peer.Paths)),
+			}
+			for _, path := range peer.Paths {
+				info.Paths = append(info.Paths, ctlrpc.PathProbeInfo{
+					Endpoint: path.Endpoint.String(),
+					Best:     path.Best,
+					Sent:     path.Stats.Sent,
+					Replied:  path.Stats.Replied,
+					Lost:     path.Stats.Lost,
+					RTT:      path.Stats.RTT,
+					MinRTT:   path.Stats.MinRTT,
+					Jitter:   path.Stats.Jitter,
+					Loss:     path.Stats.Loss,
+				})
+			}
+			result.Peers = append(result.Peers, info)
+		}
+	}
+
+	return nil
+}
+
+func (rpc *UserRPCServer) GetStatus(args ctlrpc.GetStatusArgs, result *ctlrpc.GetStatusResult) error {
+	networks, err := rpc.ctl.LookupNetworks("")
+	if err != nil {
+		return err
+	}
+
+	result.Machine = rpc.ctl.GetMachineID().String()
+	result.Active = rpc.ctl.ActiveNetwork()
+	result.Networks = make([]ctlrpc.NetworkStatusInfo, 0, len(networks))
+	for _, name := range sorted_networks(networks) {
+		nm := networks[name]
+		status := nm.Status()
+		info := ctlrpc.NetworkStatusInfo{
+			Name:   name,
+			Link:   nm.LinkTun.Link.Name,
+			Role:   RoleName(status.Role),
+			Term:   status.Term,
+			Index:  status.Index,
+			Commit: status.Commit,
+			Nodes:  status.Nodes,
+		}
+		if status.Master != nil {
+			info.Master = status.Master.ID.String()
+			info.MasterName = status.Master.Name
+		}
+		result.Networks = append(result.Networks, info)
+	}
+
+	return nil
+}
+
+func (rpc *UserRPCServer) ListNodes(args ctlrpc.ListNodesArgs, result *ctlrpc.ListNodesResult) error {
+	networks, err := rpc.ctl.LookupNetworks(args.Network)
+	if err != nil {
+		return err
+	}
+
+	result.Nodes = make([]ctlrpc.NodeInfo, 0)
+	for _, name := range sorted_networks(networks) {
+		for _, status := range networks[name].Nodes() {
+			info := ctlrpc.NodeInfo{
+				Network: name,
+				ID:      status.Node.ID.String(),
+				Name:    status.Node.Name,
+				Publish: make([]string, 0, len(status.Publish)),
+				State:   NodeStateName(status.State),
+				Self:    status.Self,
+				Master:  status.Master,
+				RTT:     status.RTT,
+			}
+			for _, ep := range status.Publish {
+				info.Publish = append(info.Publish, ep.String())
+			}
+			if status.Relay != nil {
+				info.Relay = status.Relay.Name
+			}
+			result.Nodes = append(result.Nodes, info)
+		}
+	}
+
+	return nil
+}
+
+func (rpc *UserRPCServer) GetInterfaceInfo(args ctlrpc.GetInterfaceInfoArgs, result *ctlrpc.GetInterfaceInfoResult) error {
+	networks, err := rpc.ctl.LookupNetworks(args.Network)
+	if err != nil {
+		return err
+	}
+
+	result.Interfaces = make([]ctlrpc.InterfaceInfo, 0, len(networks))
+	for _, name := range sorted_networks(networks) {
+		link := networks[name].LinkStatus()
+		result.Interfaces = append(result.Interfaces, ctlrpc.InterfaceInfo{
+			Network: name,
+			Name:    link.Name,
+			Index:   link.Index,
+			MTU:     link.MTU,
+			Queues:  link.Queues,
+			Readers: link.Readers,
+			RxBytes: link.RxBytes,
+			WxBytes: link.WxBytes,
+		})
+	}
+
+	return nil
+}
+
+func (rpc *UserRPCServer) GetStats(args ctlrpc.GetStatsArgs, result *ctlrpc.GetStatsResult) error {
+	networks, err := rpc.ctl.LookupNetworks(args.Network)
+	if err != nil {
+		return err
+	}
+
+	result.Networks = make([]ctlrpc.NetworkStats, 0, len(networks))
+	for _, name := range sorted_networks(networks) {
+		counters := networks[name].Counters()
+		result.Networks = append(result.Networks, ctlrpc.NetworkStats{
+			Network:             name,
+			RxBytes:             counters.RxBytes,
+			WxBytes:             counters.WxBytes,
+			Unknown:             counters.Unknown,
+			Fragment:            counters.Fragment,
+			Relay:               counters.Relay,
+			RelayDrop:           counters.RelayDrop,
+			DecryptDrop:         counters.DecryptDrop,
+			PlaintextDrop:       counters.PlaintextDrop,
+			ReplayDrop:          counters.ReplayDrop,
+			EpochDrop:           counters.EpochDrop,
+			FragmentTimeoutDrop: counters.FragmentTimeoutDrop,
+			FragmentLimitDrop:   counters.FragmentLimitDrop,
+			FragmentInvalidDrop: counters.FragmentInvalidDrop,
+		})
+	}
+
+	return nil
+}
+
+// JoinNetwork : Attach network if not running, and start joining it via address of a member.
+func (rpc *UserRPCServer) JoinNetwork(args ctlrpc.JoinNetworkArgs, result *ctlrpc.JoinNetworkResult) error {
+	err := rpc.join_network(&args, result)
+
+	log.WithFields(log.Fields{
+		"module": "RPCControl",
+		"event":  "Call",
+	}).Infof("RPC: JoinNetwork (Network: %v, Address: %v) [Return: %v, %v]", args.Network, args.Address, result.Link, err)
+
+	return err
+}
+
+func (rpc *UserRPCServer) join_network(args *ctlrpc.JoinNetworkArgs, result *ctlrpc.JoinNetworkResult) error {
+	address, err := protocol.ParseEndpoint(args.Address)
+	if err != nil {
+		return err
+	}
+	token, err := uuid.Parse(args.Token)
+	if err != nil {
+		return err
+	}
+	publish := make([]*protocol.Endpoint, 0, len(args.Publish))
+	for _, raw := range args.Publish {
+		ep, err := protocol.ParseEndpoint(raw)
+		if err != nil {
+			return err
+		}
+		publish = append(publish, ep)
+	}
+	prefixes := make([]*net.IPNet, 0, len(args.Prefixes))
+	for _, raw := range args.Prefixes {
+		prefix, err := protocol.ParsePrefix(raw)
+		if err != nil {
+			return err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	nm, err := rpc.ctl.LookupNetwork(args.Network)
+	if nm == nil {
+		if nm, err = rpc.ctl.AttachNetwork(args.Network); nm == nil {
+			return err
+		}
+	}
+	result.Link = nm.LinkTun.Link.Name
+
+	return nm.Join(address, token, publish, prefixes)
+}
+
+// AddNode : Propose admission of node. Daemon should be master of network.
+func (rpc *UserRPCServer) AddNode(args ctlrpc.AddNodeArgs, result *ctlrpc.AddNodeResult) error {
+	err := rpc.add_node(&args, result)
+
+	log.WithFields(log.Fields{
+		"module": "RPCControl",
+		"event":  "Call",
+	}).Infof("RPC: AddNode (Network: %v, ID: %v, Name: %v) [Return: %v, %v]", args.Network, args.ID, args.Name, result.Index, err)
+
+	return err
+}
+
+func (rpc *UserRPCServer) add_node(args *ctlrpc.AddNodeArgs, result *ctlrpc.AddNodeResult) error {
+	nm, err := rpc.ctl.LookupNetwork(args.Network)
+	if err != nil {
+		return err
+	}
+	if _, err = uuid.Parse(args.ID); err != nil {
+		return err
+	}
+
+	entry := &LogEntryYAML{
+		Op:       LOG_OP_NAMES[protocol.LOG_NODE_ADD],
+		Node:     args.ID,
+		Name:     args.Name,
+		Publish:  args.Publish,
+		Prefixes: args.Prefixes,
+		Key:      args.Key,
+		Identity: args.Identity,
+	}
+	if err = nm.Propose(entry); err != nil {
+		return err
+	}
+	result.Index = entry.Index
+	return nil
+}
+
+// RemoveNode : Propose removal of node of ID or name. Daemon should be master of network.
+func (rpc *UserRPCServer) RemoveNode(args ctlrpc.RemoveNodeArgs, result *ctlrpc.RemoveNodeResult) error {
+	err := rpc.remove_node(&args, result)
+
+	log.WithFields(log.Fields{
+		"module": "RPCControl",
+		"event":  "Call",
+	}).Infof("RPC: RemoveNode (Network: %v, Node: %v) [Return: %v, %v]", args.Network, args.Node, result.Index, err)
+
+	return err
+}
+
+func (rpc *UserRPCServer) remove_node(args *ctlrpc.RemoveNodeArgs, result *ctlrpc.RemoveNodeResult) error {
+	nm, err := rpc.ctl.LookupNetwork(args.Network)
+	if err != nil {
+		return err
+	}
+
+	var node *NetworkNode
+	for _, status := range nm.Nodes() {
+		if status.Node.ID.String() == args.Node || status.Node.Name == args.Node {
+			node = status.Node
+			break
+		}
+	}
+	if node == nil {
+		return fmt.Errorf("Node %v not found.", args.Node)
+	}
+
+	entry := &LogEntryYAML{
+		Op:   LOG_OP_NAMES[protocol.LOG_NODE_REMOVE],
+		Node: node.ID.String(),
+	}
+	if err = nm.Propose(entry); err != nil {
+		return err
+	}
+	result.Index = entry.Index
+	return nil
+}
+
+// RotateToken : Propose new join token. Daemon should be master of network.
+func (rpc *UserRPCServer) RotateToken(args ctlrpc.RotateTokenArgs, result *ctlrpc.RotateTokenResult) error {
+	err := rpc.rotate_token(&args, result)
+
+	log.WithFields(log.Fields{
+		"module": "RPCControl",
+		"event":  "Call",
+	}).Infof("RPC: RotateToken (Network: %v) [Return: %v, %v]", args.Network, result.Index, err)
+
+	return err
+}
+
+func (rpc *UserRPCServer) rotate_token(args *ctlrpc.RotateTokenArgs, result *ctlrpc.RotateTokenResult) error {
+	nm, err := rpc.ctl.LookupNetwork(args.Network)
+	if err != nil {
+		return err
+	}
+
+	token := args.Token
+	if token == "" {
+		if token, err = NewID(); err != nil {
+			return err
+		}
+	}
+	entry := &LogEntryYAML{
+		Op:                LOG_OP_NAMES[protocol.LOG_TOKEN_ROTATE],
+		Token:             token,
+		TokenExpireBefore: args.ExpireBefore,
+		TokenExpireAfter:  args.ExpireAfter,
+	}
+	if err = nm.Propose(entry); err != nil {
+		return err
+	}
+	result.Token = token
+	result.Index = entry.Index
+	return nil
+}
+
+// Reload : Read configure file again and restart networks from it.
+func (rpc *UserRPCServer) Reload(args ctlrpc.ReloadArgs, result *ctlrpc.ReloadResult) error {
+	var err error
+	result.Networks, err = rpc.ctl.Reload()
+
+	log.WithFields(log.Fields{
+		"module": "RPCControl",
+		"event":  "Call",
+	}).Infof("RPC: Reload [Return: %v, %v]", result.Networks, err)
+
+	return err
+}
+
+func sorted_networks(networks map[string]*ClusterManager) []string {
+	names := make([]string, 0, len(networks))
+	for name := range networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -48,16 +48,147 @@ func (port *UserRPCPort) Version() (uint8, uint8, error) {
 	copy(args.Magic[:], RPC_MAGIC[:])
 	args.Major = RPC_VERSION_MAJOR
 	args.Minor = RPC_VERSION_MINOR
-	err := port.Client.Call("DaemonControl.Version", args, &result)
+	err := port.Client.Call("DaemonControl.Version", args, result)
 	if err != nil {
 		return 0, 0, err
 	}
-	if bytes.Equal(result.Magic[:], RPC_MAGIC[:]) {
+	if !bytes.Equal(result.Magic[:], RPC_MAGIC[:]) {
 		return 0, 0, fmt.Errorf("Invalid Version Magic: %v", result.Magic)
 	}
 	return result.Major, result.Minor, nil
 }
 
+// StopDaemon : Stop daemon gracefully. Returns exit code of daemon.
+func (port *UserRPCPort) StopDaemon() (int, error) {
+	args := new(StopDaemonArgs)
+	result := new(StopDaemonResult)
+	if err := port.Client.Call("DaemonControl.StopDaemon", args, result); err != nil {
+		return 0, err
+	}
+	return result.ExitCode, nil
+}
+
+// AttachNetwork : Start network in daemon. Returns link of network.
+func (port *UserRPCPort) AttachNetwork(name string) (string, error) {
+	args := &AttachNetworkArgs{Name: name}
+	result := new(AttachNetworkResult)
+	if err := port.Client.Call("DaemonControl.AttachNetwork", args, result); err != nil {
+		return "", err
+	}
+	return result.Link, nil
+}
+
+// DetachNetwork : Stop network in daemon.
+func (port *UserRPCPort) DetachNetwork(name string) error {
+	args := &DetachNetworkArgs{Name: name}
+	result := new(DetachNetworkResult)
+	return port.Client.Call("DaemonControl.DetachNetwork", args, result)
+}
+
+// LeaveNetwork : Remove this node from network through master, then stop network in daemon.
+func (port *UserRPCPort) LeaveNetwork(network string, force bool) error {
+	args := &LeaveNetworkArgs{Network: network, Force: force}
+	result := new(LeaveNetworkResult)
+	return port.Client.Call("DaemonControl.LeaveNetwork", args, result)
+}
+
+// GetProbes : RTT, jitter and loss of paths to peers. All attached networks if network is empty.
+func (port *UserRPCPort) GetProbes(network string) ([]PeerProbeInfo, error) {
+	args := &GetProbesArgs{Network: network}
+	result := new(GetProbesResult)
+	if err := port.Client.Call("DaemonControl.GetProbes", args, result); err != nil {
+		return nil, err
+	}
+	return result.Peers, nil
+}
+
+// GetStatus : Machine ID, active network, and election state of attached networks.
+func (port *UserRPCPort) GetStatus() (*GetStatusResult, error) {
+	args := new(GetStatusArgs)
+	result := new(GetStatusResult)
+	if err := port.Client.Call("DaemonControl.GetStatus", args, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ListNodes : Nodes of network seen by daemon. All attached networks if network is empty.
+func (port *UserRPCPort) ListNodes(network string) ([]NodeInfo, error) {
+	args := &ListNodesArgs{Network: network}
+	result := new(ListNodesResult)
+	if err := port.Client.Call("DaemonControl.ListNodes", args, result); err != nil {
+		return nil, err
+	}
+	return result.Nodes, nil
+}
+
+// GetInterfaceInfo : TUN links of network. All attached networks if network is empty.
+func (port *UserRPCPort) GetInterfaceInfo(network string) ([]InterfaceInfo, error) {
+	args := &GetInterfaceInfoArgs{Network: network}
+	result := new(GetInterfaceInfoResult)
+	if err := port.Client.Call("DaemonControl.GetInterfaceInfo", args, result); err != nil {
+		return nil, err
+	}
+	return result.Interfaces, nil
+}
+
+// GetStats : Traffic and drop counters. All attached networks if network is empty.
+func (port *UserRPCPort) GetStats(network string) ([]NetworkStats, error) {
+	args := &GetStatsArgs{Network: network}
+	result := new(GetStatsResult)
+	if err := port.Client.Call("DaemonControl.GetStats", args, result); err != nil {
+		return nil, err
+	}
+	return result.Networks, nil
+}
+
+// JoinNetwork : Join network via publish address of a member. Returns link of network.
+func (port *UserRPCPort) JoinNetwork(args *JoinNetworkArgs) (string, error) {
+	result := new(JoinNetworkResult)
+	if err := port.Client.Call("DaemonControl.JoinNetwork", args, result); err != nil {
+		return "", err
+	}
+	return result.Link, nil
+}
+
+// AddNode : Admit node to network. Daemon should be master. Returns log index of change.
+func (port *UserRPCPort) AddNode(args *AddNodeArgs) (uint64, error) {
+	result := new(AddNodeResult)
+	if err := port.Client.Call("DaemonControl.AddNode", args, result); err != nil {
+		return 0, err
+	}
+	return result.Index, nil
+}
+
+// RemoveNode : Remove node of ID or name from network. Daemon should be master. Returns log index of change.
+func (port *UserRPCPort) RemoveNode(network string, node string) (uint64, error) {
+	args := &RemoveNodeArgs{Network: network, Node: node}
+	result := new(RemoveNodeResult)
+	if err := port.Client.Call("DaemonControl.RemoveNode", args, result); err != nil {
+		return 0, err
+	}
+	return result.Index, nil
+}
+
+// RotateToken : Replace join token of network. Daemon should be master. Returns token and log index of change.
+func (port *UserRPCPort) RotateToken(args *RotateTokenArgs) (string, uint64, error) {
+	result := new(RotateTokenResult)
+	if err := port.Client.Call("DaemonControl.RotateToken", args, result); err != nil {
+		return "", 0, err
+	}
+	return result.Token, result.Index, nil
+}
+
+// Reload : Restart networks from configure file. Returns networks running after reload.
+func (port *UserRPCPort) Reload() ([]string, error) {
+	args := new(ReloadArgs)
+	result := new(ReloadResult)
+	if err := port.Client.Call("DaemonControl.Reload", args, result); err != nil {
+		return nil, err
+	}
+	return result.Networks, nil
+}
+
 func ParseRPCNetPath(path string) (string, string, error) {
 	var err error
 	var domain, address string
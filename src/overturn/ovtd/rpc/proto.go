@@ -1,5 +1,9 @@
 package rpc
 
+import (
+	"time"
+)
+
 // Version
 const (
 	RPC_VERSION_MAJOR = 1
@@ -27,3 +31,196 @@ type StopDaemonArgs struct{}
 type StopDaemonResult struct {
 	ExitCode int
 }
+
+type AttachNetworkArgs struct {
+	Name string
+}
+
+type AttachNetworkResult struct {
+	Link string
+}
+
+type DetachNetworkArgs struct {
+	Name string
+}
+
+type DetachNetworkResult struct{}
+
+// LeaveNetworkArgs : Remove this node from network, then detach it. Force detaches even if removal fails.
+type LeaveNetworkArgs struct {
+	Network string
+	Force   bool
+}
+
+type LeaveNetworkResult struct{}
+
+type GetProbesArgs struct {
+	Network string // Empty for all attached networks.
+}
+
+// PathProbeInfo : Probe results of one underlay path to peer.
+type PathProbeInfo struct {
+	Endpoint string
+	Best     bool
+	Sent     int
+	Replied  int
+	Lost     int
+	RTT      time.Duration
+	MinRTT   time.Duration
+	Jitter   time.Duration
+	Loss     float64
+}
+
+type PeerProbeInfo struct {
+	Network string
+	ID      string
+	Name    string
+	Paths   []PathProbeInfo
+}
+
+type GetProbesResult struct {
+	Peers []PeerProbeInfo
+}
+
+type GetStatusArgs struct{}
+
+// NetworkStatusInfo : Election and membership state of attached network.
+type NetworkStatusInfo struct {
+	Name       string
+	Link       string
+	Role       string
+	Term       uint64
+	Index      uint64
+	Commit     uint64
+	Master     string // ID of master. Empty if none.
+	MasterName string
+	Nodes      int
+}
+
+type GetStatusResult struct {
+	Machine  string
+	Active   string
+	Networks []NetworkStatusInfo
+}
+
+type ListNodesArgs struct {
+	Network string // Empty for all attached networks.
+}
+
+type NodeInfo struct {
+	Network string
+	ID      string
+	Name    string
+	Publish []string
+	State   string
+	Self    bool
+	Master  bool
+	RTT     time.Duration // Over best path. 0 if unknown.
+	Relay   string        // Name of next hop if relayed.
+}
+
+type ListNodesResult struct {
+	Nodes []NodeInfo
+}
+
+type GetInterfaceInfoArgs struct {
+	Network string // Empty for all attached networks.
+}
+
+// InterfaceInfo : TUN link of attached network.
+type InterfaceInfo struct {
+	Network string
+	Name    string
+	Index   int
+	MTU     int
+	Queues  int
+	Readers uint32
+	RxBytes uint64
+	WxBytes uint64
+}
+
+type GetInterfaceInfoResult struct {
+	Interfaces []InterfaceInfo
+}
+
+type GetStatsArgs struct {
+	Network string // Empty for all attached networks.
+}
+
+// NetworkStats : Traffic and drop counters of attached network.
+type NetworkStats struct {
+	Network             string
+	RxBytes             uint64
+	WxBytes             uint64
+	Unknown             uint64
+	Fragment            uint64
+	Relay               uint64
+	RelayDrop           uint64
+	DecryptDrop         uint64
+	PlaintextDrop       uint64
+	ReplayDrop          uint64
+	EpochDrop           uint64
+	FragmentTimeoutDrop uint64
+	FragmentLimitDrop   uint64
+	FragmentInvalidDrop uint64
+}
+
+type GetStatsResult struct {
+	Networks []NetworkStats
+}
+
+// JoinNetworkArgs : Join network via publish address of a member. Network is attached first if not running.
+type JoinNetworkArgs struct {
+	Network  string
+	Address  string
+	Token    string
+	Publish  []string
+	Prefixes []string
+}
+
+type JoinNetworkResult struct {
+	Link string
+}
+
+// AddNodeArgs : Node admitted to network by master.
+type AddNodeArgs struct {
+	Network  string
+	ID       string
+	Name     string
+	Publish  []string
+	Prefixes []string
+	Key      string
+	Identity string
+}
+
+type AddNodeResult struct {
+	Index uint64 // Log index of membership change.
+}
+
+type RemoveNodeArgs struct {
+	Network string
+	Node    string // ID or name.
+}
+
+type RemoveNodeResult struct {
+	Index uint64
+}
+
+// RotateTokenArgs : New join token of network. Token is generated if empty. Expiry is in unix seconds, 0 for none.
+type RotateTokenArgs struct {
+	Network      string
+	Token        string
+	ExpireBefore uint64
+	ExpireAfter  uint64
+}
+
+type RotateTokenResult struct {
+	Token string
+	Index uint64
+}
+
+type ReloadArgs struct{}
+
+type ReloadResult struct {
+	Networks []string // Networks running after reload.
+}
@@ -0,0 +1,422 @@
+package ovtd
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"overturn/protocol"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Initiator renews session after SESSION_REKEY_PERIOD.
+	SESSION_REKEY_PERIOD = 2 * time.Minute
+	HANDSHAKE_RETRY      = time.Second
+
+	SESSION_KDF_INFO = "overturn session "
+
+	ERR_INVALID_KEY = "Invalid key."
+)
+
+// StaticKey : Long-term X25519 keypair of node.
+type StaticKey struct {
+	Private [32]byte
+	Public  [32]byte
+}
+
+func NewStaticKey() (*StaticKey, error) {
+	key := new(StaticKey)
+	if _, err := io.ReadFull(rand.Reader, key.Private[:]); err != nil {
+		return nil, err
+	}
+	if err := key.derive_public(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ParseStaticKey : Load keypair from base64 encoded private key.
+func ParseStaticKey(raw string) (*StaticKey, error) {
+	key := new(StaticKey)
+	private, err := ParseKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	key.Private = private
+	if err = key.derive_public(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (key *StaticKey) derive_public() error {
+	public, err := curve25519.X25519(key.Private[:], curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+	copy(key.Public[:], public)
+	return nil
+}
+
+func (key *StaticKey) String() string {
+	return EncodeKey(key.Private)
+}
+
+func ParseKey(raw string) ([32]byte, error) {
+	var key [32]byte
+	decoded, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		return key, err
+	}
+	if len(decoded) != len(key) {
+		return key, errors.New(ERR_INVALID_KEY)
+	}
+	copy(key[:], decoded)
+	return key, nil
+}
+
+func EncodeKey(key [32]byte) string {
+	if key == [32]byte{} {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+// PeerSession : Keys to talk with a peer.
+type PeerSession struct {
+	Send        cipher.AEAD
+	Recv        cipher.AEAD
+	Initiator   bool
+	Established time.Time
+}
+
+type pendingHandshake struct {
+	private [32]byte
+	public  [32]byte
+	sent    time.Time
+}
+
+// SessionTable : Sessions with peers. Previous session is kept to decrypt packets in flight during rekey.
+type SessionTable struct {
+	DecryptDropStat   uint64
+	PlaintextDropStat uint64
+
+	lock       sync.RWMutex
+	current    map[uuid.UUID]*PeerSession
+	previous   map[uuid.UUID]*PeerSession
+	handshakes map[uuid.UUID]*pendingHandshake
+	keyless    map[uuid.UUID]bool // peers warned for missing static key
+}
+
+func NewSessionTable() *SessionTable {
+	return &SessionTable{
+		current:    make(map[uuid.UUID]*PeerSession),
+		previous:   make(map[uuid.UUID]*PeerSession),
+		handshakes: make(map[uuid.UUID]*pendingHandshake),
+		keyless:    make(map[uuid.UUID]bool),
+	}
+}
+
+func (table *SessionTable) Get(id uuid.UUID) *PeerSession {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+	return table.current[id]
+}
+
+func (table *SessionTable) install(id uuid.UUID, session *PeerSession) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	if last, ok := table.current[id]; ok {
+		table.previous[id] = last
+	}
+	table.current[id] = session
+	delete(table.handshakes, id)
+}
+
+func (table *SessionTable) lookup(id uuid.UUID) (*PeerSession, *PeerSession) {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+	return table.current[id], table.previous[id]
+}
+
+// Forget : Drop sessions of nodes no longer in membership.
+func (table *SessionTable) Forget(keep map[uuid.UUID]*NetworkNode) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	for _, sessions := range []map[uuid.UUID]*PeerSession{table.current, table.previous} {
+		for id := range sessions {
+			if _, ok := keep[id]; !ok {
+				delete(sessions, id)
+			}
+		}
+	}
+	for id := range table.handshakes {
+		if _, ok := keep[id]; !ok {
+			delete(table.handshakes, id)
+		}
+	}
+	for id := range table.keyless {
+		if node, ok := keep[id]; !ok || node.Key != [32]byte{} {
+			delete(table.keyless, id)
+		}
+	}
+}
+
+// warn_keyless : Warn once that peer has no static key, so no session can be established with it.
+func (table *SessionTable) warn_keyless(node *NetworkNode) {
+	table.lock.Lock()
+	warned := table.keyless[node.ID]
+	table.keyless[node.ID] = true
+	table.lock.Unlock()
+
+	if !warned {
+		log.WithFields(log.Fields{
+			"module":  "ClusterManager",
+			"event":   "handshake",
+			"node_id": node.ID.String(),
+		}).Warningf("No static key of %v in membership. No session until it publishes its key.", node.Name)
+	}
+}
+
+func new_ephemeral() (*pendingHandshake, error) {
+	key, err := NewStaticKey()
+	if err != nil {
+		return nil, err
+	}
+	return &pendingHandshake{
+		private: key.Private,
+		public:  key.Public,
+		sent:    time.Now(),
+	}, nil
+}
+
+// derive_session : Derive directional keys from static and ephemeral shared secrets.
+// Static secret binds session to membership keys, ephemeral one gives forward secrecy.
+func derive_session(network string, static_shared, ephemeral_shared []byte, init_pub, resp_pub [32]byte, initiator bool) (*PeerSession, error) {
+	secret := make([]byte, 0, len(static_shared)+len(ephemeral_shared))
+	secret = append(secret, static_shared...)
+	secret = append(secret, ephemeral_shared...)
+	salt := make([]byte, 0, 64)
+	salt = append(salt, init_pub[:]...)
+	salt = append(salt, resp_pub[:]...)
+
+	keys := make([]byte, 2*chacha20poly1305.KeySize)
+	kdf := hkdf.New(sha256.New, secret, salt, []byte(SESSION_KDF_INFO+network))
+	if _, err := io.ReadFull(kdf, keys); err != nil {
+		return nil, err
+	}
+	to_responder, err := chacha20poly1305.New(keys[:chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, err
+	}
+	to_initiator, err := chacha20poly1305.New(keys[chacha20poly1305.KeySize:])
+	if err != nil {
+		return nil, err
+	}
+
+	session := &PeerSession{
+		Initiator:   initiator,
+		Established: time.Now(),
+	}
+	if initiator {
+		session.Send, session.Recv = to_responder, to_initiator
+	} else {
+		session.Send, session.Recv = to_initiator, to_responder
+	}
+	return session, nil
+}
+
+// handshake : Start session establishment with node. Retries are limited by HANDSHAKE_RETRY.
+func (nm *ClusterManager) handshake(node *NetworkNode) {
+	if node == nil || node == nm.Info.Self {
+		return
+	}
+	if node.Key == [32]byte{} {
+		nm.Sessions.warn_keyless(node)
+		return
+	}
+
+	table := nm.Sessions
+	table.lock.Lock()
+	if pending, ok := table.handshakes[node.ID]; ok && time.Since(pending.sent) < HANDSHAKE_RETRY {
+		table.lock.Unlock()
+		return
+	}
+	pending, err := new_ephemeral()
+	if err != nil {
+		table.lock.Unlock()
+		log.WithFields(log.Fields{
+			"module":     "ClusterManager",
+			"event":      "handshake",
+			"err_detail": err.Error(),
+		}).Error("Cannot generate ephemeral key.")
+		return
+	}
+	table.handshakes[node.ID] = pending
+	table.lock.Unlock()
+
+	msg := protocol.NewHandshake(nm.Info.Name, nm.Info.Self.ID, node.ID)
+	msg.Ephemeral = pending.public
+	nm.SendMessage(node, protocol.HANDSHAKE, msg)
+}
+
+// maintain_sessions : Establish missing sessions and renew aged ones.
+func (nm *ClusterManager) maintain_sessions() {
+	for _, node := range nm.Info.ByID {
+		if node == nm.Info.Self || node.LoadState() == NODE_DOWN {
+			continue
+		}
+		session := nm.Sessions.Get(node.ID)
+		if session == nil {
+			nm.handshake(node)
+			continue
+		}
+		age := time.Since(session.Established)
+		if (session.Initiator && age > SESSION_REKEY_PERIOD) || age > 2*SESSION_REKEY_PERIOD {
+			nm.handshake(node)
+		}
+	}
+}
+
+func (nm *ClusterManager) OnHandshake(msg *protocol.Handshake, frame protocol.OVTPacket) {
+	if msg.NetName != NetNameKey(nm.Info.Name) {
+		return
+	}
+
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+
+	node, ok := nm.Info.ByID[msg.Node]
+	if !ok || node == nm.Info.Self || msg.Peer != nm.Info.Self.ID || node.Key == [32]byte{} {
+		return
+	}
+	if !nm.verify_frame(node.ID, node.Identity, frame, msg) {
+		return
+	}
+	fallback := func(err error) {
+		log.WithFields(log.Fields{
+			"module":     "ClusterManager",
+			"event":      "handshake",
+			"err_detail": err.Error(),
+			"node_id":    node.ID.String(),
+		}).Warning("Handshake failed.")
+	}
+
+	static_shared, err := curve25519.X25519(nm.ctl.Key.Private[:], node.Key[:])
+	if err != nil {
+		fallback(err)
+		return
+	}
+
+	table := nm.Sessions
+	if msg.Reply {
+		table.lock.RLock()
+		pending, ok := table.handshakes[node.ID]
+		table.lock.RUnlock()
+		if !ok || pending.public != msg.PeerEphemeral {
+			return
+		}
+		ephemeral_shared, err := curve25519.X25519(pending.private[:], msg.Ephemeral[:])
+		if err != nil {
+			fallback(err)
+			return
+		}
+		session, err := derive_session(nm.Info.Name, static_shared, ephemeral_shared, pending.public, msg.Ephemeral, true)
+		if err != nil {
+			fallback(err)
+			return
+		}
+		table.install(node.ID, session)
+
+	} else {
+		// Both sides initiated. Node with smaller ID keeps initiator role.
+		table.lock.RLock()
+		_, initiating := table.handshakes[node.ID]
+		table.lock.RUnlock()
+		if initiating && bytes.Compare(nm.Info.Self.ID[:], node.ID[:]) < 0 {
+			return
+		}
+
+		ephemeral, err := new_ephemeral()
+		if err != nil {
+			fallback(err)
+			return
+		}
+		ephemeral_shared, err := curve25519.X25519(ephemeral.private[:], msg.Ephemeral[:])
+		if err != nil {
+			fallback(err)
+			return
+		}
+		session, err := derive_session(nm.Info.Name, static_shared, ephemeral_shared, msg.Ephemeral, ephemeral.public, false)
+		if err != nil {
+			fallback(err)
+			return
+		}
+		table.install(node.ID, session)
+
+		reply := protocol.NewHandshake(nm.Info.Name, nm.Info.Self.ID, node.ID)
+		reply.Reply = true
+		reply.Ephemeral = ephemeral.public
+		reply.PeerEphemeral = msg.Ephemeral
+		nm.SendMessage(node, protocol.HANDSHAKE, reply)
+	}
+
+	log.WithFields(log.Fields{
+		"module":  "ClusterManager",
+		"event":   "handshake",
+		"node_id": node.ID.String(),
+	}).Infof("Session with %v established.", node.Name)
+}
+
+// open_packet : Decrypt secure packet by session of sender. Return nil if packet should be dropped.
+func (nm *ClusterManager) open_packet(pkt protocol.OVTPacket) protocol.OVTPacket {
+	table := nm.Sessions
+	if len(pkt) < protocol.SECURE_OVERHEAD {
+		atomic.AddUint64(&table.DecryptDropStat, 1)
+		return nil
+	}
+
+	sender := pkt.Sender()
+	current, previous := table.lookup(sender)
+	for _, session := range []*PeerSession{current, previous} {
+		if session == nil {
+			continue
+		}
+		plain, err := pkt.Open(session.Recv)
+		if err != nil {
+			continue
+		}
+		if !nm.Replay.Accept(sender, pkt.Epoch(), pkt.Sequence()) {
+			return nil
+		}
+		return plain
+	}
+
+	// Peer may have restarted and lost its session.
+	atomic.AddUint64(&table.DecryptDropStat, 1)
+	if node, ok := nm.Info.ByID[sender]; ok {
+		nm.handshake(node)
+	}
+	return nil
+}
+
+// accept_plain : Only control messages are allowed in plaintext unless network is insecure.
+func (nm *ClusterManager) accept_plain(pkt protocol.OVTPacket) bool {
+	payload_type := pkt.PayloadType()
+	if (payload_type != protocol.RAW_PAYLOAD && payload_type != protocol.FRAGMENT && payload_type != protocol.RELAY) || nm.Config.Insecure {
+		return true
+	}
+	atomic.AddUint64(&nm.Sessions.PlaintextDropStat, 1)
+	return false
+}
@@ -0,0 +1,133 @@
+package ovtd
+
+import (
+	"overturn/protocol"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ClusterStatus : Snapshot of election and membership state of network.
+type ClusterStatus struct {
+	Role   uint8
+	Term   uint64
+	Index  uint64
+	Commit uint64
+	Master *NetworkNode
+	Nodes  int
+}
+
+// NodeStatus : Snapshot of node seen by this node.
+type NodeStatus struct {
+	Node    *NetworkNode
+	Publish []*protocol.Endpoint
+	State   uint32
+	Self    bool
+	Master  bool
+	RTT     time.Duration // Over best path. 0 if unknown.
+	Relay   *NetworkNode  // Next hop if node is relayed.
+}
+
+// ClusterCounters : Snapshot of traffic and drop counters of network.
+type ClusterCounters struct {
+	RxBytes             uint64
+	WxBytes             uint64
+	Unknown             uint64
+	Fragment            uint64
+	Relay               uint64
+	RelayDrop           uint64
+	DecryptDrop         uint64
+	PlaintextDrop       uint64
+	ReplayDrop          uint64
+	EpochDrop           uint64
+	FragmentTimeoutDrop uint64
+	FragmentLimitDrop   uint64
+	FragmentInvalidDrop uint64
+}
+
+// LinkStatus : Snapshot of link tunnel.
+type LinkStatus struct {
+	Name    string
+	Index   int
+	MTU     int
+	Queues  int
+	Readers uint32
+	RxBytes uint64
+	WxBytes uint64
+}
+
+// Status : Election state and membership size.
+func (nm *ClusterManager) Status() ClusterStatus {
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+
+	return ClusterStatus{
+		Role:   nm.Info.Role,
+		Term:   nm.Info.Term,
+		Index:  nm.Info.Index,
+		Commit: nm.Info.Commit,
+		Master: nm.Info.Master,
+		Nodes:  len(nm.Info.ByID),
+	}
+}
+
+// Nodes : Snapshot of nodes in membership, ordered by name.
+func (nm *ClusterManager) Nodes() []NodeStatus {
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+
+	nodes := make([]NodeStatus, 0, len(nm.Info.ByID))
+	for _, node := range nm.Info.ByID {
+		status := NodeStatus{
+			Node:    node,
+			Publish: node.Publish,
+			State:   node.LoadState(),
+			Self:    node == nm.Info.Self,
+			Master:  node == nm.Info.Master,
+			Relay:   nm.relay_hop(node),
+		}
+		for _, path := range node.Paths.Probes() {
+			if path.Best {
+				status.RTT = path.Stats.RTT
+			}
+		}
+		nodes = append(nodes, status)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Node.Name < nodes[j].Node.Name
+	})
+	return nodes
+}
+
+// LinkStatus : Attributes and counters of link tunnel.
+func (nm *ClusterManager) LinkStatus() LinkStatus {
+	attrs := nm.LinkTun.Link.Attrs()
+	return LinkStatus{
+		Name:    attrs.Name,
+		Index:   attrs.Index,
+		MTU:     attrs.MTU,
+		Queues:  len(nm.LinkTun.Link.Fds),
+		Readers: nm.LinkTun.ReaderCount(),
+		RxBytes: atomic.LoadUint64(&nm.LinkTun.RxStat),
+		WxBytes: atomic.LoadUint64(&nm.LinkTun.WxStat),
+	}
+}
+
+// Counters : Traffic and drop counters of network.
+func (nm *ClusterManager) Counters() ClusterCounters {
+	return ClusterCounters{
+		RxBytes:             atomic.LoadUint64(&nm.LinkTun.RxStat),
+		WxBytes:             atomic.LoadUint64(&nm.LinkTun.WxStat),
+		Unknown:             atomic.LoadUint64(&nm.UnknownStat),
+		Fragment:            atomic.LoadUint64(&nm.FragmentStat),
+		Relay:               atomic.LoadUint64(&nm.RelayStat),
+		RelayDrop:           atomic.LoadUint64(&nm.RelayDropStat),
+		DecryptDrop:         atomic.LoadUint64(&nm.Sessions.DecryptDropStat),
+		PlaintextDrop:       atomic.LoadUint64(&nm.Sessions.PlaintextDropStat),
+		ReplayDrop:          atomic.LoadUint64(&nm.Replay.ReplayDropStat),
+		EpochDrop:           atomic.LoadUint64(&nm.Replay.EpochDropStat),
+		FragmentTimeoutDrop: atomic.LoadUint64(&nm.Fragments.TimeoutDropStat),
+		FragmentLimitDrop:   atomic.LoadUint64(&nm.Fragments.LimitDropStat),
+		FragmentInvalidDrop: atomic.LoadUint64(&nm.Fragments.InvalidDropStat),
+	}
+}
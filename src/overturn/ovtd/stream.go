@@ -0,0 +1,383 @@
+package ovtd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"overturn/protocol"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_STREAM_PORT = 443
+
+	STREAM_MAX_FRAME     = 65536
+	STREAM_DIAL_TIMEOUT  = 5 * time.Second
+	STREAM_WRITE_TIMEOUT = 5 * time.Second
+	STREAM_BACKOFF_MIN   = time.Second
+	STREAM_BACKOFF_MAX   = 60 * time.Second
+
+	// Accept errors like EMFILE persist for a while. Back off as net/http does.
+	STREAM_ACCEPT_BACKOFF_MIN = 5 * time.Millisecond
+	STREAM_ACCEPT_BACKOFF_MAX = time.Second
+
+	ERR_STREAM_NOT_CONNECTED = "Stream not connected."
+)
+
+type streamPeer struct {
+	conn       net.Conn
+	inbound    bool
+	ip         net.IP
+	write_lock sync.Mutex
+
+	dialing   bool
+	backoff   time.Duration
+	next_dial time.Time
+}
+
+// StreamTunnel : Carry OVT packets over persistent TCP (or TLS) connections.
+// OVT header encodes packet length, so packets are framed as is.
+type StreamTunnel struct {
+	RxStat uint64
+	WxStat uint64
+	Port   uint16
+	TLS    *tls.Config
+
+	mtu      uint32
+	running  uint32
+	fallback bool
+	listener net.Listener
+	handler  func(tun NetTunnel, pkt protocol.TunnelPacket, from net.Addr)
+	lock     sync.Mutex
+	peers    map[string]*streamPeer
+	wait     sync.WaitGroup
+}
+
+type StreamTunnelPacket []byte
+
+func (pkt StreamTunnelPacket) PayloadRef() []byte {
+	return pkt
+}
+
+// LoadTLSConfig : Build mutual TLS configure from network configure.
+func LoadTLSConfig(config *NetworkClusterYAML) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	tls_config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.TLSCA != "" {
+		var ca []byte
+		if ca, err = ioutil.ReadFile(config.TLSCA); err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("No certificate found in %v.", config.TLSCA)
+		}
+		tls_config.RootCAs = pool
+		tls_config.ClientCAs = pool
+		tls_config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tls_config, nil
+}
+
+func NewStreamTunnel(address string, port uint16, tls_config *tls.Config, fallback bool) (*StreamTunnel, error) {
+	var err error
+
+	if port == 0 {
+		port = DEFAULT_STREAM_PORT
+	}
+
+	tun := &StreamTunnel{
+		RxStat:   0,
+		WxStat:   0,
+		Port:     port,
+		TLS:      tls_config,
+		mtu:      1500 - 40 - 20, // Header: IPv6(40byte) + TCP(20Byte)
+		fallback: fallback,
+		peers:    make(map[string]*streamPeer),
+	}
+
+	tun.listener, err = net.Listen("tcp", net.JoinHostPort(address, strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, err
+	}
+	return tun, nil
+}
+
+func (tun *StreamTunnel) Name() string {
+	if tun.TLS != nil {
+		return TRANSPORT_TLS
+	}
+	return TRANSPORT_TCP
+}
+
+func (tun *StreamTunnel) MTU() uint32 {
+	return tun.mtu
+}
+
+func (tun *StreamTunnel) Stats() (uint64, uint64) {
+	return atomic.LoadUint64(&tun.RxStat), atomic.LoadUint64(&tun.WxStat)
+}
+
+// PeerAddr : Endpoint port belongs to primary transport. Fallback stream always uses its own port.
+func (tun *StreamTunnel) PeerAddr(ep *protocol.Endpoint) net.Addr {
+	port := ep.Port
+	if port == 0 || tun.fallback {
+		port = tun.Port
+	}
+	return &net.TCPAddr{IP: ep.IP, Port: int(port)}
+}
+
+func (tun *StreamTunnel) NewPacket(payload_size uint) protocol.TunnelPacket {
+	pkt := make(StreamTunnelPacket, payload_size)
+	return &pkt
+}
+
+func (tun *StreamTunnel) Handler(handler func(tun NetTunnel, pkt protocol.TunnelPacket, from net.Addr)) error {
+	tun.lock.Lock()
+	tun.handler = handler
+	tun.lock.Unlock()
+	return nil
+}
+
+func (tun *StreamTunnel) Start() error {
+	if !atomic.CompareAndSwapUint32(&tun.running, 0, 1) {
+		return nil
+	}
+	tun.wait.Add(1)
+	go tun.accept()
+	return nil
+}
+
+func (tun *StreamTunnel) Stop() error {
+	if !atomic.CompareAndSwapUint32(&tun.running, 1, 0) {
+		return fmt.Errorf("Not running.")
+	}
+
+	tun.listener.Close()
+	tun.lock.Lock()
+	for _, peer := range tun.peers {
+		if peer.conn != nil {
+			peer.conn.Close()
+		}
+	}
+	tun.lock.Unlock()
+
+	tun.wait.Wait()
+	return nil
+}
+
+func (tun *StreamTunnel) Destroy() error {
+	if err := tun.Stop(); err == nil {
+		return nil
+	}
+	return tun.listener.Close()
+}
+
+func (tun *StreamTunnel) accept() {
+	defer tun.wait.Done()
+
+	var backoff time.Duration
+	for atomic.LoadUint32(&tun.running) > 0 {
+		conn, err := tun.listener.Accept()
+		if err != nil {
+			if atomic.LoadUint32(&tun.running) == 0 {
+				break
+			}
+			if backoff == 0 {
+				backoff = STREAM_ACCEPT_BACKOFF_MIN
+			} else if backoff *= 2; backoff > STREAM_ACCEPT_BACKOFF_MAX {
+				backoff = STREAM_ACCEPT_BACKOFF_MAX
+			}
+			log.WithFields(log.Fields{
+				"module":     "StreamTunnel",
+				"event":      "accept",
+				"err_detail": err.Error(),
+			}).Warningf("Cannot accept connection. Retry in %v.", backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		if tun.TLS != nil {
+			conn = tls.Server(conn, tun.TLS)
+		}
+
+		from := conn.RemoteAddr()
+		peer := &streamPeer{
+			conn:    conn,
+			inbound: true,
+		}
+		if tcp_addr, ok := from.(*net.TCPAddr); ok {
+			peer.ip = tcp_addr.IP
+		}
+
+		tun.lock.Lock()
+		tun.peers[from.String()] = peer
+		tun.lock.Unlock()
+
+		tun.wait.Add(1)
+		go tun.serve(from.String(), peer, conn, from)
+	}
+}
+
+// serve : Read frames from connection until it breaks.
+func (tun *StreamTunnel) serve(key string, peer *streamPeer, conn net.Conn, from net.Addr) {
+	defer tun.wait.Done()
+
+	header := make([]byte, protocol.OVT_HEADER_SIZE)
+	for atomic.LoadUint32(&tun.running) > 0 {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			break
+		}
+		size := binary.BigEndian.Uint32(header[8:12])
+		if !bytes.Equal(header[0:4], protocol.OVT_MAGIC[:]) || size < protocol.OVT_HEADER_SIZE || size > STREAM_MAX_FRAME {
+			log.WithFields(log.Fields{
+				"module": "StreamTunnel",
+				"event":  "packet",
+			}).Warningf("Bad frame from %v. Close connection.", from.String())
+			break
+		}
+
+		frame := make([]byte, size)
+		copy(frame, header)
+		if _, err := io.ReadFull(conn, frame[protocol.OVT_HEADER_SIZE:]); err != nil {
+			break
+		}
+		atomic.AddUint64(&tun.RxStat, uint64(size))
+
+		tun.lock.Lock()
+		handler := tun.handler
+		tun.lock.Unlock()
+		if handler != nil {
+			handler(tun, StreamTunnelPacket(frame), from)
+		}
+	}
+
+	tun.drop(key, peer, conn)
+}
+
+func (tun *StreamTunnel) drop(key string, peer *streamPeer, conn net.Conn) {
+	tun.lock.Lock()
+	defer tun.lock.Unlock()
+
+	conn.Close()
+	if peer.conn == conn {
+		peer.conn = nil
+	}
+	if peer.inbound {
+		delete(tun.peers, key)
+	}
+}
+
+// connection : Find connection to address. Dial in background if none.
+func (tun *StreamTunnel) connection(address net.Addr) (*streamPeer, net.Conn) {
+	key := address.String()
+
+	tun.lock.Lock()
+	defer tun.lock.Unlock()
+
+	peer, ok := tun.peers[key]
+	if ok && peer.conn != nil {
+		return peer, peer.conn
+	}
+
+	// reuse inbound connection from the same host.
+	if tcp_addr, is_tcp := address.(*net.TCPAddr); is_tcp {
+		for _, inbound := range tun.peers {
+			if inbound.inbound && inbound.conn != nil && inbound.ip.Equal(tcp_addr.IP) {
+				return inbound, inbound.conn
+			}
+		}
+	}
+
+	if !ok {
+		peer = &streamPeer{backoff: STREAM_BACKOFF_MIN}
+		tun.peers[key] = peer
+	}
+	if !peer.dialing && time.Now().After(peer.next_dial) && atomic.LoadUint32(&tun.running) > 0 {
+		peer.dialing = true
+		go tun.dial(key, peer, address)
+	}
+
+	return nil, nil
+}
+
+func (tun *StreamTunnel) dial(key string, peer *streamPeer, address net.Addr) {
+	var conn net.Conn
+	var err error
+
+	dialer := &net.Dialer{Timeout: STREAM_DIAL_TIMEOUT}
+	if tun.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address.String(), tun.TLS)
+	} else {
+		conn, err = dialer.Dial("tcp", address.String())
+	}
+
+	tun.lock.Lock()
+	defer tun.lock.Unlock()
+
+	peer.dialing = false
+	if err != nil {
+		peer.next_dial = time.Now().Add(peer.backoff)
+		log.WithFields(log.Fields{
+			"module":     "StreamTunnel",
+			"event":      "connect",
+			"err_detail": err.Error(),
+		}).Warningf("Cannot connect to %v. Retry in %v.", key, peer.backoff)
+
+		peer.backoff *= 2
+		if peer.backoff > STREAM_BACKOFF_MAX {
+			peer.backoff = STREAM_BACKOFF_MAX
+		}
+		return
+	}
+	if atomic.LoadUint32(&tun.running) == 0 {
+		conn.Close()
+		return
+	}
+
+	peer.conn = conn
+	peer.backoff = STREAM_BACKOFF_MIN
+	tun.wait.Add(1)
+	go tun.serve(key, peer, conn, address)
+}
+
+func (tun *StreamTunnel) Write(packet protocol.TunnelPacket, address net.Addr) (int, error) {
+	pkt, ok := packet.(*StreamTunnelPacket)
+	if !ok {
+		return 0, errors.New("Not a stream tunnel packet")
+	}
+
+	peer, conn := tun.connection(address)
+	if conn == nil {
+		return 0, errors.New(ERR_STREAM_NOT_CONNECTED)
+	}
+
+	peer.write_lock.Lock()
+	conn.SetWriteDeadline(time.Now().Add(STREAM_WRITE_TIMEOUT))
+	wx, err := conn.Write((*pkt)[:])
+	peer.write_lock.Unlock()
+
+	atomic.AddUint64(&tun.WxStat, uint64(wx))
+	if err != nil {
+		conn.Close()
+	}
+	return wx, err
+}
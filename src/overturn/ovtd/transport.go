@@ -0,0 +1,221 @@
+package ovtd
+
+import (
+	"crypto/tls"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net"
+	"overturn/protocol"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	TRANSPORT_ICMP = "icmp"
+	TRANSPORT_UDP  = "udp"
+	TRANSPORT_TCP  = "tcp"
+	TRANSPORT_TLS  = "tls"
+
+	DEFAULT_TRANSPORT = TRANSPORT_ICMP
+)
+
+// NetTunnel : Underlay transport carrying OVT packets between nodes.
+type NetTunnel interface {
+	Name() string
+	NewPacket(payload_size uint) protocol.TunnelPacket
+	Write(packet protocol.TunnelPacket, address net.Addr) (int, error)
+	Handler(handler func(tun NetTunnel, pkt protocol.TunnelPacket, from net.Addr)) error
+	PeerAddr(ep *protocol.Endpoint) net.Addr
+	Start() error
+	Stop() error
+	Destroy() error
+
+	// MTU : Max OVT packet size carried by one underlay packet without IP fragmentation.
+	MTU() uint32
+
+	// Stats : Received and sent bytes.
+	Stats() (uint64, uint64)
+}
+
+// PathMTUReporter : Transport reporting path MTU feedback from underlay, such as ICMP fragmentation needed.
+// Reported MTU is max OVT packet size to the address.
+type PathMTUReporter interface {
+	OnPathMTU(handler func(ip net.IP, mtu uint32))
+}
+
+// set_dont_fragment : Send datagrams with DF set. Packets exceeding known path MTU fail with EMSGSIZE
+// instead of being fragmented. Both IPv4 and IPv6 options are tried, since dual-stack sockets carry both.
+func set_dont_fragment(conn interface{}) error {
+	sys_conn, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("Socket options not supported.")
+	}
+	raw, err := sys_conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var err4, err6 error
+	if err = raw.Control(func(fd uintptr) {
+		err4 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+		err6 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
+	}); err != nil {
+		return err
+	}
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+	return nil
+}
+
+// NewNetTunnel : Create transport specified by network configure.
+func NewNetTunnel(config *NetworkClusterYAML) (NetTunnel, error) {
+	transport := config.Transport
+	if transport == "" {
+		transport = DEFAULT_TRANSPORT
+	}
+	return new_transport(transport, config, false)
+}
+
+// NewFallbackTunnel : Create stream transport used when datagrams get no reply.
+// Return nil if no fallback configured.
+func NewFallbackTunnel(config *NetworkClusterYAML) (NetTunnel, error) {
+	switch config.Fallback {
+	case "":
+		return nil, nil
+	case TRANSPORT_TCP, TRANSPORT_TLS:
+		return new_transport(config.Fallback, config, true)
+	}
+	return nil, fmt.Errorf("Transport %v cannot be a fallback.", config.Fallback)
+}
+
+func new_transport(transport string, config *NetworkClusterYAML, fallback bool) (NetTunnel, error) {
+	switch transport {
+	case TRANSPORT_ICMP:
+		tun, err := NewICMPTunnel("")
+		if err != nil {
+			return nil, err
+		}
+		return tun, nil
+
+	case TRANSPORT_UDP:
+		tun, err := NewUDPTunnel("", config.Port)
+		if err != nil {
+			return nil, err
+		}
+		return tun, nil
+
+	case TRANSPORT_TCP, TRANSPORT_TLS:
+		var tls_config *tls.Config
+		var err error
+
+		port := config.StreamPort
+		if !fallback && port == 0 {
+			port = config.Port
+		}
+		if transport == TRANSPORT_TLS {
+			if tls_config, err = LoadTLSConfig(config); err != nil {
+				return nil, err
+			}
+		}
+		tun, err := NewStreamTunnel("", port, tls_config, fallback)
+		if err != nil {
+			return nil, err
+		}
+		return tun, nil
+	}
+
+	return nil, fmt.Errorf("Unknown transport %v.", transport)
+}
+
+// listen_ports : Ports transports of network configure listen on, defaults resolved as transports do.
+func listen_ports(config *NetworkClusterYAML) []CapturePort {
+	ports := make([]CapturePort, 0, 2)
+	for idx, transport := range []string{config.Transport, config.Fallback} {
+		switch transport {
+		case TRANSPORT_UDP:
+			port := config.Port
+			if port == 0 {
+				port = DEFAULT_UDP_PORT
+			}
+			ports = append(ports, CapturePort{Proto: syscall.IPPROTO_UDP, Port: port})
+		case TRANSPORT_TCP, TRANSPORT_TLS:
+			port := config.StreamPort
+			if idx == 0 && port == 0 {
+				port = config.Port
+			}
+			if port == 0 {
+				port = DEFAULT_STREAM_PORT
+			}
+			ports = append(ports, CapturePort{Proto: syscall.IPPROTO_TCP, Port: port})
+		}
+	}
+	return ports
+}
+
+const (
+	LINK_MIN_MTU = 576
+	LINK_MAX_MTU = protocol.FRAGMENT_MAX_SIZE
+)
+
+// link_mtu : MTU of link device. Default is the inner packet size that fits in one sealed tunnel packet
+// over the narrowest path. Larger inner packets are fragmented.
+func (nm *ClusterManager) link_mtu() int {
+	mtu := int(nm.Config.MTU)
+	if mtu == 0 {
+		mtu = int(nm.min_path_mtu()) - protocol.SECURE_OVERHEAD
+	}
+	if mtu < LINK_MIN_MTU {
+		mtu = LINK_MIN_MTU
+	} else if mtu > LINK_MAX_MTU {
+		mtu = LINK_MAX_MTU
+	}
+	return mtu
+}
+
+// route_tunnel : Tunnel to reach node.
+func (nm *ClusterManager) route_tunnel(node *NetworkNode) NetTunnel {
+	if nm.Fallback != nil && atomic.LoadUint32(&node.Fallback) > 0 {
+		return nm.Fallback
+	}
+	return nm.NetTun
+}
+
+// update_fallback : Switch node to fallback tunnel if datagrams get no heartbeat back.
+func (nm *ClusterManager) update_fallback(node *NetworkNode, now time.Time) {
+	timeout := time.Duration(nm.Info.HeartbeatTimeout) * time.Millisecond
+
+	var fallback uint32 = 0
+	if now.Sub(node.LastDatagram) > timeout {
+		fallback = 1
+	}
+	if atomic.SwapUint32(&node.Fallback, fallback) == fallback {
+		return
+	}
+
+	entry := log.WithFields(log.Fields{
+		"module":  "ClusterManager",
+		"event":   "transport",
+		"node_id": node.ID.String(),
+	})
+	if fallback > 0 {
+		entry.Warningf("No heartbeat from %v over %v. Fall back to %v.", node.Name, nm.NetTun.Name(), nm.Fallback.Name())
+	} else {
+		entry.Infof("Heartbeat from %v over %v recovered.", node.Name, nm.NetTun.Name())
+	}
+}
+
+// tunnel_ignore_ports : Ports of tunnel traffic excluded from capture.
+func (nm *ClusterManager) tunnel_ignore_ports() []CapturePort {
+	ports := make([]CapturePort, 0, 3)
+	for _, tun := range []NetTunnel{nm.NetTun, nm.Fallback} {
+		switch t := tun.(type) {
+		case *UDPTunnel:
+			ports = append(ports, CapturePort{Proto: syscall.IPPROTO_UDP, Port: t.Port})
+		case *StreamTunnel:
+			ports = append(ports, CapturePort{Proto: syscall.IPPROTO_TCP, Port: t.Port})
+			ports = append(ports, CapturePort{Proto: syscall.IPPROTO_TCP, Port: t.Port, Dst: true})
+		}
+	}
+	return ports
+}
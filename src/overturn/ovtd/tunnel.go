@@ -21,7 +21,7 @@ type LinkTunnel struct {
 	stopSig      chan int
 }
 
-func NewLinkTunnel(name string, queues int) (*LinkTunnel, error) {
+func NewLinkTunnel(name string, queues int, mtu int) (*LinkTunnel, error) {
 	var err error
 
 	tun := &LinkTunnel{Link: netlink.Tuntap{
@@ -45,18 +45,10 @@ func NewLinkTunnel(name string, queues int) (*LinkTunnel, error) {
 		return nil, err
 	}
 
-	if err = tun.SetMTU(1472); err != nil {
+	if err = tun.SetMTU(mtu); err != nil {
 		return nil, err
 	}
 
-	//disable ipv6
-	var file *os.File
-	if file, err = os.OpenFile("/proc/sys/net/ipv6/conf/"+name+"/disable_ipv6", os.O_RDWR, 0); err != nil {
-		return nil, err
-	}
-	file.Write([]byte{'1'})
-	file.Close()
-
 	//if err = tun.update_attrs(); err != nil {
 	//	return nil, err
 	//}
@@ -146,6 +138,13 @@ func (tun *LinkTunnel) SetMTU(mtu int) error {
 	return tun.update_attrs()
 }
 
+func (tun *LinkTunnel) SetAlias(alias string) error {
+	if err := netlink.LinkSetAlias(&tun.Link, alias); err != nil {
+		return err
+	}
+	return tun.update_attrs()
+}
+
 func (tun *LinkTunnel) Up() error {
 	return netlink.LinkSetUp(&tun.Link)
 }
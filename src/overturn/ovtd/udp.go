@@ -0,0 +1,144 @@
+package ovtd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"overturn/protocol"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_UDP_PORT = 4279
+	UDP_MAX_DATAGRAM = 65507
+)
+
+// UDPTunnel : Carry OVT packets in UDP datagrams.
+type UDPTunnel struct {
+	RxStat uint64
+	WxStat uint64
+	Port   uint16
+
+	mtu          uint32
+	worker_count uint32
+	running      uint32
+	conn         *net.UDPConn
+	sigStop      chan int
+}
+
+type UDPTunnelPacket []byte
+
+func (pkt UDPTunnelPacket) PayloadRef() []byte {
+	return pkt
+}
+
+func NewUDPTunnel(address string, port uint16) (*UDPTunnel, error) {
+	var err error
+
+	if port == 0 {
+		port = DEFAULT_UDP_PORT
+	}
+
+	tun := &UDPTunnel{
+		RxStat:  0,
+		WxStat:  0,
+		Port:    port,
+		mtu:     1500 - 40 - 8, // Header: IPv6(40byte) + UDP(8Byte)
+		sigStop: make(chan int),
+	}
+
+	// Wildcard address listens on both IPv4 and IPv6 if available.
+	tun.conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(address), Port: int(port)})
+	if err != nil {
+		return nil, err
+	}
+	if err = set_dont_fragment(tun.conn); err != nil {
+		tun.conn.Close()
+		return nil, err
+	}
+	return tun, nil
+}
+
+func (tun *UDPTunnel) Name() string {
+	return TRANSPORT_UDP
+}
+
+func (tun *UDPTunnel) MTU() uint32 {
+	return tun.mtu
+}
+
+func (tun *UDPTunnel) Stats() (uint64, uint64) {
+	return atomic.LoadUint64(&tun.RxStat), atomic.LoadUint64(&tun.WxStat)
+}
+
+func (tun *UDPTunnel) PeerAddr(ep *protocol.Endpoint) net.Addr {
+	port := ep.Port
+	if port == 0 {
+		port = tun.Port
+	}
+	return &net.UDPAddr{IP: ep.IP, Port: int(port)}
+}
+
+func (tun *UDPTunnel) NewPacket(payload_size uint) protocol.TunnelPacket {
+	pkt := make(UDPTunnelPacket, payload_size)
+	return &pkt
+}
+
+func (tun *UDPTunnel) Destroy() error {
+	tun.Stop()
+	return tun.conn.Close()
+}
+
+func (tun *UDPTunnel) Handler(handler func(tun NetTunnel, pkt protocol.TunnelPacket, from net.Addr)) error {
+	atomic.AddUint32(&tun.worker_count, 1)
+	go func() {
+		buf := make([]byte, UDP_MAX_DATAGRAM)
+
+		for atomic.LoadUint32(&tun.running) > 0 {
+			tun.conn.SetReadDeadline(time.Now().Add(time.Second))
+			sz, from, err := tun.conn.ReadFrom(buf)
+			if err != nil {
+				continue
+			}
+
+			atomic.AddUint64(&tun.RxStat, uint64(sz))
+			handler(tun, UDPTunnelPacket(buf[:sz]), from)
+		}
+
+		last := atomic.AddUint32(&tun.worker_count, 0xFFFFFFFF) // -1
+		if last == 0 {
+			tun.sigStop <- 0
+		}
+	}()
+
+	return nil
+}
+
+func (tun *UDPTunnel) Write(packet protocol.TunnelPacket, address net.Addr) (int, error) {
+	pkt, ok := packet.(*UDPTunnelPacket)
+	if !ok {
+		return 0, errors.New("Not a udp tunnel packet")
+	}
+
+	wx, err := tun.conn.WriteTo((*pkt)[:], address)
+	atomic.AddUint64(&tun.WxStat, uint64(wx))
+	return wx, err
+}
+
+func (tun *UDPTunnel) Start() error {
+	atomic.CompareAndSwapUint32(&tun.running, 0, 1)
+	return nil
+}
+
+func (tun *UDPTunnel) Stop() error {
+	if !atomic.CompareAndSwapUint32(&tun.running, 1, 0) {
+		return fmt.Errorf("Not running.")
+	}
+
+	// wait until all readers are stopped
+	if atomic.LoadUint32(&tun.worker_count) > 0 {
+		<-tun.sigStop
+	}
+	return nil
+}
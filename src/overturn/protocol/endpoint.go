@@ -0,0 +1,173 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Endpoint : Publish address of node. Port 0 means transport default.
+type Endpoint struct {
+	IP   net.IP
+	Port uint16
+}
+
+const (
+	ENDPOINT_SIZE = net.IPv6len + 2
+)
+
+// ParseEndpoint : Parse "ip", "ip:port" or "[ipv6]:port".
+func ParseEndpoint(raw string) (*Endpoint, error) {
+	if ip := net.ParseIP(raw); ip != nil {
+		return &Endpoint{IP: ip}, nil
+	}
+
+	host, port_raw, err := net.SplitHostPort(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid endpoint %v: %v", raw, err.Error())
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid IP Address %v.", host)
+	}
+	port, err := strconv.ParseUint(port_raw, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port %v.", port_raw)
+	}
+	return &Endpoint{IP: ip, Port: uint16(port)}, nil
+}
+
+func (ep *Endpoint) String() string {
+	if ep.Port == 0 {
+		return ep.IP.String()
+	}
+	return net.JoinHostPort(ep.IP.String(), strconv.Itoa(int(ep.Port)))
+}
+
+func (ep *Endpoint) Place(buf []byte) error {
+	if len(buf) < ENDPOINT_SIZE {
+		return errors.New(ERR_BUFFER_SMALL)
+	}
+	copy(buf[0:net.IPv6len], ep.IP.To16())
+	binary.BigEndian.PutUint16(buf[net.IPv6len:ENDPOINT_SIZE], ep.Port)
+	return nil
+}
+
+func (ep *Endpoint) Unmarshal(buf []byte) error {
+	if len(buf) < ENDPOINT_SIZE {
+		return fmt.Errorf("Not a valid Endpoint.")
+	}
+	ep.IP = make(net.IP, net.IPv6len)
+	copy(ep.IP, buf[0:net.IPv6len])
+	if ip4 := ep.IP.To4(); ip4 != nil {
+		ep.IP = ip4
+	}
+	ep.Port = binary.BigEndian.Uint16(buf[net.IPv6len:ENDPOINT_SIZE])
+	return nil
+}
+
+// placeEndpoints : Place endpoint list prefixed by count.
+func placeEndpoints(buf []byte, endpoints []*Endpoint) (int, error) {
+	if len(endpoints) > 0xFF {
+		return 0, fmt.Errorf("Too many endpoints.")
+	}
+	if len(buf) < 1+len(endpoints)*ENDPOINT_SIZE {
+		return 0, errors.New(ERR_BUFFER_SMALL)
+	}
+	buf[0] = uint8(len(endpoints))
+	offset := 1
+	for _, ep := range endpoints {
+		ep.Place(buf[offset:])
+		offset += ENDPOINT_SIZE
+	}
+	return offset, nil
+}
+
+// unmarshalEndpoints : Decode endpoint list prefixed by count.
+func unmarshalEndpoints(buf []byte) ([]*Endpoint, int, error) {
+	if len(buf) < 1 {
+		return nil, 0, fmt.Errorf("Not a valid endpoint list.")
+	}
+	count := int(buf[0])
+	if len(buf) < 1+count*ENDPOINT_SIZE {
+		return nil, 0, fmt.Errorf("Not a valid endpoint list. (truncated)")
+	}
+	endpoints := make([]*Endpoint, 0, count)
+	offset := 1
+	for ; count > 0; count-- {
+		ep := new(Endpoint)
+		ep.Unmarshal(buf[offset:])
+		endpoints = append(endpoints, ep)
+		offset += ENDPOINT_SIZE
+	}
+	return endpoints, offset, nil
+}
+
+const (
+	PREFIX_SIZE = net.IPv6len + 1
+)
+
+// ParsePrefix : Parse CIDR prefix. Bare IP means a host prefix.
+func ParsePrefix(raw string) (*net.IPNet, error) {
+	if ip := net.ParseIP(raw); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, prefix, err := net.ParseCIDR(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid prefix %v: %v", raw, err.Error())
+	}
+	return prefix, nil
+}
+
+// placePrefixes : Place prefix list prefixed by count. Prefix is address(16) and length(1).
+// Length of IPv4 prefix counts in IPv4 bits.
+func placePrefixes(buf []byte, prefixes []*net.IPNet) (int, error) {
+	if len(prefixes) > 0xFF {
+		return 0, fmt.Errorf("Too many prefixes.")
+	}
+	if len(buf) < 1+len(prefixes)*PREFIX_SIZE {
+		return 0, errors.New(ERR_BUFFER_SMALL)
+	}
+	buf[0] = uint8(len(prefixes))
+	offset := 1
+	for _, prefix := range prefixes {
+		ones, _ := prefix.Mask.Size()
+		copy(buf[offset:offset+net.IPv6len], prefix.IP.To16())
+		buf[offset+net.IPv6len] = uint8(ones)
+		offset += PREFIX_SIZE
+	}
+	return offset, nil
+}
+
+// unmarshalPrefixes : Decode prefix list prefixed by count.
+func unmarshalPrefixes(buf []byte) ([]*net.IPNet, int, error) {
+	if len(buf) < 1 {
+		return nil, 0, fmt.Errorf("Not a valid prefix list.")
+	}
+	count := int(buf[0])
+	if len(buf) < 1+count*PREFIX_SIZE {
+		return nil, 0, fmt.Errorf("Not a valid prefix list. (truncated)")
+	}
+	prefixes := make([]*net.IPNet, 0, count)
+	offset := 1
+	for ; count > 0; count-- {
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, buf[offset:offset+net.IPv6len])
+		ones, bits := int(buf[offset+net.IPv6len]), 8*net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		if ones > bits {
+			return nil, 0, fmt.Errorf("Not a valid prefix length %v.", ones)
+		}
+		mask := net.CIDRMask(ones, bits)
+		prefixes = append(prefixes, &net.IPNet{IP: ip.Mask(mask), Mask: mask})
+		offset += PREFIX_SIZE
+	}
+	return prefixes, offset, nil
+}
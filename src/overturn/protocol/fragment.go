@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Fragment : Part of an inner packet too large for one tunnel packet.
+// +--------+--------+
+// |   ID (+0)       |
+// +--------+--------+
+// | Offset | Flags  |
+// |  (+4)  |  (+6)  |
+// +--------+--------+
+// |   Data (+8)     |
+// +-----------------+
+//
+// Each fragment is sealed and sequenced as a separate packet.
+type Fragment struct {
+	ID     uint32
+	Offset uint16
+	Last   bool
+	Data   []byte
+}
+
+const (
+	FRAGMENT_HEADER_SIZE = 8
+	FRAGMENT_MAX_SIZE    = 0xFFFF
+
+	FRAGMENT_FLAG_LAST = 0x1
+)
+
+func (m *Fragment) Type() uint16 {
+	return FRAGMENT
+}
+
+func (m *Fragment) Marshal() []byte {
+	buf := make([]byte, m.Size())
+	m.Place(buf)
+	return buf
+}
+
+func (m *Fragment) Place(buf []byte) error {
+	if uint(len(buf)) < m.Size() {
+		return errors.New(ERR_BUFFER_SMALL)
+	}
+	if int(m.Offset)+len(m.Data) > FRAGMENT_MAX_SIZE {
+		return fmt.Errorf("Fragment exceeds max packet size.")
+	}
+	var flags uint16 = 0
+	if m.Last {
+		flags |= FRAGMENT_FLAG_LAST
+	}
+	binary.BigEndian.PutUint32(buf[0:4], m.ID)
+	binary.BigEndian.PutUint16(buf[4:6], m.Offset)
+	binary.BigEndian.PutUint16(buf[6:8], flags)
+	copy(buf[FRAGMENT_HEADER_SIZE:], m.Data)
+	return nil
+}
+
+// Unmarshal : Data refers to buf.
+func (m *Fragment) Unmarshal(buf []byte) error {
+	if len(buf) < FRAGMENT_HEADER_SIZE {
+		return fmt.Errorf("Not a valid Fragment message.")
+	}
+	m.ID = binary.BigEndian.Uint32(buf[0:4])
+	m.Offset = binary.BigEndian.Uint16(buf[4:6])
+	m.Last = binary.BigEndian.Uint16(buf[6:8])&FRAGMENT_FLAG_LAST != 0
+	m.Data = buf[FRAGMENT_HEADER_SIZE:]
+	if int(m.Offset)+len(m.Data) > FRAGMENT_MAX_SIZE {
+		return fmt.Errorf("Fragment exceeds max packet size.")
+	}
+	return nil
+}
+
+func (m *Fragment) Size() uint {
+	return uint(FRAGMENT_HEADER_SIZE + len(m.Data))
+}
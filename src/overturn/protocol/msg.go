@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"net"
 )
 
 const (
@@ -12,7 +13,7 @@ const (
 )
 
 type Message interface {
-	Type() uint8
+	Type() uint16
 	Marshal() []byte
 	Place([]byte) error
 	Unmarshal([]byte) error
@@ -21,10 +22,20 @@ type Message interface {
 
 // Join : Join a network
 type JoinRequest struct {
-	Name  [16]byte
-	Token uuid.UUID
+	Name      [16]byte
+	Token     uuid.UUID
+	Node      uuid.UUID
+	Key       [32]byte
+	Identity  [32]byte
+	Publish   []*Endpoint
+	Prefixes  []*net.IPNet
+	Signature [SIGNATURE_SIZE]byte
 }
 
+const (
+	JOIN_REQUEST_FIXED_SIZE = 16 + 16 + 16 + 32 + 32 + 1 + 1 + SIGNATURE_SIZE
+)
+
 func NewJoinRequest(network_name string, token uuid.UUID) *JoinRequest {
 	m := new(JoinRequest)
 	copy(m.Name[:], network_name)
@@ -32,12 +43,12 @@ func NewJoinRequest(network_name string, token uuid.UUID) *JoinRequest {
 	return m
 }
 
-func (m *JoinRequest) Type() uint8 {
+func (m *JoinRequest) Type() uint16 {
 	return JOIN_REQUEST
 }
 
 func (m *JoinRequest) Marshal() []byte {
-	buf := make([]byte, 16+16)
+	buf := make([]byte, m.Size())
 	m.Place(buf)
 	return buf
 }
@@ -48,25 +59,244 @@ func (m *JoinRequest) Place(buf []byte) error {
 	}
 	copy(buf[0:16], m.Name[:])
 	copy(buf[16:32], m.Token[:])
+	copy(buf[32:48], m.Node[:])
+	copy(buf[48:80], m.Key[:])
+	copy(buf[80:112], m.Identity[:])
+	offset := 112
+	placed, err := placeEndpoints(buf[offset:], m.Publish)
+	if err != nil {
+		return err
+	}
+	offset += placed
+	if placed, err = placePrefixes(buf[offset:], m.Prefixes); err != nil {
+		return err
+	}
+	offset += placed
+	copy(buf[offset:], m.Signature[:])
 	return nil
 }
 
 func (m *JoinRequest) Unmarshal(buf []byte) error {
-	if uint(len(buf)) != m.Size() {
+	var err error
+	var consumed int
+
+	if len(buf) < JOIN_REQUEST_FIXED_SIZE {
 		return fmt.Errorf("Not a valid JoinRequest message. (buffered: %v)", len(buf))
 	}
 	copy(m.Name[:], buf[0:16])
 	copy(m.Token[:], buf[16:32])
+	copy(m.Node[:], buf[32:48])
+	copy(m.Key[:], buf[48:80])
+	copy(m.Identity[:], buf[80:112])
+	offset := 112
+	if m.Publish, consumed, err = unmarshalEndpoints(buf[offset : len(buf)-SIGNATURE_SIZE]); err != nil {
+		return err
+	}
+	offset += consumed
+	if m.Prefixes, consumed, err = unmarshalPrefixes(buf[offset : len(buf)-SIGNATURE_SIZE]); err != nil {
+		return err
+	}
+	offset += consumed
+	if len(buf) != offset+SIGNATURE_SIZE {
+		return fmt.Errorf("Not a valid JoinRequest message. (buffered: %v)", len(buf))
+	}
+	copy(m.Signature[:], buf[offset:])
 	return nil
 }
 
 func (m *JoinRequest) Size() uint {
-	return uint(16 + 16)
+	return uint(JOIN_REQUEST_FIXED_SIZE + len(m.Publish)*ENDPOINT_SIZE + len(m.Prefixes)*PREFIX_SIZE)
+}
+
+// SignedBytes : Joiner proves possession of its identity key.
+func (m *JoinRequest) SignedBytes() []byte {
+	unsigned := *m
+	unsigned.Signature = [SIGNATURE_SIZE]byte{}
+	return unsigned.Marshal()
+}
+
+func (m *JoinRequest) SignatureRef() []byte {
+	return m.Signature[:]
+}
+
+// NodeRecord : Membership record of node.
+type NodeRecord struct {
+	ID       uuid.UUID
+	Key      [32]byte
+	Identity [32]byte
+	Name     string
+	Publish  []*Endpoint
+	Prefixes []*net.IPNet
+}
+
+func (r *NodeRecord) Size() uint {
+	return uint(16 + 32 + 32 + 1 + len(r.Name) + 1 + len(r.Publish)*ENDPOINT_SIZE + 1 + len(r.Prefixes)*PREFIX_SIZE)
+}
+
+func (r *NodeRecord) Place(buf []byte) error {
+	if uint(len(buf)) < r.Size() {
+		return errors.New(ERR_BUFFER_SMALL)
+	}
+	if len(r.Name) > 0xFF || len(r.Publish) > 0xFF {
+		return fmt.Errorf("NodeRecord too large.")
+	}
+	copy(buf[0:16], r.ID[:])
+	copy(buf[16:48], r.Key[:])
+	copy(buf[48:80], r.Identity[:])
+	offset := 80
+	buf[offset] = uint8(len(r.Name))
+	offset++
+	copy(buf[offset:offset+len(r.Name)], r.Name)
+	offset += len(r.Name)
+	placed, err := placeEndpoints(buf[offset:], r.Publish)
+	if err != nil {
+		return err
+	}
+	_, err = placePrefixes(buf[offset+placed:], r.Prefixes)
+	return err
+}
+
+// Unmarshal : Decode record from head of buffer. Return bytes consumed.
+func (r *NodeRecord) Unmarshal(buf []byte) (int, error) {
+	if len(buf) < 83 {
+		return 0, fmt.Errorf("Not a valid NodeRecord.")
+	}
+	copy(r.ID[:], buf[0:16])
+	copy(r.Key[:], buf[16:48])
+	copy(r.Identity[:], buf[48:80])
+	offset := 80
+	name_len := int(buf[offset])
+	offset++
+	if len(buf) < offset+name_len+1 {
+		return 0, fmt.Errorf("Not a valid NodeRecord. (truncated name)")
+	}
+	r.Name = string(buf[offset : offset+name_len])
+	offset += name_len
+	publish, consumed, err := unmarshalEndpoints(buf[offset:])
+	if err != nil {
+		return 0, err
+	}
+	offset += consumed
+	prefixes, consumed, err := unmarshalPrefixes(buf[offset:])
+	if err != nil {
+		return 0, err
+	}
+	r.Publish = publish
+	r.Prefixes = prefixes
+	return offset + consumed, nil
+}
+
+// JoinResponse : Result of join request.
+// Membership snapshot may be splited into several responses. Joiner collects
+// them until Total records are received.
+// MAC is keyed by join token of request, so only who knows the token can answer.
+type JoinResponse struct {
+	NetName [16]byte
+	Status  uint8
+	Master  uuid.UUID
+	Node    uuid.UUID
+	Term    uint64
+	Index   uint64
+	Total   uint16
+	MAC     [JOIN_MAC_SIZE]byte
+	Nodes   []*NodeRecord
+}
+
+const (
+	JOIN_MAC_SIZE            = 32
+	JOIN_RESPONSE_FIXED_SIZE = 16 + 1 + 16 + 16 + 8 + 8 + 2 + JOIN_MAC_SIZE + 1
+)
+
+func NewJoinResponse(network_name string, status uint8) *JoinResponse {
+	m := &JoinResponse{
+		Status: status,
+	}
+	copy(m.NetName[:], network_name)
+	return m
+}
+
+func (m *JoinResponse) Type() uint16 {
+	return JOIN_RESPONSE
+}
+
+func (m *JoinResponse) Marshal() []byte {
+	buf := make([]byte, m.Size())
+	m.Place(buf)
+	return buf
+}
+
+func (m *JoinResponse) Place(buf []byte) error {
+	if uint(len(buf)) < m.Size() {
+		return errors.New(ERR_BUFFER_SMALL)
+	}
+	if len(m.Nodes) > 0xFF {
+		return fmt.Errorf("Too many records in JoinResponse.")
+	}
+	copy(buf[0:16], m.NetName[:])
+	buf[16] = m.Status
+	copy(buf[17:33], m.Master[:])
+	copy(buf[33:49], m.Node[:])
+	binary.BigEndian.PutUint64(buf[49:57], m.Term)
+	binary.BigEndian.PutUint64(buf[57:65], m.Index)
+	binary.BigEndian.PutUint16(buf[65:67], m.Total)
+	copy(buf[67:99], m.MAC[:])
+	buf[99] = uint8(len(m.Nodes))
+	offset := uint(JOIN_RESPONSE_FIXED_SIZE)
+	for _, record := range m.Nodes {
+		if err := record.Place(buf[offset:]); err != nil {
+			return err
+		}
+		offset += record.Size()
+	}
+	return nil
+}
+
+func (m *JoinResponse) Unmarshal(buf []byte) error {
+	if len(buf) < JOIN_RESPONSE_FIXED_SIZE {
+		return fmt.Errorf("Not a valid JoinResponse message.")
+	}
+	copy(m.NetName[:], buf[0:16])
+	m.Status = buf[16]
+	copy(m.Master[:], buf[17:33])
+	copy(m.Node[:], buf[33:49])
+	m.Term = binary.BigEndian.Uint64(buf[49:57])
+	m.Index = binary.BigEndian.Uint64(buf[57:65])
+	m.Total = binary.BigEndian.Uint16(buf[65:67])
+	copy(m.MAC[:], buf[67:99])
+	count := int(buf[99])
+	m.Nodes = make([]*NodeRecord, 0, count)
+	offset := JOIN_RESPONSE_FIXED_SIZE
+	for ; count > 0; count-- {
+		record := new(NodeRecord)
+		consumed, err := record.Unmarshal(buf[offset:])
+		if err != nil {
+			return err
+		}
+		m.Nodes = append(m.Nodes, record)
+		offset += consumed
+	}
+	return nil
+}
+
+func (m *JoinResponse) Size() uint {
+	size := uint(JOIN_RESPONSE_FIXED_SIZE)
+	for _, record := range m.Nodes {
+		size += record.Size()
+	}
+	return size
+}
+
+// MACBytes : Content covered by MAC.
+func (m *JoinResponse) MACBytes() []byte {
+	buf := m.Marshal()
+	copy(buf[67:99], make([]byte, JOIN_MAC_SIZE))
+	return buf
 }
 
 // NodeActivate : An existing node is up.
 type NodeActivate struct {
-	ID uuid.UUID
+	ID        uuid.UUID
+	Signature [SIGNATURE_SIZE]byte
 }
 
 func NewNodeActivateMessage(id uuid.UUID) *NodeActivate {
@@ -76,10 +306,10 @@ func NewNodeActivateMessage(id uuid.UUID) *NodeActivate {
 }
 
 func (m *NodeActivate) Size() uint {
-	return uint(binary.Size(m.ID))
+	return uint(binary.Size(*m))
 }
 
-func (m *NodeActivate) Type() uint8 {
+func (m *NodeActivate) Type() uint16 {
 	return NODE_ACTIVATE
 }
 
@@ -93,7 +323,8 @@ func (m *NodeActivate) Place(buf []byte) error {
 	if uint(len(buf)) < m.Size() {
 		return errors.New(ERR_BUFFER_SMALL)
 	}
-	copy(buf[0:binary.Size(m.ID)], m.ID[:])
+	copy(buf[0:16], m.ID[:])
+	copy(buf[16:80], m.Signature[:])
 	return nil
 }
 
@@ -101,26 +332,50 @@ func (m *NodeActivate) Unmarshal(buf []byte) error {
 	if uint(len(buf)) < m.Size() {
 		return fmt.Errorf("Not a valid NodeActivate message.")
 	}
-	copy(m.ID[:], buf[0:binary.Size(m.ID)])
+	copy(m.ID[:], buf[0:16])
+	copy(m.Signature[:], buf[16:80])
 	return nil
 }
 
+func (m *NodeActivate) SignedBytes() []byte {
+	return m.ID[:]
+}
+
+func (m *NodeActivate) SignatureRef() []byte {
+	return m.Signature[:]
+}
+
 // Heartbeat : Liveness pulse signal.
 // Subtype: Master Heartbeat, Node Heartbeat
+// Reach lists nodes the sender hears from directly, from which relay routes are computed.
 type Heartbeat struct {
-	NetName [16]byte
-	Master  uuid.UUID
-	Term    uint64
-	Index   uint64
+	NetName   [16]byte
+	Master    uuid.UUID
+	Node      uuid.UUID
+	Term      uint64
+	Index     uint64
+	Commit    uint64 // Highest log index committed by majority, as known by sender.
+	Reach     []uuid.UUID
+	Signature [SIGNATURE_SIZE]byte
+
+	kind uint16
 }
 
-func NewHeartbeat() *Heartbeat {
-	m := new(Heartbeat)
-	return m
+const (
+	HEARTBEAT_FIXED_SIZE = 16 + 16 + 16 + 8 + 8 + 8 + 2 + SIGNATURE_SIZE
+	HEARTBEAT_MAX_REACH  = 256
+)
+
+// NewHeartbeat : New heartbeat of subtype HEARTBEAT_MASTER or HEARTBEAT_NODE.
+func NewHeartbeat(hb_type uint16) *Heartbeat {
+	return &Heartbeat{kind: hb_type}
 }
 
-func (m *Heartbeat) Type() uint8 {
-	return NODE_ACTIVATE
+func (m *Heartbeat) Type() uint16 {
+	if m.kind == HEARTBEAT_MASTER {
+		return HEARTBEAT_MASTER
+	}
+	return HEARTBEAT_NODE
 }
 
 func (m *Heartbeat) Marshal() []byte {
@@ -133,24 +388,656 @@ func (m *Heartbeat) Place(buf []byte) error {
 	if uint(len(buf)) < m.Size() {
 		return errors.New(ERR_BUFFER_SMALL)
 	}
+	if len(m.Reach) > HEARTBEAT_MAX_REACH {
+		return fmt.Errorf("Too many reachable nodes in Heartbeat.")
+	}
 	copy(buf[0:16], m.NetName[:])
 	copy(buf[16:32], m.Master[:])
+	copy(buf[32:48], m.Node[:])
+	binary.BigEndian.PutUint64(buf[48:56], m.Term)
+	binary.BigEndian.PutUint64(buf[56:64], m.Index)
+	binary.BigEndian.PutUint64(buf[64:72], m.Commit)
+	binary.BigEndian.PutUint16(buf[72:74], uint16(len(m.Reach)))
+	offset := 74
+	for _, id := range m.Reach {
+		copy(buf[offset:offset+16], id[:])
+		offset += 16
+	}
+	copy(buf[offset:offset+SIGNATURE_SIZE], m.Signature[:])
+	return nil
+}
+
+func (m *Heartbeat) Unmarshal(buf []byte) error {
+	if len(buf) < HEARTBEAT_FIXED_SIZE {
+		return fmt.Errorf("Not a valid Heartbeat message.")
+	}
+	count := int(binary.BigEndian.Uint16(buf[72:74]))
+	if count > HEARTBEAT_MAX_REACH || len(buf) < HEARTBEAT_FIXED_SIZE+count*16 {
+		return fmt.Errorf("Not a valid Heartbeat message.")
+	}
+	copy(m.NetName[:], buf[0:16])
+	copy(m.Master[:], buf[16:32])
+	copy(m.Node[:], buf[32:48])
+	m.Term = binary.BigEndian.Uint64(buf[48:56])
+	m.Index = binary.BigEndian.Uint64(buf[56:64])
+	m.Commit = binary.BigEndian.Uint64(buf[64:72])
+	m.Reach = make([]uuid.UUID, count)
+	offset := 74
+	for idx := range m.Reach {
+		copy(m.Reach[idx][:], buf[offset:offset+16])
+		offset += 16
+	}
+	copy(m.Signature[:], buf[offset:offset+SIGNATURE_SIZE])
+	return nil
+}
+
+func (m *Heartbeat) Size() uint {
+	return uint(HEARTBEAT_FIXED_SIZE + len(m.Reach)*16)
+}
+
+func (m *Heartbeat) SignedBytes() []byte {
+	return m.Marshal()[:m.Size()-SIGNATURE_SIZE]
+}
+
+func (m *Heartbeat) SignatureRef() []byte {
+	return m.Signature[:]
+}
+
+// VoteRequest : Candidate asks for vote in a new term. Index and LogTerm describe last entry in candidate's log.
+type VoteRequest struct {
+	NetName   [16]byte
+	Candidate uuid.UUID
+	Term      uint64
+	Index     uint64
+	LogTerm   uint64
+	Signature [SIGNATURE_SIZE]byte
+}
+
+func NewVoteRequest(network_name string, candidate uuid.UUID, term uint64, index uint64, log_term uint64) *VoteRequest {
+	m := &VoteRequest{
+		Candidate: candidate,
+		Term:      term,
+		Index:     index,
+		LogTerm:   log_term,
+	}
+	copy(m.NetName[:], network_name)
+	return m
+}
+
+func (m *VoteRequest) Type() uint16 {
+	return VOTE_REQUEST
+}
+
+func (m *VoteRequest) Marshal() []byte {
+	buf := make([]byte, m.Size())
+	m.Place(buf)
+	return buf
+}
+
+func (m *VoteRequest) Place(buf []byte) error {
+	if uint(len(buf)) < m.Size() {
+		return errors.New(ERR_BUFFER_SMALL)
+	}
+	copy(buf[0:16], m.NetName[:])
+	copy(buf[16:32], m.Candidate[:])
 	binary.BigEndian.PutUint64(buf[32:40], m.Term)
 	binary.BigEndian.PutUint64(buf[40:48], m.Index)
+	binary.BigEndian.PutUint64(buf[48:56], m.LogTerm)
+	copy(buf[56:56+SIGNATURE_SIZE], m.Signature[:])
 	return nil
 }
 
-func (m *Heartbeat) Unmarshal(buf []byte) error {
+func (m *VoteRequest) Unmarshal(buf []byte) error {
 	if uint(len(buf)) < m.Size() {
-		return fmt.Errorf("Not a valid Heartbeat message.")
+		return fmt.Errorf("Not a valid VoteRequest message.")
+	}
+	copy(m.NetName[:], buf[0:16])
+	copy(m.Candidate[:], buf[16:32])
+	m.Term = binary.BigEndian.Uint64(buf[32:40])
+	m.Index = binary.BigEndian.Uint64(buf[40:48])
+	m.LogTerm = binary.BigEndian.Uint64(buf[48:56])
+	copy(m.Signature[:], buf[56:56+SIGNATURE_SIZE])
+	return nil
+}
+
+func (m *VoteRequest) Size() uint {
+	return uint(binary.Size(*m))
+}
+
+func (m *VoteRequest) SignedBytes() []byte {
+	return m.Marshal()[:m.Size()-SIGNATURE_SIZE]
+}
+
+func (m *VoteRequest) SignatureRef() []byte {
+	return m.Signature[:]
+}
+
+// VoteResponse : Vote result replied to candidate.
+type VoteResponse struct {
+	NetName   [16]byte
+	Voter     uuid.UUID
+	Term      uint64
+	Granted   bool
+	Signature [SIGNATURE_SIZE]byte
+}
+
+func NewVoteResponse(network_name string, voter uuid.UUID, term uint64, granted bool) *VoteResponse {
+	m := &VoteResponse{
+		Voter:   voter,
+		Term:    term,
+		Granted: granted,
+	}
+	copy(m.NetName[:], network_name)
+	return m
+}
+
+func (m *VoteResponse) Type() uint16 {
+	return VOTE_RESPONSE
+}
+
+func (m *VoteResponse) Marshal() []byte {
+	buf := make([]byte, m.Size())
+	m.Place(buf)
+	return buf
+}
+
+func (m *VoteResponse) Place(buf []byte) error {
+	if uint(len(buf)) < m.Size() {
+		return errors.New(ERR_BUFFER_SMALL)
+	}
+	copy(buf[0:16], m.NetName[:])
+	copy(buf[16:32], m.Voter[:])
+	binary.BigEndian.PutUint64(buf[32:40], m.Term)
+	if m.Granted {
+		buf[40] = 1
+	} else {
+		buf[40] = 0
+	}
+	copy(buf[41:41+SIGNATURE_SIZE], m.Signature[:])
+	return nil
+}
+
+func (m *VoteResponse) Unmarshal(buf []byte) error {
+	if uint(len(buf)) < m.Size() {
+		return fmt.Errorf("Not a valid VoteResponse message.")
+	}
+	copy(m.NetName[:], buf[0:16])
+	copy(m.Voter[:], buf[16:32])
+	m.Term = binary.BigEndian.Uint64(buf[32:40])
+	m.Granted = buf[40] != 0
+	copy(m.Signature[:], buf[41:41+SIGNATURE_SIZE])
+	return nil
+}
+
+func (m *VoteResponse) Size() uint {
+	return uint(binary.Size(*m))
+}
+
+func (m *VoteResponse) SignedBytes() []byte {
+	return m.Marshal()[:m.Size()-SIGNATURE_SIZE]
+}
+
+func (m *VoteResponse) SignatureRef() []byte {
+	return m.Signature[:]
+}
+
+// LogEntry : Membership log entry replicated by master.
+// Master is the master of Term that issued the entry, and equals Issuer. Whole entry but
+// signature is signed, so that it is verifiable when served again by later masters.
+type LogEntry struct {
+	NetName           [16]byte
+	Master            uuid.UUID
+	Index             uint64
+	Term              uint64
+	Op                uint8
+	Node              uuid.UUID
+	Token             uuid.UUID
+	TokenExpireBefore uint64
+	TokenExpireAfter  uint64
+	Key               [32]byte
+	Identity          [32]byte
+	Issuer            uuid.UUID
+	Name              string
+	Publish           []*Endpoint
+	Prefixes          []*net.IPNet
+	Signature         [SIGNATURE_SIZE]byte
+}
+
+const (
+	LOG_ENTRY_FIXED_SIZE = 16 + 16 + 8 + 8 + 1 + 16 + 16 + 8 + 8 + 32 + 32 + 16 + 1 + 1 + 1 + SIGNATURE_SIZE
+	LOG_ENTRY_MAX_NAME   = 0xFF
+)
+
+func NewLogEntry(network_name string, master uuid.UUID) *LogEntry {
+	m := &LogEntry{
+		Master: master,
+	}
+	copy(m.NetName[:], network_name)
+	return m
+}
+
+func (m *LogEntry) Type() uint16 {
+	return LOG_ENTRY
+}
+
+func (m *LogEntry) Marshal() []byte {
+	buf := make([]byte, m.Size())
+	m.Place(buf)
+	return buf
+}
+
+func (m *LogEntry) Place(buf []byte) error {
+	if uint(len(buf)) < m.Size() {
+		return errors.New(ERR_BUFFER_SMALL)
+	}
+	if len(m.Name) > LOG_ENTRY_MAX_NAME {
+		return fmt.Errorf("LogEntry too large.")
+	}
+	copy(buf[0:16], m.NetName[:])
+	copy(buf[16:32], m.Master[:])
+	binary.BigEndian.PutUint64(buf[32:40], m.Index)
+	binary.BigEndian.PutUint64(buf[40:48], m.Term)
+	buf[48] = m.Op
+	copy(buf[49:65], m.Node[:])
+	copy(buf[65:81], m.Token[:])
+	binary.BigEndian.PutUint64(buf[81:89], m.TokenExpireBefore)
+	binary.BigEndian.PutUint64(buf[89:97], m.TokenExpireAfter)
+	copy(buf[97:129], m.Key[:])
+	copy(buf[129:161], m.Identity[:])
+	copy(buf[161:177], m.Issuer[:])
+
+	offset := 177
+	buf[offset] = uint8(len(m.Name))
+	offset++
+	copy(buf[offset:offset+len(m.Name)], m.Name)
+	offset += len(m.Name)
+
+	placed, err := placeEndpoints(buf[offset:], m.Publish)
+	if err != nil {
+		return err
+	}
+	offset += placed
+	if placed, err = placePrefixes(buf[offset:], m.Prefixes); err != nil {
+		return err
+	}
+	offset += placed
+	copy(buf[offset:offset+SIGNATURE_SIZE], m.Signature[:])
+	return nil
+}
+
+func (m *LogEntry) Unmarshal(buf []byte) error {
+	if len(buf) < LOG_ENTRY_FIXED_SIZE {
+		return fmt.Errorf("Not a valid LogEntry message.")
 	}
 	copy(m.NetName[:], buf[0:16])
 	copy(m.Master[:], buf[16:32])
+	m.Index = binary.BigEndian.Uint64(buf[32:40])
+	m.Term = binary.BigEndian.Uint64(buf[40:48])
+	m.Op = buf[48]
+	copy(m.Node[:], buf[49:65])
+	copy(m.Token[:], buf[65:81])
+	m.TokenExpireBefore = binary.BigEndian.Uint64(buf[81:89])
+	m.TokenExpireAfter = binary.BigEndian.Uint64(buf[89:97])
+	copy(m.Key[:], buf[97:129])
+	copy(m.Identity[:], buf[129:161])
+	copy(m.Issuer[:], buf[161:177])
+
+	offset := 177
+	name_len := int(buf[offset])
+	offset++
+	if len(buf) < offset+name_len+1 {
+		return fmt.Errorf("Not a valid LogEntry message. (truncated name)")
+	}
+	m.Name = string(buf[offset : offset+name_len])
+	offset += name_len
+
+	publish, consumed, err := unmarshalEndpoints(buf[offset:])
+	if err != nil {
+		return err
+	}
+	offset += consumed
+	prefixes, consumed, err := unmarshalPrefixes(buf[offset:])
+	if err != nil {
+		return err
+	}
+	offset += consumed
+	if len(buf) < offset+SIGNATURE_SIZE {
+		return fmt.Errorf("Not a valid LogEntry message. (no signature)")
+	}
+	m.Publish = publish
+	m.Prefixes = prefixes
+	copy(m.Signature[:], buf[offset:offset+SIGNATURE_SIZE])
+	return nil
+}
+
+func (m *LogEntry) Size() uint {
+	return uint(LOG_ENTRY_FIXED_SIZE + len(m.Name) + len(m.Publish)*ENDPOINT_SIZE + len(m.Prefixes)*PREFIX_SIZE)
+}
+
+// SignedBytes : Entry is signed by its issuer. Master serving the entry is not covered.
+func (m *LogEntry) SignedBytes() []byte {
+	unsigned := *m
+	unsigned.Signature = [SIGNATURE_SIZE]byte{}
+	return unsigned.Marshal()
+}
+
+func (m *LogEntry) SignatureRef() []byte {
+	return m.Signature[:]
+}
+
+// LogFetch : Ask master for log entries in [Begin, End).
+type LogFetch struct {
+	NetName [16]byte
+	Node    uuid.UUID
+	Begin   uint64
+	End     uint64
+}
+
+func NewLogFetch(network_name string, node uuid.UUID, begin uint64, end uint64) *LogFetch {
+	m := &LogFetch{
+		Node:  node,
+		Begin: begin,
+		End:   end,
+	}
+	copy(m.NetName[:], network_name)
+	return m
+}
+
+func (m *LogFetch) Type() uint16 {
+	return LOG_FETCH
+}
+
+func (m *LogFetch) Marshal() []byte {
+	buf := make([]byte, m.Size())
+	m.Place(buf)
+	return buf
+}
+
+func (m *LogFetch) Place(buf []byte) error {
+	if uint(len(buf)) < m.Size() {
+		return errors.New(ERR_BUFFER_SMALL)
+	}
+	copy(buf[0:16], m.NetName[:])
+	copy(buf[16:32], m.Node[:])
+	binary.BigEndian.PutUint64(buf[32:40], m.Begin)
+	binary.BigEndian.PutUint64(buf[40:48], m.End)
+	return nil
+}
+
+func (m *LogFetch) Unmarshal(buf []byte) error {
+	if uint(len(buf)) < m.Size() {
+		return fmt.Errorf("Not a valid LogFetch message.")
+	}
+	copy(m.NetName[:], buf[0:16])
+	copy(m.Node[:], buf[16:32])
+	m.Begin = binary.BigEndian.Uint64(buf[32:40])
+	m.End = binary.BigEndian.Uint64(buf[40:48])
+	return nil
+}
+
+func (m *LogFetch) Size() uint {
+	return uint(binary.Size(*m))
+}
+
+// Handshake : Exchange ephemeral keys to establish peer session.
+// Initiator leaves PeerEphemeral zero. Responder echoes initiator's ephemeral key in it.
+type Handshake struct {
+	NetName       [16]byte
+	Node          uuid.UUID
+	Peer          uuid.UUID
+	Reply         bool
+	Ephemeral     [32]byte
+	PeerEphemeral [32]byte
+	Signature     [SIGNATURE_SIZE]byte
+}
+
+func NewHandshake(network_name string, node uuid.UUID, peer uuid.UUID) *Handshake {
+	m := &Handshake{
+		Node: node,
+		Peer: peer,
+	}
+	copy(m.NetName[:], network_name)
+	return m
+}
+
+func (m *Handshake) Type() uint16 {
+	return HANDSHAKE
+}
+
+func (m *Handshake) Marshal() []byte {
+	buf := make([]byte, m.Size())
+	m.Place(buf)
+	return buf
+}
+
+func (m *Handshake) Place(buf []byte) error {
+	if uint(len(buf)) < m.Size() {
+		return errors.New(ERR_BUFFER_SMALL)
+	}
+	copy(buf[0:16], m.NetName[:])
+	copy(buf[16:32], m.Node[:])
+	copy(buf[32:48], m.Peer[:])
+	if m.Reply {
+		buf[48] = 1
+	} else {
+		buf[48] = 0
+	}
+	copy(buf[49:81], m.Ephemeral[:])
+	copy(buf[81:113], m.PeerEphemeral[:])
+	copy(buf[113:177], m.Signature[:])
+	return nil
+}
+
+func (m *Handshake) Unmarshal(buf []byte) error {
+	if uint(len(buf)) < m.Size() {
+		return fmt.Errorf("Not a valid Handshake message.")
+	}
+	copy(m.NetName[:], buf[0:16])
+	copy(m.Node[:], buf[16:32])
+	copy(m.Peer[:], buf[32:48])
+	m.Reply = buf[48] != 0
+	copy(m.Ephemeral[:], buf[49:81])
+	copy(m.PeerEphemeral[:], buf[81:113])
+	copy(m.Signature[:], buf[113:177])
+	return nil
+}
+
+func (m *Handshake) Size() uint {
+	return uint(binary.Size(*m))
+}
+
+func (m *Handshake) SignedBytes() []byte {
+	return m.Marshal()[:113]
+}
+
+func (m *Handshake) SignatureRef() []byte {
+	return m.Signature[:]
+}
+
+// PathProbe : Padded probe of path MTU. Receiver replies with an unpadded probe of same ID and Length.
+// Length is total OVT packet size of the probe.
+type PathProbe struct {
+	Node    uuid.UUID
+	ID      uint32
+	Length  uint16
+	Reply   bool
+	Padding uint16
+}
+
+const (
+	PATH_PROBE_FIXED_SIZE = 16 + 4 + 2 + 1
+)
+
+func (m *PathProbe) Type() uint16 {
+	return PATH_PROBE
+}
+
+func (m *PathProbe) Marshal() []byte {
+	buf := make([]byte, m.Size())
+	m.Place(buf)
+	return buf
+}
+
+func (m *PathProbe) Place(buf []byte) error {
+	if uint(len(buf)) < m.Size() {
+		return errors.New(ERR_BUFFER_SMALL)
+	}
+	copy(buf[0:16], m.Node[:])
+	binary.BigEndian.PutUint32(buf[16:20], m.ID)
+	binary.BigEndian.PutUint16(buf[20:22], m.Length)
+	if m.Reply {
+		buf[22] = 1
+	} else {
+		buf[22] = 0
+	}
+	padding := buf[PATH_PROBE_FIXED_SIZE:m.Size()]
+	for i := range padding {
+		padding[i] = 0
+	}
+	return nil
+}
+
+func (m *PathProbe) Unmarshal(buf []byte) error {
+	if len(buf) < PATH_PROBE_FIXED_SIZE {
+		return fmt.Errorf("Not a valid PathProbe message.")
+	}
+	copy(m.Node[:], buf[0:16])
+	m.ID = binary.BigEndian.Uint32(buf[16:20])
+	m.Length = binary.BigEndian.Uint16(buf[20:22])
+	m.Reply = buf[22] != 0
+	m.Padding = uint16(len(buf) - PATH_PROBE_FIXED_SIZE)
+	return nil
+}
+
+func (m *PathProbe) Size() uint {
+	return PATH_PROBE_FIXED_SIZE + uint(m.Padding)
+}
+
+// LogAck : Follower has log entries up to Index matching master of Term.
+type LogAck struct {
+	NetName   [16]byte
+	Node      uuid.UUID
+	Term      uint64
+	Index     uint64
+	Signature [SIGNATURE_SIZE]byte
+}
+
+func NewLogAck(network_name string, node uuid.UUID, term uint64, index uint64) *LogAck {
+	m := &LogAck{
+		Node:  node,
+		Term:  term,
+		Index: index,
+	}
+	copy(m.NetName[:], network_name)
+	return m
+}
+
+func (m *LogAck) Type() uint16 {
+	return LOG_ACK
+}
+
+func (m *LogAck) Marshal() []byte {
+	buf := make([]byte, m.Size())
+	m.Place(buf)
+	return buf
+}
+
+func (m *LogAck) Place(buf []byte) error {
+	if uint(len(buf)) < m.Size() {
+		return errors.New(ERR_BUFFER_SMALL)
+	}
+	copy(buf[0:16], m.NetName[:])
+	copy(buf[16:32], m.Node[:])
+	binary.BigEndian.PutUint64(buf[32:40], m.Term)
+	binary.BigEndian.PutUint64(buf[40:48], m.Index)
+	copy(buf[48:48+SIGNATURE_SIZE], m.Signature[:])
+	return nil
+}
+
+func (m *LogAck) Unmarshal(buf []byte) error {
+	if uint(len(buf)) < m.Size() {
+		return fmt.Errorf("Not a valid LogAck message.")
+	}
+	copy(m.NetName[:], buf[0:16])
+	copy(m.Node[:], buf[16:32])
 	m.Term = binary.BigEndian.Uint64(buf[32:40])
 	m.Index = binary.BigEndian.Uint64(buf[40:48])
+	copy(m.Signature[:], buf[48:48+SIGNATURE_SIZE])
 	return nil
 }
 
-func (m *Heartbeat) Size() uint {
+func (m *LogAck) Size() uint {
 	return uint(binary.Size(*m))
 }
+
+func (m *LogAck) SignedBytes() []byte {
+	return m.Marshal()[:m.Size()-SIGNATURE_SIZE]
+}
+
+func (m *LogAck) SignatureRef() []byte {
+	return m.Signature[:]
+}
+
+// PathEcho : Timestamped probe over one underlay path of peer, measuring its RTT, jitter and loss.
+// Receiver replies with the same ID and Timestamp to address probe comes from. Timestamp is taken
+// by clock of sender in nanoseconds, so only sender interprets it.
+type PathEcho struct {
+	Node      uuid.UUID
+	ID        uint32
+	Reply     bool
+	Timestamp int64
+}
+
+const (
+	PATH_ECHO_SIZE = 16 + 4 + 1 + 8
+)
+
+func (m *PathEcho) Type() uint16 {
+	return PATH_ECHO
+}
+
+func (m *PathEcho) Marshal() []byte {
+	buf := make([]byte, m.Size())
+	m.Place(buf)
+	return buf
+}
+
+func (m *PathEcho) Place(buf []byte) error {
+	if uint(len(buf)) < m.Size() {
+		return errors.New(ERR_BUFFER_SMALL)
+	}
+	copy(buf[0:16], m.Node[:])
+	binary.BigEndian.PutUint32(buf[16:20], m.ID)
+	if m.Reply {
+		buf[20] = 1
+	} else {
+		buf[20] = 0
+	}
+	binary.BigEndian.PutUint64(buf[21:29], uint64(m.Timestamp))
+	return nil
+}
+
+func (m *PathEcho) Unmarshal(buf []byte) error {
+	if len(buf) < PATH_ECHO_SIZE {
+		return fmt.Errorf("Not a valid PathEcho message.")
+	}
+	copy(m.Node[:], buf[0:16])
+	m.ID = binary.BigEndian.Uint32(buf[16:20])
+	m.Reply = buf[20] != 0
+	m.Timestamp = int64(binary.BigEndian.Uint64(buf[21:29]))
+	return nil
+}
+
+func (m *PathEcho) Size() uint {
+	return PATH_ECHO_SIZE
+}
+
+// LogPropose : Membership change about sender itself, proposed to master.
+// Issuer and Node are both sender. Master issues accepted change as its own entry.
+type LogPropose struct {
+	LogEntry
+}
+
+func (m *LogPropose) Type() uint16 {
+	return LOG_PROPOSE
+}
@@ -0,0 +1,177 @@
+package protocol
+
+import (
+	"bytes"
+	"github.com/google/uuid"
+	"net"
+	"testing"
+)
+
+func test_endpoints() []*Endpoint {
+	return []*Endpoint{
+		{IP: net.ParseIP("192.168.0.1"), Port: 3000},
+		{IP: net.ParseIP("fd00::1"), Port: 0},
+	}
+}
+
+func test_prefixes(t *testing.T) []*net.IPNet {
+	prefixes := make([]*net.IPNet, 0)
+	for _, raw := range []string{"10.1.0.0/16", "192.168.0.1", "fd00::/8"} {
+		prefix, err := ParsePrefix(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+func test_signature() [SIGNATURE_SIZE]byte {
+	var signature [SIGNATURE_SIZE]byte
+	for i := range signature {
+		signature[i] = byte(i)
+	}
+	return signature
+}
+
+func test_log_entry(t *testing.T) *LogEntry {
+	m := NewLogEntry("net0", uuid.New())
+	m.Index = 12
+	m.Term = 3
+	m.Op = LOG_NODE_ADD
+	m.Node = uuid.New()
+	m.Token = uuid.New()
+	m.TokenExpireBefore = 100
+	m.TokenExpireAfter = 200
+	m.Key[0] = 1
+	m.Identity[0] = 2
+	m.Issuer = m.Master
+	m.Name = "node_a"
+	m.Publish = test_endpoints()
+	m.Prefixes = test_prefixes(t)
+	m.Signature = test_signature()
+	return m
+}
+
+func test_messages(t *testing.T) []Message {
+	join_req := NewJoinRequest("net0", uuid.New())
+	join_req.Node = uuid.New()
+	join_req.Key[0] = 1
+	join_req.Identity[0] = 2
+	join_req.Publish = test_endpoints()
+	join_req.Prefixes = test_prefixes(t)
+	join_req.Signature = test_signature()
+
+	join_resp := NewJoinResponse("net0", JOIN_ACCEPT)
+	join_resp.Master = uuid.New()
+	join_resp.Node = uuid.New()
+	join_resp.Term = 3
+	join_resp.Index = 12
+	join_resp.Total = 2
+	join_resp.MAC[0] = 1
+	join_resp.Nodes = []*NodeRecord{
+		{ID: uuid.New(), Name: "node_a", Publish: test_endpoints(), Prefixes: test_prefixes(t)},
+		{ID: uuid.New(), Name: ""},
+	}
+
+	activate := NewNodeActivateMessage(uuid.New())
+	activate.Signature = test_signature()
+
+	hb := NewHeartbeat(HEARTBEAT_MASTER)
+	copy(hb.NetName[:], "net0")
+	hb.Master = uuid.New()
+	hb.Node = hb.Master
+	hb.Term = 3
+	hb.Index = 12
+	hb.Commit = 11
+	hb.Reach = []uuid.UUID{uuid.New(), uuid.New()}
+	hb.Signature = test_signature()
+
+	vote_req := NewVoteRequest("net0", uuid.New(), 4, 12, 3)
+	vote_req.Signature = test_signature()
+
+	vote_resp := NewVoteResponse("net0", uuid.New(), 4, true)
+	vote_resp.Signature = test_signature()
+
+	handshake := NewHandshake("net0", uuid.New(), uuid.New())
+	handshake.Reply = true
+	handshake.Ephemeral[0] = 1
+	handshake.PeerEphemeral[0] = 2
+	handshake.Signature = test_signature()
+
+	ack := NewLogAck("net0", uuid.New(), 3, 12)
+	ack.Signature = test_signature()
+
+	return []Message{
+		join_req,
+		join_resp,
+		activate,
+		hb,
+		vote_req,
+		vote_resp,
+		test_log_entry(t),
+		NewLogFetch("net0", uuid.New(), 5, 12),
+		handshake,
+		&PathProbe{Node: uuid.New(), ID: 7, Length: 1400, Reply: true, Padding: 32},
+		ack,
+		&PathEcho{Node: uuid.New(), ID: 7, Reply: true, Timestamp: 1234567},
+		&LogPropose{LogEntry: *test_log_entry(t)},
+	}
+}
+
+// fixed_size : Bytes message cannot be unmarshaled without. Padding of probe is optional.
+func fixed_size(m Message, buf []byte) int {
+	if _, ok := m.(*PathProbe); ok {
+		return PATH_PROBE_FIXED_SIZE
+	}
+	return len(buf)
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	for _, m := range test_messages(t) {
+		buf := m.Marshal()
+		if uint(len(buf)) != m.Size() {
+			t.Errorf("Type %v: marshaled %v bytes, size %v", m.Type(), len(buf), m.Size())
+		}
+
+		decoded, known := NewMessage(m.Type())
+		if !known {
+			t.Errorf("Type %v: not registered", m.Type())
+			continue
+		}
+		if err := decoded.Unmarshal(buf); err != nil {
+			t.Errorf("Type %v: %v", m.Type(), err)
+			continue
+		}
+		if !bytes.Equal(decoded.Marshal(), buf) {
+			t.Errorf("Type %v: decoded message marshals differently.\n got: %x\nwant: %x", m.Type(), decoded.Marshal(), buf)
+		}
+
+		placed := make([]byte, len(buf))
+		if err := m.Place(placed); err != nil || !bytes.Equal(placed, buf) {
+			t.Errorf("Type %v: Place differs from Marshal. (err: %v)", m.Type(), err)
+		}
+		if len(buf) > 0 && m.Place(placed[:len(buf)-1]) == nil {
+			t.Errorf("Type %v: Place into small buffer succeeded", m.Type())
+		}
+	}
+}
+
+func TestMessageTruncated(t *testing.T) {
+	for _, m := range test_messages(t) {
+		buf := m.Marshal()
+		for size := 0; size < fixed_size(m, buf); size++ {
+			decoded, _ := NewMessage(m.Type())
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Errorf("Type %v: Unmarshal of %v/%v bytes panics: %v", m.Type(), size, len(buf), r)
+					}
+				}()
+				if err := decoded.Unmarshal(buf[:size]); err == nil {
+					t.Errorf("Type %v: Unmarshal of %v/%v bytes succeeded", m.Type(), size, len(buf))
+				}
+			}()
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"github.com/google/uuid"
 )
 
 // Packet Encapsulation
@@ -21,6 +22,29 @@ type OVTPacket []byte
 // +-----------------+
 // |  Payload (+12)  |
 // +-----------------+
+//
+// Extended header (VERSION_EXTENDED, VERSION_SECURE)
+// +-----------------+
+// |   OVT Header    |
+// |   (+0, 12byte)  |
+// +-----------------+
+// |  Sender (+12)   |
+// |    (16byte)     |
+// +--------+--------+
+// | Epoch  |
+// | (+28)  |
+// +--------+--------+
+// |  Sequence (+32) |
+// |    (8byte)      |
+// +-----------------+
+// |  Network (+40)  |
+// +-----------------+
+// |  Payload (+44)  |
+// +-----------------+
+//
+// Epoch is renewed when sender restarts. Sequence increases on every packet
+// sent to the same peer within an epoch. Network is hash of network name, so
+// networks sharing one underlay socket tell their packets apart.
 
 type OVTEncapsulatedPacket interface {
 	OVTPacketRef() OVTPacket
@@ -36,10 +60,17 @@ var (
 	OVT_VERSION = 0xAA
 	OVT_MAGIC   = [4]byte{'O', 'V', 'T', 0xAA}
 	VERSION     = [2]byte{1, 0}
+
+	// Header is extended by sender, epoch, sequence and network.
+	VERSION_EXTENDED = [2]byte{1, 2}
+
+	// Payload of packet with this version is sealed by peer session.
+	VERSION_SECURE = [2]byte{2, 1}
 )
 
 const (
-	OVT_HEADER_SIZE = 12
+	OVT_HEADER_SIZE      = 12
+	EXTENDED_HEADER_SIZE = OVT_HEADER_SIZE + 16 + 4 + 8 + 4
 
 	PKG_TOO_SHORT = "Packet too short."
 	PKG_INVALID   = "Not a OVTPacket."
@@ -51,6 +82,36 @@ const (
 	HEARTBEAT_MASTER
 	HEARTBEAT_NODE
 	JOIN_REQUEST
+	VOTE_REQUEST
+	VOTE_RESPONSE
+	LOG_ENTRY
+	LOG_FETCH
+	JOIN_RESPONSE
+	HANDSHAKE
+	FRAGMENT
+	PATH_PROBE
+	RELAY
+	PATH_ECHO
+	LOG_ACK
+	LOG_PROPOSE
+)
+
+// Join status
+const (
+	JOIN_ACCEPT = iota
+	JOIN_REJECT_TOKEN
+	JOIN_REJECT_EXPIRED
+	JOIN_REJECT_NO_MASTER
+	JOIN_REDIRECT
+	JOIN_REJECT_IDENTITY
+)
+
+// Membership log operations
+const (
+	LOG_NODE_ADD = iota + 1
+	LOG_NODE_REMOVE
+	LOG_NODE_PUBLISH
+	LOG_TOKEN_ROTATE
 )
 
 func PlaceNewOVTPacket(buf []byte, payload_size uint, packet_type uint16) OVTPacket {
@@ -63,6 +124,27 @@ func PlaceNewOVTPacket(buf []byte, payload_size uint, packet_type uint16) OVTPac
 	return OVTPacket(buf)
 }
 
+// PlaceNewExtendedOVTPacket : Place packet with extended header. Length is set.
+func PlaceNewExtendedOVTPacket(buf []byte, payload_size uint, packet_type uint16, network uint32, sender uuid.UUID, epoch uint32, sequence uint64) OVTPacket {
+	return place_extended(buf, payload_size+EXTENDED_HEADER_SIZE, VERSION_EXTENDED, packet_type, network, sender, epoch, sequence)
+}
+
+func place_extended(buf []byte, size uint, version [2]byte, packet_type uint16, network uint32, sender uuid.UUID, epoch uint32, sequence uint64) OVTPacket {
+	if uint(len(buf)) < size {
+		return nil
+	}
+	buf = buf[:size]
+	copy(buf[0:4], OVT_MAGIC[:])
+	copy(buf[4:6], version[:])
+	binary.BigEndian.PutUint16(buf[6:8], packet_type)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(size))
+	copy(buf[12:28], sender[:])
+	binary.BigEndian.PutUint32(buf[28:32], epoch)
+	binary.BigEndian.PutUint64(buf[32:40], sequence)
+	binary.BigEndian.PutUint32(buf[40:44], network)
+	return OVTPacket(buf)
+}
+
 func OVTPacketUnpack(buf []byte, size_limit uint32) (bool, OVTPacket, error) {
 
 	if len(buf) < OVT_HEADER_SIZE {
@@ -81,6 +163,9 @@ func OVTPacketUnpack(buf []byte, size_limit uint32) (bool, OVTPacket, error) {
 	if enc_len > size_limit {
 		return true, nil, fmt.Errorf("Packet size limited for safety.")
 	}
+	if OVTPacket(buf).IsExtended() && enc_len < EXTENDED_HEADER_SIZE {
+		return true, nil, errors.New(PKG_TOO_SHORT)
+	}
 	return true, OVTPacket(buf), nil
 }
 
@@ -96,6 +181,40 @@ func (pack OVTPacket) Version() (uint8, uint8) {
 	return pack[4], pack[5]
 }
 
+func (pack OVTPacket) IsSecure() bool {
+	return pack[4] == VERSION_SECURE[0] && pack[5] == VERSION_SECURE[1]
+}
+
+func (pack OVTPacket) IsExtended() bool {
+	return pack.IsSecure() || (pack[4] == VERSION_EXTENDED[0] && pack[5] == VERSION_EXTENDED[1])
+}
+
+func (pack OVTPacket) Sender() uuid.UUID {
+	var id uuid.UUID
+	copy(id[:], pack[12:28])
+	return id
+}
+
+func (pack OVTPacket) Epoch() uint32 {
+	return binary.BigEndian.Uint32(pack[28:32])
+}
+
+func (pack OVTPacket) Sequence() uint64 {
+	return binary.BigEndian.Uint64(pack[32:40])
+}
+
+func (pack OVTPacket) Network() uint32 {
+	return binary.BigEndian.Uint32(pack[40:44])
+}
+
+// FrameContext : Type and extended header fields, which stay the same when packet is sealed or opened.
+func (pack OVTPacket) FrameContext() []byte {
+	context := make([]byte, 2+EXTENDED_HEADER_SIZE-OVT_HEADER_SIZE)
+	copy(context[0:2], pack[6:8])
+	copy(context[2:], pack[OVT_HEADER_SIZE:EXTENDED_HEADER_SIZE])
+	return context
+}
+
 func (pack OVTPacket) Pack() []byte {
 	var enc_len uint32
 
@@ -106,5 +225,8 @@ func (pack OVTPacket) Pack() []byte {
 }
 
 func (pack OVTPacket) PayloadRef() []byte {
+	if pack.IsExtended() {
+		return pack[EXTENDED_HEADER_SIZE:]
+	}
 	return pack[OVT_HEADER_SIZE:]
 }
@@ -0,0 +1,50 @@
+package protocol
+
+import (
+	"sync"
+)
+
+// MessageConstructor : Create an empty message to unmarshal into.
+type MessageConstructor func() Message
+
+var (
+	registry      = make(map[uint16]MessageConstructor)
+	registry_lock sync.RWMutex
+)
+
+// RegisterMessage : Map a packet type to its message.
+func RegisterMessage(msg_type uint16, constructor MessageConstructor) {
+	registry_lock.Lock()
+	registry[msg_type] = constructor
+	registry_lock.Unlock()
+}
+
+// NewMessage : Create an empty message of packet type. False if type is unknown.
+func NewMessage(msg_type uint16) (Message, bool) {
+	registry_lock.RLock()
+	constructor, ok := registry[msg_type]
+	registry_lock.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return constructor(), true
+}
+
+func init() {
+	RegisterMessage(NODE_ACTIVATE, func() Message { return new(NodeActivate) })
+	RegisterMessage(HEARTBEAT_MASTER, func() Message { return NewHeartbeat(HEARTBEAT_MASTER) })
+	RegisterMessage(HEARTBEAT_NODE, func() Message { return NewHeartbeat(HEARTBEAT_NODE) })
+	RegisterMessage(JOIN_REQUEST, func() Message { return new(JoinRequest) })
+	RegisterMessage(VOTE_REQUEST, func() Message { return new(VoteRequest) })
+	RegisterMessage(VOTE_RESPONSE, func() Message { return new(VoteResponse) })
+	RegisterMessage(LOG_ENTRY, func() Message { return new(LogEntry) })
+	RegisterMessage(LOG_FETCH, func() Message { return new(LogFetch) })
+	RegisterMessage(JOIN_RESPONSE, func() Message { return new(JoinResponse) })
+	RegisterMessage(HANDSHAKE, func() Message { return new(Handshake) })
+	RegisterMessage(FRAGMENT, func() Message { return new(Fragment) })
+	RegisterMessage(PATH_PROBE, func() Message { return new(PathProbe) })
+	RegisterMessage(RELAY, func() Message { return new(Relay) })
+	RegisterMessage(PATH_ECHO, func() Message { return new(PathEcho) })
+	RegisterMessage(LOG_ACK, func() Message { return new(LogAck) })
+	RegisterMessage(LOG_PROPOSE, func() Message { return new(LogPropose) })
+}
@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+)
+
+// Relay : OVT packet forwarded to node not reachable directly.
+// +-----------------+
+// | Destination(+0) |
+// |    (16byte)     |
+// +--------+--------+
+// |  Hops  |
+// | (+16)  |
+// +--------+--------+
+// |  Packet (+17)   |
+// +-----------------+
+//
+// Inner packet is sealed end-to-end by session of destination. Relay itself is
+// sealed hop-by-hop. Hops is decreased by every forwarder, and packet is dropped
+// when it runs out.
+type Relay struct {
+	Dest   uuid.UUID
+	Hops   uint8
+	Packet []byte
+}
+
+const (
+	RELAY_HEADER_SIZE = 16 + 1
+)
+
+func (m *Relay) Type() uint16 {
+	return RELAY
+}
+
+func (m *Relay) Marshal() []byte {
+	buf := make([]byte, m.Size())
+	m.Place(buf)
+	return buf
+}
+
+func (m *Relay) Place(buf []byte) error {
+	if uint(len(buf)) < m.Size() {
+		return errors.New(ERR_BUFFER_SMALL)
+	}
+	copy(buf[0:16], m.Dest[:])
+	buf[16] = m.Hops
+	copy(buf[RELAY_HEADER_SIZE:], m.Packet)
+	return nil
+}
+
+// Unmarshal : Packet refers to buf.
+func (m *Relay) Unmarshal(buf []byte) error {
+	if len(buf) < RELAY_HEADER_SIZE+OVT_HEADER_SIZE {
+		return fmt.Errorf("Not a valid Relay message.")
+	}
+	copy(m.Dest[:], buf[0:16])
+	m.Hops = buf[16]
+	m.Packet = buf[RELAY_HEADER_SIZE:]
+	return nil
+}
+
+func (m *Relay) Size() uint {
+	return uint(RELAY_HEADER_SIZE + len(m.Packet))
+}
@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"crypto/cipher"
+	"errors"
+	"github.com/google/uuid"
+)
+
+// Secure packet (VERSION_SECURE)
+// +-----------------+
+// | Extended Header |
+// |   (+0, 44byte)  |
+// +-----------------+
+// | Sealed payload  |
+// |     (+44)       |
+// +-----------------+
+// |  AEAD tag (16)  |
+// +-----------------+
+//
+// Extended header is authenticated as additional data.
+// Nonce is epoch and sequence, which never repeat for a sender.
+
+const (
+	SECURE_HEADER_SIZE = EXTENDED_HEADER_SIZE
+	SECURE_TAG_SIZE    = 16
+	SECURE_OVERHEAD    = SECURE_HEADER_SIZE + SECURE_TAG_SIZE
+
+	ERR_SECURE_TOO_SHORT = "Secure packet too short."
+	ERR_NOT_SECURE       = "Not a secure packet."
+)
+
+func (pack OVTPacket) nonce() []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, pack[28:40])
+	return nonce
+}
+
+// PlaceNewSecureOVTPacket : Place header of secure packet. Plaintext should be filled into SecurePayloadRef() before Seal().
+func PlaceNewSecureOVTPacket(buf []byte, payload_size uint, packet_type uint16, network uint32, sender uuid.UUID, epoch uint32, sequence uint64) OVTPacket {
+	return place_extended(buf, payload_size+SECURE_OVERHEAD, VERSION_SECURE, packet_type, network, sender, epoch, sequence)
+}
+
+func (pack OVTPacket) SecurePayloadRef() []byte {
+	return pack[SECURE_HEADER_SIZE : len(pack)-SECURE_TAG_SIZE]
+}
+
+// Seal : Encrypt payload in place.
+func (pack OVTPacket) Seal(aead cipher.AEAD) {
+	plain := pack.SecurePayloadRef()
+	aead.Seal(plain[:0], pack.nonce(), plain, pack[:SECURE_HEADER_SIZE])
+}
+
+// Open : Decrypt secure packet into a new packet. Opened packet keeps the secure header so
+// it is known to be authenticated.
+func (pack OVTPacket) Open(aead cipher.AEAD) (OVTPacket, error) {
+	if len(pack) < SECURE_OVERHEAD {
+		return nil, errors.New(ERR_SECURE_TOO_SHORT)
+	}
+	if !pack.IsSecure() {
+		return nil, errors.New(ERR_NOT_SECURE)
+	}
+
+	plain := make(OVTPacket, len(pack)-SECURE_TAG_SIZE)
+	copy(plain, pack[:SECURE_HEADER_SIZE])
+	if _, err := aead.Open(plain[SECURE_HEADER_SIZE:SECURE_HEADER_SIZE], pack.nonce(), pack[SECURE_HEADER_SIZE:], pack[:SECURE_HEADER_SIZE]); err != nil {
+		return nil, err
+	}
+	plain.Pack()
+	return plain, nil
+}
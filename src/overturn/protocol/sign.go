@@ -0,0 +1,46 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+)
+
+const (
+	SIGNATURE_SIZE = ed25519.SignatureSize
+)
+
+// SignedMessage : Message carrying signature of its issuer.
+type SignedMessage interface {
+	Message
+
+	// SignedBytes : Content covered by signature.
+	SignedBytes() []byte
+	SignatureRef() []byte
+}
+
+// MessageContext : Context binding signature to message type only.
+// Message signed by sender of packet should use OVTPacket.FrameContext() instead,
+// so that it can not be replayed in another packet.
+func MessageContext(msg_type uint16) []byte {
+	context := make([]byte, 2)
+	binary.BigEndian.PutUint16(context, msg_type)
+	return context
+}
+
+func signing_payload(context []byte, msg SignedMessage) []byte {
+	content := msg.SignedBytes()
+	payload := make([]byte, 0, len(context)+len(content))
+	payload = append(payload, context...)
+	return append(payload, content...)
+}
+
+func SignMessage(context []byte, msg SignedMessage, key ed25519.PrivateKey) {
+	copy(msg.SignatureRef(), ed25519.Sign(key, signing_payload(context, msg)))
+}
+
+func VerifyMessage(context []byte, msg SignedMessage, key ed25519.PublicKey) bool {
+	if len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(key, signing_payload(context, msg), msg.SignatureRef())
+}